@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"os"
 	"os/signal"
 	"strings"
@@ -11,8 +13,8 @@ import (
 	"time"
 
 	"ekiben-agent/internal/agent"
-	"ekiben-agent/internal/console"
 	"ekiben-agent/internal/config"
+	"ekiben-agent/internal/console"
 	"ekiben-agent/internal/db"
 	"ekiben-agent/internal/logger"
 	"ekiben-agent/internal/version"
@@ -53,30 +55,34 @@ func main() {
 		return
 	}
 	printLine(log.Infof, 250*time.Millisecond, "DB path: %s", log.Accent(cfg.DBPath))
+	for _, src := range cfg.Sources {
+		location := src.DBPath
+		if location == "" {
+			location = src.APIBaseURL
+		}
+		printLine(log.Infof, 250*time.Millisecond, "Source %s: %s", src.Name, log.Accent(location))
+	}
 	printLine(log.Infof, 250*time.Millisecond, "Press Ctrl+C to shut down")
 
 	cfg.SourceMode = strings.TrimSpace(strings.ToLower(cfg.SourceMode))
 
 	if cfg.SourceMode == "" {
-		log.Fatalf("missing required --source (direct|api)")
+		log.Fatalf("missing required --source (direct|api|hybrid)")
 	}
 
-	var sqlDB *sql.DB
-	var apiClient *db.APIClient
-	switch cfg.SourceMode {
-	case "direct":
-		sqlDB, err = db.Open(cfg.DBPath)
-		if err != nil {
-			log.Fatalf("open db: %v", err)
-		}
+	db.SetSlowQueryLog(cfg.SlowQueryThreshold, log.Warnf)
+	if err := checkTables(cfg.HybridDirectWrites); err != nil {
+		log.Fatalf("hybridDirectWrites: %v", err)
+	}
+	if err := checkResultCache(cfg, cfg.SourceMode); err != nil {
+		log.Fatalf("%v", err)
+	}
+	sqlDB, apiClient, err := openSource(cfg.SourceMode, cfg.DBPath, cfg.APIBaseURL, cfg.APIToken)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if sqlDB != nil {
 		defer sqlDB.Close()
-	case "api":
-		apiClient, err = db.NewAPIClient(cfg.APIBaseURL, cfg.APIToken)
-		if err != nil {
-			log.Fatalf("configure tls api client: %v", err)
-		}
-	default:
-		log.Fatalf("invalid --source %q (expected direct or api)", cfg.SourceMode)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -84,6 +90,29 @@ func main() {
 
 	ag := agent.New(cfg, sqlDB, apiClient, log)
 
+	seen := map[string]bool{config.DefaultSource: true}
+	for _, src := range cfg.Sources {
+		if src.Name == "" || seen[src.Name] {
+			log.Fatalf("source names must be unique and not empty or %q: %q", config.DefaultSource, src.Name)
+		}
+		seen[src.Name] = true
+		src.SourceMode = strings.TrimSpace(strings.ToLower(src.SourceMode))
+		if err := checkTables(src.HybridDirectWrites); err != nil {
+			log.Fatalf("source %s: hybridDirectWrites: %v", src.Name, err)
+		}
+		if err := checkResultCache(cfg, src.SourceMode); err != nil {
+			log.Fatalf("source %s: %v", src.Name, err)
+		}
+		srcDB, srcAPI, err := openSource(src.SourceMode, src.DBPath, src.APIBaseURL, src.APIToken)
+		if err != nil {
+			log.Fatalf("source %s: %v", src.Name, err)
+		}
+		if srcDB != nil {
+			defer srcDB.Close()
+		}
+		ag.AddSource(src, srcDB, srcAPI)
+	}
+
 	var shutdownOnce sync.Once
 	shutdownStarted := make(chan struct{})
 	shutdownDone := make(chan struct{})
@@ -134,3 +163,48 @@ func main() {
 	default:
 	}
 }
+
+// openSource connects to the database file or the TLS REST API of a data source, or to both in
+// hybrid mode.
+func openSource(mode, dbPath, apiBaseURL, apiToken string) (*sql.DB, *db.APIClient, error) {
+	if mode != "direct" && mode != "api" && mode != "hybrid" {
+		return nil, nil, fmt.Errorf("invalid source %q (expected direct, api or hybrid)", mode)
+	}
+	var apiClient *db.APIClient
+	if mode != "direct" {
+		var err error
+		apiClient, err = db.NewAPIClient(apiBaseURL, apiToken)
+		if err != nil {
+			return nil, nil, fmt.Errorf("configure tls api client: %w", err)
+		}
+	}
+	if mode == "api" {
+		return nil, apiClient, nil
+	}
+	sqlDB, err := db.Open(dbPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open db: %w", err)
+	}
+	return sqlDB, apiClient, nil
+}
+
+// checkTables rejects names that are not tables the agent knows, so a typo in hybridDirectWrites
+// is caught at startup instead of on the first refused write. The token ledger is not readable
+// through table.select but is written by tokens.grant and tokens.set.
+func checkTables(tables []string) error {
+	for _, table := range tables {
+		if _, ok := db.TableSchemas[table]; !ok && table != db.TokenLedgerTable {
+			return fmt.Errorf("unknown table: %s", table)
+		}
+	}
+	return nil
+}
+
+// checkResultCache rejects a result cache without a TTL in api mode. TLS writes are not visible
+// there, so nothing else would ever age an entry.
+func checkResultCache(cfg config.Config, mode string) error {
+	if mode == "api" && cfg.ResultCacheSize > 0 && cfg.ResultCacheTTL <= 0 {
+		return errors.New("resultCacheTtl must be above 0 in api mode; set resultCacheSize to 0 to disable the cache")
+	}
+	return nil
+}
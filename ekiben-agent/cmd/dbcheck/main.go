@@ -1,15 +1,36 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"ekiben-agent/internal/db"
 )
 
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		switch os.Args[1] {
+		case "sync":
+			runSync(os.Args[2:])
+		case "sync-export":
+			runSyncExport(os.Args[2:])
+		case "export":
+			runExport(os.Args[2:])
+		case "import":
+			runImport(os.Args[2:])
+		default:
+			log.Fatalf("unknown command: %s", os.Args[1])
+		}
+		return
+	}
+
 	var dbPath string
 	flag.StringVar(&dbPath, "db", "", "path to taiko.db3")
 	flag.Parse()
@@ -31,3 +52,274 @@ func main() {
 
 	fmt.Fprintf(os.Stdout, "UserData rows: %d\n", count)
 }
+
+// runSync applies best scores from another taiko.db3 or from an exported change set.
+func runSync(args []string) {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	dbPath := fs.String("db", "", "path to the taiko.db3 to update")
+	fromPath := fs.String("from", "", "path to the taiko.db3 to read from")
+	changesPath := fs.String("changes", "", "path to a change set exported with sync-export")
+	full := fs.Bool("full", false, "ignore the stored watermark and reconcile every player")
+	dryRun := fs.Bool("dry-run", false, "report what would change, writing in a transaction that is rolled back")
+	fs.Parse(args)
+
+	if *dbPath == "" {
+		log.Fatal("missing --db")
+	}
+	if (*fromPath == "") == (*changesPath == "") {
+		log.Fatal("exactly one of --from or --changes is required")
+	}
+
+	dstDB, err := db.Open(*dbPath)
+	if err != nil {
+		log.Fatalf("open db: %v", err)
+	}
+	defer dstDB.Close()
+
+	statePath := db.SyncStatePath(*dbPath)
+	state, err := db.LoadSyncState(statePath)
+	if err != nil {
+		log.Fatalf("load sync state: %v", err)
+	}
+
+	ctx := context.Background()
+	var report *db.SyncReport
+	if *fromPath != "" {
+		origin, err := filepath.Abs(*fromPath)
+		if err != nil {
+			log.Fatalf("resolve --from: %v", err)
+		}
+		srcDB, err := db.Open(origin)
+		if err != nil {
+			log.Fatalf("open source db: %v", err)
+		}
+		defer srcDB.Close()
+
+		report, err = db.SyncDatabases(ctx, srcDB, dstDB, origin, state, *full, *dryRun, true)
+		if err != nil {
+			log.Fatalf("sync: %v", err)
+		}
+	} else {
+		data, err := os.ReadFile(*changesPath)
+		if err != nil {
+			log.Fatalf("read change set: %v", err)
+		}
+		var changeSet db.ChangeSet
+		if err := json.Unmarshal(data, &changeSet); err != nil {
+			log.Fatalf("parse change set: %v", err)
+		}
+		report, err = db.ApplyTrackedChangeSet(ctx, dstDB, &changeSet, state, *dryRun, true)
+		if err != nil {
+			log.Fatalf("sync: %v", err)
+		}
+	}
+
+	if !*dryRun {
+		if err := state.Save(statePath); err != nil {
+			log.Fatalf("save sync state: %v", err)
+		}
+	}
+
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Fprintln(os.Stdout, string(out))
+}
+
+// runSyncExport writes a change set that another machine can apply with sync --changes.
+func runSyncExport(args []string) {
+	fs := flag.NewFlagSet("sync-export", flag.ExitOnError)
+	dbPath := fs.String("db", "", "path to taiko.db3")
+	outPath := fs.String("out", "", "file to write the change set to (default stdout)")
+	origin := fs.String("origin", "", "name identifying this database (default its path)")
+	since := fs.String("since", "", "only export players who played after this LastPlayDatetime")
+	fs.Parse(args)
+
+	if *dbPath == "" {
+		log.Fatal("missing --db")
+	}
+	if *origin == "" {
+		abs, err := filepath.Abs(*dbPath)
+		if err != nil {
+			log.Fatalf("resolve --db: %v", err)
+		}
+		*origin = abs
+	}
+
+	sqlDB, err := db.Open(*dbPath)
+	if err != nil {
+		log.Fatalf("open db: %v", err)
+	}
+	defer sqlDB.Close()
+
+	changeSet, err := db.ExportChangeSet(context.Background(), sqlDB, *origin, *since)
+	if err != nil {
+		log.Fatalf("export: %v", err)
+	}
+
+	out, _ := json.MarshalIndent(changeSet, "", "  ")
+	out = append(out, '\n')
+	if *outPath == "" {
+		os.Stdout.Write(out)
+		return
+	}
+	if err := os.WriteFile(*outPath, out, 0o644); err != nil {
+		log.Fatalf("write change set: %v", err)
+	}
+	fmt.Fprintf(os.Stdout, "Exported %d players to %s\n", len(changeSet.Players), *outPath)
+}
+
+// runExport streams a table, optionally filtered like table.select, to CSV or NDJSON.
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dbPath := fs.String("db", "", "path to taiko.db3")
+	table := fs.String("table", "", "table to export")
+	format := fs.String("format", db.ExportCSV, "output format: csv or ndjson")
+	outPath := fs.String("out", "", "file to write to (default stdout)")
+	columns := fs.String("columns", "", "comma-separated columns to export (default all visible columns)")
+	orderBy := fs.String("order", "", "comma-separated columns to order by, each optionally suffixed with :desc")
+	limit := fs.Int("limit", 0, "maximum number of rows (0 for all)")
+	var filters filterFlag
+	fs.Var(&filters, "filter", "Column=Value equality filter (repeatable)")
+	fs.Parse(args)
+
+	if *dbPath == "" {
+		log.Fatal("missing --db")
+	}
+	if *table == "" {
+		log.Fatal("missing --table")
+	}
+
+	req := db.ExportRequest{Table: *table, Format: *format, Filters: map[string]any(filters)}
+	if *columns != "" {
+		req.Columns = strings.Split(*columns, ",")
+	}
+	if *orderBy != "" {
+		for _, item := range strings.Split(*orderBy, ",") {
+			column, dir, _ := strings.Cut(item, ":")
+			req.OrderBy = append(req.OrderBy, db.OrderBy{Column: column, Desc: strings.EqualFold(dir, "desc")})
+		}
+	}
+	if *limit > 0 {
+		req.Limit = limit
+	}
+
+	sqlDB, err := db.Open(*dbPath)
+	if err != nil {
+		log.Fatalf("open db: %v", err)
+	}
+	defer sqlDB.Close()
+
+	out := os.Stdout
+	if *outPath != "" {
+		out, err = os.Create(*outPath)
+		if err != nil {
+			log.Fatalf("create output: %v", err)
+		}
+	}
+	stats, err := db.ExportTable(context.Background(), sqlDB, req, out)
+	if err != nil {
+		log.Fatalf("export: %v", err)
+	}
+	if *outPath != "" {
+		if err := out.Close(); err != nil {
+			log.Fatalf("write output: %v", err)
+		}
+		fmt.Fprintf(os.Stdout, "Exported %d rows (%d bytes) to %s\n", stats.Rows, stats.Bytes, *outPath)
+	}
+}
+
+// runImport loads a CSV or NDJSON file into a table. Nothing is written unless every row imports.
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dbPath := fs.String("db", "", "path to taiko.db3")
+	table := fs.String("table", "", "table to import into")
+	inPath := fs.String("in", "", "file to read from (default stdin)")
+	format := fs.String("format", "", "input format: csv or ndjson (default from the file extension, else csv)")
+	mode := fs.String("mode", db.ImportInsert, "insert, upsert, or skip rows that already exist")
+	dryRun := fs.Bool("dry-run", false, "check every row without writing")
+	var columns mapFlag
+	fs.Var(&columns, "map", "Source=Column column mapping, Source= drops the column (repeatable)")
+	fs.Parse(args)
+
+	if *dbPath == "" {
+		log.Fatal("missing --db")
+	}
+	if *table == "" {
+		log.Fatal("missing --table")
+	}
+
+	in := os.Stdin
+	if *inPath != "" {
+		f, err := os.Open(*inPath)
+		if err != nil {
+			log.Fatalf("open input: %v", err)
+		}
+		defer f.Close()
+		in = f
+		if *format == "" {
+			switch strings.ToLower(filepath.Ext(*inPath)) {
+			case ".ndjson", ".jsonl":
+				*format = db.ExportNDJSON
+			}
+		}
+	}
+
+	sqlDB, err := db.Open(*dbPath)
+	if err != nil {
+		log.Fatalf("open db: %v", err)
+	}
+	defer sqlDB.Close()
+
+	req := db.ImportRequest{Table: *table, Format: *format, Mode: *mode, Columns: map[string]string(columns), DryRun: *dryRun}
+	report, err := db.ImportTable(context.Background(), sqlDB, req, in, true)
+	if err != nil {
+		log.Fatalf("import: %v", err)
+	}
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Fprintln(os.Stdout, string(out))
+	if report.ErrorCount > 0 {
+		os.Exit(1)
+	}
+}
+
+// mapFlag collects --map Source=Column pairs.
+type mapFlag map[string]string
+
+func (m *mapFlag) String() string {
+	return fmt.Sprint(map[string]string(*m))
+}
+
+func (m *mapFlag) Set(value string) error {
+	source, column, ok := strings.Cut(value, "=")
+	if !ok || source == "" {
+		return fmt.Errorf("map must be Source=Column: %s", value)
+	}
+	if *m == nil {
+		*m = make(mapFlag)
+	}
+	(*m)[source] = column
+	return nil
+}
+
+// filterFlag collects --filter Column=Value pairs. Values that look like integers are compared as
+// integers, since that is how the game stores ids and flags.
+type filterFlag map[string]any
+
+func (f *filterFlag) String() string {
+	return fmt.Sprint(map[string]any(*f))
+}
+
+func (f *filterFlag) Set(value string) error {
+	column, raw, ok := strings.Cut(value, "=")
+	if !ok || column == "" {
+		return fmt.Errorf("filter must be Column=Value: %s", value)
+	}
+	if *f == nil {
+		*f = make(filterFlag)
+	}
+	if n, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		(*f)[column] = n
+	} else {
+		(*f)[column] = raw
+	}
+	return nil
+}
@@ -1,9 +1,12 @@
 package agent
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/exec"
@@ -33,6 +36,28 @@ type Agent struct {
 	api    *db.APIClient
 	logger *logger.Logger
 
+	resetCodes *db.ResetCodes
+	watcher    *db.Watcher
+	milestones *db.MilestoneRules
+	usageCache *db.UsageCache
+	// resultCache serves repeated table.select and read-only query calls until the data changes.
+	resultCache *db.ResultCache
+	// roDB is the read-only handle sql.query runs on, opened on first use.
+	roDB     *sql.DB
+	roDBOnce sync.Once
+	roDBErr  error
+	pruneMu  sync.Mutex
+	// pruned caches the pruned history milestones are detected with; nil until first read and
+	// after anything changes it.
+	pruned atomic.Pointer[db.PrunedHistory]
+
+	// sourceName is the data source this agent serves. The agent for the default source also
+	// holds one agent per further source and hands requests naming them over.
+	sourceName string
+	sources    map[string]*Agent
+	// root is the agent of the default source; it is the agent itself for the default source.
+	root *Agent
+
 	connMu           sync.Mutex
 	conn             *websocket.Conn
 	inflight         sync.WaitGroup
@@ -41,11 +66,114 @@ type Agent struct {
 }
 
 func New(cfg config.Config, sqlDB *sql.DB, apiClient *db.APIClient, log *logger.Logger) *Agent {
-	return &Agent{cfg: cfg, db: sqlDB, api: apiClient, logger: log}
+	resultCache := db.NewResultCache(sqlDB, cfg.ResultCacheSize, cfg.ResultCacheTTL)
+	if apiClient != nil {
+		apiClient.SetCache(resultCache)
+	}
+	a := &Agent{cfg: cfg, db: sqlDB, api: apiClient, logger: log, resetCodes: db.NewResetCodes(), usageCache: db.NewUsageCache(cfg.AnalyticsCacheTTL), resultCache: resultCache, sourceName: config.DefaultSource}
+	a.root = a
+	return a
+}
+
+// AddSource serves src next to the default source. It gets its own caches, change feed and prune
+// schedule; everything else is configured as for the default source.
+func (a *Agent) AddSource(src config.Source, sqlDB *sql.DB, apiClient *db.APIClient) {
+	cfg := a.cfg
+	cfg.SourceMode = src.SourceMode
+	cfg.DBPath = src.DBPath
+	cfg.APIBaseURL = src.APIBaseURL
+	cfg.APIToken = src.APIToken
+	cfg.AllowWrite = src.AllowWrite
+	cfg.HybridDirectWrites = src.HybridDirectWrites
+	cfg.Sources = nil
+
+	child := New(cfg, sqlDB, apiClient, a.logger)
+	child.sourceName = src.Name
+	child.root = a
+	if a.sources == nil {
+		a.sources = make(map[string]*Agent)
+	}
+	a.sources[src.Name] = child
+}
+
+// allSources returns this agent followed by the agents of the further sources, sorted by name.
+func (a *Agent) allSources() []*Agent {
+	names := make([]string, 0, len(a.sources))
+	for name := range a.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	all := []*Agent{a}
+	for _, name := range names {
+		all = append(all, a.sources[name])
+	}
+	return all
+}
+
+// sourceFor returns the agent serving the source named by the source param of a request.
+func (a *Agent) sourceFor(params json.RawMessage) (*Agent, error) {
+	var target struct {
+		Source string `json:"source"`
+	}
+	// Params that are not an object cannot name a source.
+	_ = json.Unmarshal(params, &target)
+	if target.Source == "" || target.Source == a.sourceName {
+		return a, nil
+	}
+	if src, ok := a.sources[target.Source]; ok {
+		return src, nil
+	}
+	return nil, fmt.Errorf("unknown source: %s", target.Source)
+}
+
+// agentWideMethods act on the PC or the shared config file rather than on a source, so they are
+// always checked against the default source's allowWrite and reject a source param.
+var agentWideMethods = map[string]bool{
+	"system.shutdown": true, "system.restart": true, "config.get": true, "config.set": true,
+}
+
+// sourceLabel names a further source in log lines; it is empty for the default source.
+func (a *Agent) sourceLabel() string {
+	if a.sourceName == config.DefaultSource {
+		return ""
+	}
+	return " of source " + a.sourceName
+}
+
+// sourceMeta describes a source in the register envelope.
+func (a *Agent) sourceMeta() map[string]any {
+	meta := map[string]any{
+		"name":       a.sourceName,
+		"source":     a.cfg.SourceMode,
+		"dbPath":     a.cfg.DBPath,
+		"apiBaseUrl": a.cfg.APIBaseURL,
+		"allowWrite": a.cfg.AllowWrite,
+	}
+	if a.cfg.SourceMode == "hybrid" {
+		meta["hybridDirectWrites"] = a.cfg.HybridDirectWrites
+	}
+	if a.eventsEnabled() {
+		meta["events"] = a.subscribedEvents()
+	}
+	return meta
+}
+
+// readOnlyMethods never change data. Every other method drops the result cache once it is handled,
+// whether or not it succeeded, since a failed write may still have changed something.
+var readOnlyMethods = map[string]bool{
+	"ping": true, "version.get": true, "agent.version": true, "movie.list": true, "dan.list": true,
+	"config.get": true, "query": true, "table.select": true, "player.stats": true,
+	"leaderboard.song": true, "leaderboard.overall": true, "player.favorites.list": true,
+	"sessions.list": true, "sessions.daily": true, "analytics.usage": true, "player.unlocks.get": true,
+	"tokens.history": true, "card.lookup": true, "sync.export": true, "cache.stats": true,
+	"db.indexAdvice": true, "sql.query": true, "table.export": true,
 }
 
 // BeginShutdown signals the agent to stop accepting new work and close connections.
 func (a *Agent) BeginShutdown() {
+	for _, src := range a.sources {
+		src.shutdown.Store(true)
+	}
 	a.shutdown.Store(true)
 	a.closeConn()
 }
@@ -54,7 +182,9 @@ func (a *Agent) BeginShutdown() {
 func (a *Agent) WaitForInflight(timeout time.Duration) bool {
 	done := make(chan struct{})
 	go func() {
-		a.inflight.Wait()
+		for _, src := range a.allSources() {
+			src.inflight.Wait()
+		}
 		close(done)
 	}()
 	select {
@@ -69,6 +199,11 @@ func (a *Agent) Run(ctx context.Context) error {
 	if a.cfg.ControllerURL == "" || a.cfg.Token == "" || a.cfg.AgentID == "" {
 		return errors.New("missing controller, token, or agent-id")
 	}
+	if a.cfg.PruneInterval > 0 {
+		for _, src := range a.allSources() {
+			go src.runPruneSchedule(ctx)
+		}
+	}
 
 	for {
 		select {
@@ -84,7 +219,7 @@ func (a *Agent) Run(ctx context.Context) error {
 		if a.shutdown.Load() {
 			return nil
 		}
-		
+
 		// Only log if we're reconnecting
 		a.logger.Infof("Reconnecting in %s...", a.cfg.ReconnectDelay)
 
@@ -123,6 +258,17 @@ func (a *Agent) connectOnce(ctx context.Context) error {
 			"apiBaseUrl": a.cfg.APIBaseURL,
 		},
 	}
+	if a.cfg.SourceMode == "hybrid" {
+		register.Meta["hybridDirectWrites"] = a.cfg.HybridDirectWrites
+	}
+	if a.eventsEnabled() {
+		register.Meta["events"] = a.subscribedEvents()
+	}
+	sources := make([]map[string]any, 0, len(a.sources)+1)
+	for _, src := range a.allSources() {
+		sources = append(sources, src.sourceMeta())
+	}
+	register.Meta["sources"] = sources
 	a.logger.TrafficTx("register", register)
 	if err := conn.WriteJSON(register); err != nil {
 		return err
@@ -143,11 +289,30 @@ func (a *Agent) connectOnce(ctx context.Context) error {
 
 	go a.readLoop(readCtx, conn, readCh)
 
+	// The change feed is polled from this loop so that events and responses share one writer.
+	var feeds []*Agent
+	for _, src := range a.allSources() {
+		if !src.eventsEnabled() {
+			continue
+		}
+		if err := src.startWatcher(ctx); err != nil {
+			a.logger.Errorf("change feed%s disabled: %v", src.sourceLabel(), err)
+			continue
+		}
+		feeds = append(feeds, src)
+	}
+	var eventTick <-chan time.Time
+	if len(feeds) > 0 {
+		eventTicker := time.NewTicker(a.cfg.EventPollInterval)
+		defer eventTicker.Stop()
+		eventTick = eventTicker.C
+	}
+
 	controllerType := "Controller"
 	if strings.Contains(a.cfg.ControllerURL, "jido.sorsax.dev") {
 		controllerType = "Jidotachi"
 	}
-	
+
 	connectedLogged := false
 	for {
 		select {
@@ -155,6 +320,12 @@ func (a *Agent) connectOnce(ctx context.Context) error {
 			return nil
 		case <-pingTicker.C:
 			_ = conn.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(3*time.Second))
+		case <-eventTick:
+			for _, src := range feeds {
+				if err := src.pushEvents(ctx, conn); err != nil {
+					return err
+				}
+			}
 		case msg := <-readCh:
 			if msg.err != nil {
 				return msg.err
@@ -170,14 +341,14 @@ func (a *Agent) connectOnce(ctx context.Context) error {
 					a.logger.Infof("Checking for custom songs")
 					time.Sleep(500 * time.Millisecond)
 					a.logger.Infof("0 Custom songs found")
-				time.Sleep(560 * time.Millisecond)
-				a.logger.Infof("Sending heartbeat to DonderHiroba (BNE)")
-				time.Sleep(2 * time.Second)
-				a.logger.Infof("Heartbeat %s by DonderHiroba (BNE)", a.logger.Green("acknowledged"))
+					time.Sleep(560 * time.Millisecond)
+					a.logger.Infof("Sending heartbeat to DonderHiroba (BNE)")
+					time.Sleep(2 * time.Second)
+					a.logger.Infof("Heartbeat %s by DonderHiroba (BNE)", a.logger.Green("acknowledged"))
 				})
 				connectedLogged = true
 			}
-			
+
 			a.logger.TrafficRx("message", msg.data)
 			a.inflight.Add(1)
 			msgCtx := ctx
@@ -214,6 +385,133 @@ func (a *Agent) closeConn() {
 	a.connMu.Unlock()
 }
 
+// eventsEnabled reports whether the change feed is configured. It needs direct database access.
+func (a *Agent) eventsEnabled() bool {
+	return len(a.cfg.Events) > 0 && a.cfg.SourceMode != "api" && a.db != nil
+}
+
+// subscribedEvents expands the configured event list, where "*" stands for every event type.
+func (a *Agent) subscribedEvents() []string {
+	for _, event := range a.cfg.Events {
+		if event == "*" {
+			return append(db.EventTypes(), db.EventMilestone)
+		}
+	}
+	return a.cfg.Events
+}
+
+func (a *Agent) subscribed(event string) bool {
+	for _, e := range a.subscribedEvents() {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// startWatcher creates the change feed watcher on the first connection. The watcher outlives the
+// connection, so changes made while disconnected are sent after reconnecting. Milestones are
+// derived from new plays and dan results, so subscribing to them watches those tables too.
+func (a *Agent) startWatcher(ctx context.Context) error {
+	if a.watcher != nil {
+		return nil
+	}
+
+	var tableEvents []string
+	for _, event := range a.subscribedEvents() {
+		if event != db.EventMilestone {
+			tableEvents = append(tableEvents, event)
+		}
+	}
+	if a.subscribed(db.EventMilestone) {
+		rules, err := a.readMilestoneRules()
+		if err != nil {
+			return fmt.Errorf("milestone rules: %w", err)
+		}
+		a.milestones = &rules
+		tableEvents = append(tableEvents, db.EventPlayRecorded, db.EventDanResult)
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+	defer cancel()
+
+	watcher, err := db.NewWatcher(ctxTimeout, a.db, tableEvents)
+	if err != nil {
+		return err
+	}
+	a.watcher = watcher
+	return nil
+}
+
+// readMilestoneRules loads milestones.json from next to agent-config.json, falling back to the
+// default rules when the file does not exist.
+func (a *Agent) readMilestoneRules() (db.MilestoneRules, error) {
+	path, err := a.agentConfigPath()
+	if err != nil {
+		return db.MilestoneRules{}, err
+	}
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(path), "milestones.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return db.DefaultMilestoneRules(), nil
+		}
+		return db.MilestoneRules{}, err
+	}
+	return db.ParseMilestoneRules(stripUTF8BOM(data))
+}
+
+// pushEvents polls the change feed and sends one event envelope per change and per milestone.
+// Only write errors are returned; database errors are logged and retried on the next tick.
+func (a *Agent) pushEvents(ctx context.Context, conn *websocket.Conn) error {
+	ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+	defer cancel()
+
+	events, err := a.watcher.Poll(ctxTimeout)
+	if err != nil {
+		a.logger.Errorf("change feed%s: %v", a.sourceLabel(), err)
+	}
+	for _, event := range events {
+		if a.subscribed(event.Event) {
+			if err := a.sendEvent(conn, event.Event, event.Data); err != nil {
+				return err
+			}
+		}
+		if a.milestones == nil {
+			continue
+		}
+		pruned, err := a.prunedHistory()
+		if err != nil {
+			a.logger.Errorf("milestones%s: %v", a.sourceLabel(), err)
+			continue
+		}
+		milestones, err := db.DetectMilestones(ctxTimeout, a.db, *a.milestones, pruned, event)
+		if err != nil {
+			a.logger.Errorf("milestones%s: %v", a.sourceLabel(), err)
+			continue
+		}
+		for _, milestone := range milestones {
+			if err := a.sendEvent(conn, db.EventMilestone, milestone); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (a *Agent) sendEvent(conn *websocket.Conn, event string, data any) error {
+	env := protocol.Envelope{
+		Type:    "event",
+		AgentID: a.cfg.AgentID,
+		Event:   event,
+		Data:    data,
+	}
+	if a.sourceName != config.DefaultSource {
+		env.Source = a.sourceName
+	}
+	a.logger.TrafficTx("event", env)
+	return conn.WriteJSON(env)
+}
+
 type eventFolderEntry struct {
 	FolderID int `json:"folderId"`
 }
@@ -301,7 +599,24 @@ func (a *Agent) handleMessage(ctx context.Context, conn *websocket.Conn, data []
 		return nil
 	}
 
-	resp := protocol.Envelope{Type: "response", ID: env.ID}
+	resp := protocol.Envelope{Type: "response", ID: env.ID, AgentID: a.cfg.AgentID}
+	src, err := a.sourceFor(env.Params)
+	if err != nil {
+		resp.Error = &protocol.Error{Code: "unknown_source", Message: err.Error()}
+		a.logger.TrafficTx("response", resp)
+		return conn.WriteJSON(resp)
+	}
+	if src != a {
+		if agentWideMethods[env.Method] {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: env.Method + " applies to the whole agent and takes no source"}
+			a.logger.TrafficTx("response", resp)
+			return conn.WriteJSON(resp)
+		}
+		return src.handleMessage(ctx, conn, data)
+	}
+	if a.sourceName != config.DefaultSource {
+		resp.Source = a.sourceName
+	}
 
 	switch env.Method {
 	case "ping":
@@ -475,7 +790,13 @@ func (a *Agent) handleMessage(ctx context.Context, conn *websocket.Conn, data []
 		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
 		defer cancel()
 
-		result, err := a.queryNamed(ctxTimeout, params.Name, params.Args)
+		var result map[string]any
+		var err error
+		if params.Explain {
+			result, err = a.explainQuery(ctxTimeout, params.Name, params.Args)
+		} else {
+			result, err = a.queryNamed(ctxTimeout, params.Name, params.Args)
+		}
 		if err != nil {
 			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
 			break
@@ -495,7 +816,13 @@ func (a *Agent) handleMessage(ctx context.Context, conn *websocket.Conn, data []
 			orderBy = append(orderBy, db.OrderBy{Column: item.Column, Desc: item.Desc})
 		}
 
-		result, err := a.tableSelect(ctxTimeout, params.Table, params.Columns, params.Filters, orderBy, params.Limit, params.Offset)
+		var result map[string]any
+		var err error
+		if params.Explain {
+			result, err = a.explainSelect(ctxTimeout, params.Table, params.Columns, params.Filters, orderBy, params.Limit, params.Offset)
+		} else {
+			result, err = a.tableSelect(ctxTimeout, params.Table, params.Columns, params.Filters, orderBy, params.Limit, params.Offset)
+		}
 		if err != nil {
 			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
 			break
@@ -546,77 +873,1468 @@ func (a *Agent) handleMessage(ctx context.Context, conn *websocket.Conn, data []
 			break
 		}
 		resp.Result = result
-	default:
-		resp.Error = &protocol.Error{Code: "unknown_method", Message: "unsupported method"}
-	}
+	case "player.merge":
+		var params protocol.PlayerMergeParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		if params.SourceBaid <= 0 || params.TargetBaid <= 0 {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: "sourceBaid and targetBaid are required"}
+			break
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
 
-	a.logger.TrafficTx("response", resp)
-	return conn.WriteJSON(resp)
-}
+		result, err := a.playerMerge(ctxTimeout, params.SourceBaid, params.TargetBaid, params.Preview)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "player.rebuildBest":
+		var params protocol.PlayerRebuildBestParams
+		if len(env.Params) > 0 {
+			if err := json.Unmarshal(env.Params, &params); err != nil {
+				resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+				break
+			}
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
 
-func (a *Agent) queryNamed(ctx context.Context, name string, args []any) (map[string]any, error) {
-	if a.cfg.SourceMode == "api" {
-		if a.api == nil {
-			return nil, errors.New("api client is not configured")
+		result, err := a.playerRebuildBest(ctxTimeout, params.Baid, params.Apply, params.Exact)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
+			break
 		}
-		return a.api.QueryNamed(ctx, name, args, a.cfg.AllowWrite)
-	}
-	if a.db == nil {
-		return nil, errors.New("database is not configured")
-	}
-	return db.QueryNamed(ctx, a.db, name, args, a.cfg.AllowWrite)
-}
+		resp.Result = result
+	case "player.stats":
+		var params protocol.PlayerStatsParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		if params.Baid <= 0 {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: "baid is required"}
+			break
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
 
-func (a *Agent) tableSelect(ctx context.Context, table string, columns []string, filters map[string]any, orderBy []db.OrderBy, limit *int, offset *int) (map[string]any, error) {
-	if a.cfg.SourceMode == "api" {
-		if a.api == nil {
-			return nil, errors.New("api client is not configured")
+		stats, err := a.playerStats(ctxTimeout, params.Baid)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
+			break
 		}
-		return a.api.TableSelect(ctx, table, columns, filters, orderBy, limit, offset)
-	}
-	if a.db == nil {
-		return nil, errors.New("database is not configured")
-	}
-	return db.TableSelect(ctx, a.db, table, columns, filters, orderBy, limit, offset)
-}
+		resp.Result = map[string]any{"stats": stats}
+	case "leaderboard.song":
+		var params protocol.LeaderboardSongParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
 
-func (a *Agent) tableInsert(ctx context.Context, table string, values map[string]any) (map[string]any, error) {
-	if a.cfg.SourceMode == "api" {
-		if a.api == nil {
-			return nil, errors.New("api client is not configured")
+		result, err := a.leaderboardSong(ctxTimeout, params)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
+			break
 		}
-		return a.api.TableInsert(ctx, table, values, a.cfg.AllowWrite)
-	}
-	if a.db == nil {
-		return nil, errors.New("database is not configured")
-	}
-	return db.TableInsert(ctx, a.db, table, values, a.cfg.AllowWrite)
-}
+		resp.Result = result
+	case "leaderboard.overall":
+		var params protocol.LeaderboardOverallParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		if params.By == "" {
+			params.By = "crowns"
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
 
-func (a *Agent) tableUpdate(ctx context.Context, table string, values map[string]any, filters map[string]any) (map[string]any, error) {
-	if a.cfg.SourceMode == "api" {
-		if a.api == nil {
-			return nil, errors.New("api client is not configured")
+		result, err := a.leaderboardOverall(ctxTimeout, params)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
+			break
 		}
-		return a.api.TableUpdate(ctx, table, values, filters, a.cfg.AllowWrite)
-	}
-	if a.db == nil {
-		return nil, errors.New("database is not configured")
-	}
-	return db.TableUpdate(ctx, a.db, table, values, filters, a.cfg.AllowWrite)
-}
+		resp.Result = result
+	case "player.create":
+		var params protocol.PlayerCreateParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		if params.AccessCode == "" {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: "accessCode is required"}
+			break
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
 
-func (a *Agent) tableDelete(ctx context.Context, table string, filters map[string]any) (map[string]any, error) {
-	if a.cfg.SourceMode == "api" {
-		if a.api == nil {
-			return nil, errors.New("api client is not configured")
+		result, err := a.playerCreate(ctxTimeout, params)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "player.delete":
+		var params protocol.PlayerDeleteParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		if params.Baid <= 0 {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: "baid is required"}
+			break
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+
+		result, err := a.playerDelete(ctxTimeout, params.Baid, params.Anonymize)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "player.profile.update":
+		var params protocol.PlayerProfileUpdateParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		if params.Baid <= 0 {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: "baid is required"}
+			break
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+
+		result, err := a.playerProfileUpdate(ctxTimeout, params)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "player.favorites.list", "player.favorites.add", "player.favorites.remove", "player.favorites.reorder":
+		var params protocol.PlayerFavoritesParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		if params.Baid <= 0 {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: "baid is required"}
+			break
+		}
+		if env.Method != "player.favorites.list" && env.Method != "player.favorites.reorder" && len(params.SongIDs) == 0 {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: "songIds is required"}
+			break
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+
+		result, err := a.playerFavorites(ctxTimeout, env.Method, params)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "sessions.list", "sessions.daily":
+		var params protocol.SessionsParams
+		if len(env.Params) > 0 {
+			if err := json.Unmarshal(env.Params, &params); err != nil {
+				resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+				break
+			}
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+
+		result, err := a.sessions(ctxTimeout, env.Method, params)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "analytics.usage":
+		var params protocol.AnalyticsUsageParams
+		if len(env.Params) > 0 {
+			if err := json.Unmarshal(env.Params, &params); err != nil {
+				resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+				break
+			}
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+
+		result, err := a.analyticsUsage(ctxTimeout, params)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "db.prune":
+		var params protocol.DBPruneParams
+		if len(env.Params) > 0 {
+			if err := json.Unmarshal(env.Params, &params); err != nil {
+				resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+				break
+			}
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+
+		result, err := a.dbPrune(ctxTimeout, params)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "cache.stats":
+		resp.Result = map[string]any{"cache": a.resultCache.Stats()}
+	case "db.indexAdvice":
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+
+		result, err := a.dbIndexAdvice(ctxTimeout)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "sql.query":
+		if !a.cfg.SQLConsole {
+			resp.Error = &protocol.Error{Code: "forbidden", Message: "sql.query is disabled"}
+			break
+		}
+		var params protocol.SQLQueryParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		if strings.TrimSpace(params.SQL) == "" {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: "sql is required"}
+			break
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+
+		result, err := a.sqlQuery(ctxTimeout, params)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "table.export":
+		var params protocol.TableExportParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.TransferTimeout)
+		defer cancel()
+
+		stopKeepAlive := a.keepAlive(conn)
+		result, err := a.tableExport(ctxTimeout, conn, env.ID, params)
+		stopKeepAlive()
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "table.import":
+		var params protocol.TableImportParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		if (params.Data == "") == (params.File == "") {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: "exactly one of data or file is required"}
+			break
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.TransferTimeout)
+		defer cancel()
+
+		stopKeepAlive := a.keepAlive(conn)
+		result, err := a.tableImport(ctxTimeout, params)
+		stopKeepAlive()
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "player.unlocks.get":
+		var params protocol.PlayerUnlocksGetParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		if params.Baid <= 0 {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: "baid is required"}
+			break
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+
+		result, err := a.playerUnlocksGet(ctxTimeout, params.Baid)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "player.unlocks.grant", "player.unlocks.revoke":
+		var params protocol.PlayerUnlocksChangeParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		if params.Baid > 0 {
+			params.Baids = append(params.Baids, params.Baid)
+		}
+		if len(params.Baids) == 0 && !params.All {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: "baid, baids or all is required"}
+			break
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+
+		result, err := a.playerUnlocksChange(ctxTimeout, env.Method, params)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "tokens.grant":
+		if !a.cfg.TokenLedger {
+			resp.Error = &protocol.Error{Code: "forbidden", Message: "tokens.grant needs the token ledger, which is disabled"}
+			break
+		}
+		var params protocol.TokensGrantParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		if params.Baid > 0 {
+			params.Baids = append(params.Baids, params.Baid)
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+
+		result, err := a.tokensGrant(ctxTimeout, params)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "tokens.set":
+		if !a.cfg.TokenLedger {
+			resp.Error = &protocol.Error{Code: "forbidden", Message: "tokens.set needs the token ledger, which is disabled"}
+			break
+		}
+		var params protocol.TokensSetParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		if params.Baid <= 0 {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: "baid is required"}
+			break
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+
+		result, err := a.tokensSet(ctxTimeout, params)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "tokens.history":
+		if !a.cfg.TokenLedger {
+			resp.Error = &protocol.Error{Code: "forbidden", Message: "tokens.history needs the token ledger, which is disabled"}
+			break
+		}
+		var params protocol.TokensHistoryParams
+		if len(env.Params) > 0 {
+			if err := json.Unmarshal(env.Params, &params); err != nil {
+				resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+				break
+			}
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+
+		result, err := a.tokensHistory(ctxTimeout, params)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "db_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "credential.set":
+		var params protocol.CredentialSetParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		if params.Baid <= 0 {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: "baid is required"}
+			break
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+
+		result, err := a.credentialSet(ctxTimeout, params)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "credential_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "credential.reset":
+		var params protocol.CredentialResetParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		if params.Baid <= 0 {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: "baid is required"}
+			break
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+
+		result, err := a.credentialReset(ctxTimeout, params.Baid)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "credential_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "card.bind":
+		var params protocol.CardBindParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+
+		result, err := a.cardBind(ctxTimeout, params.Baid, params.AccessCode)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "card_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "card.unbind":
+		var params protocol.CardUnbindParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+
+		result, err := a.cardUnbind(ctxTimeout, params.AccessCode, params.Force)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "card_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "card.transfer":
+		var params protocol.CardTransferParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+
+		result, err := a.cardTransfer(ctxTimeout, params.AccessCode, params.TargetBaid, params.Force)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "card_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "card.lookup":
+		var params protocol.CardLookupParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+
+		result, err := a.cardLookup(ctxTimeout, params.AccessCode)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "card_error", Message: err.Error()}
+			break
+		}
+		resp.Result = result
+	case "sync.export":
+		var params protocol.SyncExportParams
+		if len(env.Params) > 0 {
+			if err := json.Unmarshal(env.Params, &params); err != nil {
+				resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+				break
+			}
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+
+		changeSet, err := a.syncExport(ctxTimeout, params.Since)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "sync_error", Message: err.Error()}
+			break
+		}
+		resp.Result = map[string]any{"changeSet": changeSet}
+	case "sync.apply":
+		var params protocol.SyncApplyParams
+		if err := json.Unmarshal(env.Params, &params); err != nil {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: err.Error()}
+			break
+		}
+		if len(params.ChangeSet) == 0 && params.FromDBPath == "" {
+			resp.Error = &protocol.Error{Code: "bad_params", Message: "changeSet or fromDbPath is required"}
+			break
+		}
+		ctxTimeout, cancel := context.WithTimeout(ctx, a.cfg.RequestTimeout)
+		defer cancel()
+
+		report, err := a.syncApply(ctxTimeout, params)
+		if err != nil {
+			resp.Error = &protocol.Error{Code: "sync_error", Message: err.Error()}
+			break
+		}
+		resp.Result = map[string]any{"report": report}
+	default:
+		resp.Error = &protocol.Error{Code: "unknown_method", Message: "unsupported method"}
+	}
+	if !readOnlyMethods[env.Method] {
+		a.resultCache.Invalidate()
+	}
+
+	a.logger.TrafficTx("response", resp)
+	return conn.WriteJSON(resp)
+}
+
+func (a *Agent) queryNamed(ctx context.Context, name string, args []any) (map[string]any, error) {
+	q, ok := db.Queries[name]
+	readOnly := ok && q.ReadOnly
+	if a.cfg.SourceMode == "api" || !readOnly && a.writesThroughAPI("query", "") {
+		if a.api == nil {
+			return nil, errors.New("api client is not configured")
+		}
+		return a.api.QueryNamed(ctx, name, args, a.cfg.AllowWrite)
+	}
+	if a.db == nil {
+		return nil, errors.New("database is not configured")
+	}
+	if !readOnly {
+		// "query" counts as read-only in readOnlyMethods, so named writes drop the cache here.
+		defer a.resultCache.Invalidate()
+		return db.QueryNamed(ctx, a.db, name, args, a.cfg.AllowWrite)
+	}
+	key := db.CacheKey("query", map[string]any{"name": name, "args": args})
+	return db.CachedResult(ctx, a.resultCache, key, func() (map[string]any, error) {
+		return db.QueryNamed(ctx, a.db, name, args, a.cfg.AllowWrite)
+	})
+}
+
+func (a *Agent) tableSelect(ctx context.Context, table string, columns []string, filters map[string]any, orderBy []db.OrderBy, limit *int, offset *int) (map[string]any, error) {
+	if a.cfg.SourceMode == "api" {
+		if a.api == nil {
+			return nil, errors.New("api client is not configured")
+		}
+		return a.api.TableSelect(ctx, table, columns, filters, orderBy, limit, offset)
+	}
+	if a.db == nil {
+		return nil, errors.New("database is not configured")
+	}
+	key := db.CacheKey("table.select", map[string]any{
+		"table": table, "columns": columns, "filters": filters, "orderBy": orderBy, "limit": limit, "offset": offset,
+	})
+	return db.CachedResult(ctx, a.resultCache, key, func() (map[string]any, error) {
+		return db.TableSelect(ctx, a.db, table, columns, filters, orderBy, limit, offset)
+	})
+}
+
+func (a *Agent) tableInsert(ctx context.Context, table string, values map[string]any) (map[string]any, error) {
+	if a.writesThroughAPI("table.insert", table) {
+		if a.api == nil {
+			return nil, errors.New("api client is not configured")
+		}
+		return a.api.TableInsert(ctx, table, values, a.cfg.AllowWrite)
+	}
+	sqlDB, err := a.writeDB("table.insert", true, table)
+	if err != nil {
+		return nil, err
+	}
+	return db.TableInsert(ctx, sqlDB, table, values, a.cfg.AllowWrite)
+}
+
+func (a *Agent) tableUpdate(ctx context.Context, table string, values map[string]any, filters map[string]any) (map[string]any, error) {
+	if a.writesThroughAPI("table.update", table) {
+		if a.api == nil {
+			return nil, errors.New("api client is not configured")
+		}
+		return a.api.TableUpdate(ctx, table, values, filters, a.cfg.AllowWrite)
+	}
+	sqlDB, err := a.writeDB("table.update", true, table)
+	if err != nil {
+		return nil, err
+	}
+	return db.TableUpdate(ctx, sqlDB, table, values, filters, a.cfg.AllowWrite)
+}
+
+func (a *Agent) tableDelete(ctx context.Context, table string, filters map[string]any) (map[string]any, error) {
+	if a.writesThroughAPI("table.delete", table) {
+		if a.api == nil {
+			return nil, errors.New("api client is not configured")
+		}
+		return a.api.TableDelete(ctx, table, filters, a.cfg.AllowWrite)
+	}
+	sqlDB, err := a.writeDB("table.delete", true, table)
+	if err != nil {
+		return nil, err
+	}
+	return db.TableDelete(ctx, sqlDB, table, filters, a.cfg.AllowWrite)
+}
+
+// explainQuery and explainSelect return the query plan instead of rows; there is no SQL to
+// explain in api mode.
+func (a *Agent) explainQuery(ctx context.Context, name string, args []any) (map[string]any, error) {
+	sqlDB, err := a.directDB("query explain")
+	if err != nil {
+		return nil, err
+	}
+	return db.ExplainNamed(ctx, sqlDB, name, args)
+}
+
+func (a *Agent) explainSelect(ctx context.Context, table string, columns []string, filters map[string]any, orderBy []db.OrderBy, limit *int, offset *int) (map[string]any, error) {
+	sqlDB, err := a.directDB("table.select explain")
+	if err != nil {
+		return nil, err
+	}
+	return db.ExplainTableSelect(ctx, sqlDB, table, columns, filters, orderBy, limit, offset)
+}
+
+func (a *Agent) dbIndexAdvice(ctx context.Context) (map[string]any, error) {
+	sqlDB, err := a.directDB("db.indexAdvice")
+	if err != nil {
+		return nil, err
+	}
+	return db.AdviseIndexes(ctx, sqlDB)
+}
+
+func (a *Agent) sqlQuery(ctx context.Context, params protocol.SQLQueryParams) (map[string]any, error) {
+	if _, err := a.directDB("sql.query"); err != nil {
+		return nil, err
+	}
+	a.roDBOnce.Do(func() {
+		a.roDB, a.roDBErr = db.OpenReadOnly(a.cfg.DBPath)
+	})
+	if a.roDBErr != nil {
+		return nil, fmt.Errorf("open read-only db: %w", a.roDBErr)
+	}
+	return db.SQLQuery(ctx, a.roDB, params.SQL, params.Args, params.MaxRows)
+}
+
+// exportChunkSize is the amount of export output sent per chunk envelope.
+const exportChunkSize = 64 << 10
+
+// tableExport writes the export to a file in the export directory, or streams it back over conn
+// as chunk envelopes when no file is given. The last chunk has final set, and complete only when
+// every row was sent, so a controller can tell a cut-off stream from a finished one.
+func (a *Agent) tableExport(ctx context.Context, conn *websocket.Conn, id string, params protocol.TableExportParams) (map[string]any, error) {
+	sqlDB, err := a.directDB("table.export")
+	if err != nil {
+		return nil, err
+	}
+	req := db.ExportRequest{
+		Table:   params.Table,
+		Columns: params.Columns,
+		Filters: params.Filters,
+		Limit:   params.Limit,
+		Offset:  params.Offset,
+		Format:  params.Format,
+	}
+	for _, item := range params.OrderBy {
+		req.OrderBy = append(req.OrderBy, db.OrderBy{Column: item.Column, Desc: item.Desc})
+	}
+
+	if params.File == "" {
+		chunks := &chunkWriter{send: func(seq int, data string) error {
+			env := protocol.Envelope{Type: "chunk", ID: id, Data: map[string]any{"seq": seq, "data": data}}
+			return conn.WriteJSON(env)
+		}}
+		stats, err := db.ExportTable(ctx, sqlDB, req, chunks)
+		if err == nil {
+			err = chunks.Flush()
+		}
+		final := map[string]any{"seq": chunks.seq, "data": "", "final": true, "complete": err == nil}
+		if err != nil {
+			final["error"] = err.Error()
+		}
+		if sendErr := conn.WriteJSON(protocol.Envelope{Type: "chunk", ID: id, Data: final}); err == nil {
+			err = sendErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"export": stats, "chunks": chunks.seq}, nil
+	}
+
+	if !a.cfg.AllowWrite {
+		return nil, errors.New("write operations are disabled")
+	}
+	if params.File != filepath.Base(params.File) || params.File == "." || params.File == ".." {
+		return nil, errors.New("file must be a plain file name")
+	}
+	dir, err := a.exportDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, params.File)
+	tmp, err := os.CreateTemp(dir, params.File+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	stats, err := db.ExportTable(ctx, sqlDB, req, tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return map[string]any{"export": stats, "file": path}, nil
+}
+
+// tableImport loads rows given inline or from a file in the export directory, so a file written
+// by table.export on another agent can be copied over and imported as is.
+func (a *Agent) tableImport(ctx context.Context, params protocol.TableImportParams) (map[string]any, error) {
+	sqlDB, err := a.writeDB("table.import", true, params.Table)
+	if err != nil {
+		return nil, err
+	}
+	req := db.ImportRequest{
+		Table:   params.Table,
+		Format:  params.Format,
+		Mode:    params.Mode,
+		Columns: params.Columns,
+		DryRun:  params.DryRun,
+	}
+
+	var input io.Reader = strings.NewReader(params.Data)
+	var path string
+	if params.File != "" {
+		if params.File != filepath.Base(params.File) || params.File == "." || params.File == ".." {
+			return nil, errors.New("file must be a plain file name")
+		}
+		dir, err := a.exportDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(dir, params.File)
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		input = f
+		if req.Format == "" {
+			switch strings.ToLower(filepath.Ext(params.File)) {
+			case ".ndjson", ".jsonl":
+				req.Format = db.ExportNDJSON
+			}
+		}
+	}
+
+	report, err := db.ImportTable(ctx, sqlDB, req, input, a.cfg.AllowWrite)
+	if err != nil {
+		return nil, err
+	}
+	if params.File != "" {
+		return map[string]any{"import": report, "file": path}, nil
+	}
+	return map[string]any{"import": report}, nil
+}
+
+func (a *Agent) exportDir() (string, error) {
+	if a.cfg.ExportDir != "" {
+		return a.cfg.ExportDir, nil
+	}
+	exePath, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(exePath), "exports"), nil
+}
+
+// keepAlive pings the controller until stop is called. Messages are handled one at a time, so a
+// long transfer would otherwise hold back the pings the controller's pongs depend on and the
+// read deadline would run out. Events are held back too, and sent once the transfer is done.
+func (a *Agent) keepAlive(conn *websocket.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(a.cfg.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// WriteControl may be called concurrently with the other write methods.
+				_ = conn.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(3*time.Second))
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// chunkWriter collects output and sends it in pieces of about exportChunkSize. A piece always
+// ends after a newline, so it never splits a UTF-8 sequence and can be decoded on its own.
+type chunkWriter struct {
+	buf  []byte
+	seq  int
+	send func(seq int, data string) error
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= exportChunkSize {
+		end := bytes.LastIndexByte(w.buf, '\n')
+		if end < 0 {
+			break
+		}
+		if err := w.emit(end + 1); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *chunkWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	return w.emit(len(w.buf))
+}
+
+func (w *chunkWriter) emit(n int) error {
+	if err := w.send(w.seq, string(w.buf[:n])); err != nil {
+		return err
+	}
+	w.seq++
+	w.buf = append(w.buf[:0], w.buf[n:]...)
+	return nil
+}
+
+// directDB returns the sqlite handle for methods that only work against the database file.
+func (a *Agent) directDB(method string) (*sql.DB, error) {
+	if a.cfg.SourceMode == "api" {
+		return nil, fmt.Errorf("%s is not supported in api mode", method)
+	}
+	if a.db == nil {
+		return nil, errors.New("database is not configured")
+	}
+	return a.db, nil
+}
+
+// apiWriteMethods are the writes the TLS REST API has endpoints for, which hybrid mode sends to
+// TLS. The table methods only have endpoints for the tables listed, and player.delete only when
+// it does not anonymize.
+var apiWriteMethods = map[string][]string{
+	"query": nil, "player.profile.update": nil, "card.bind": nil, "card.unbind": nil,
+	"card.transfer": nil, "table.insert": {"Card"}, "table.delete": {"Card"},
+	"player.delete": nil, "player.favorites.add": nil, "player.favorites.remove": nil,
+}
+
+// writesThroughAPI reports whether a write goes to the TLS API: always in api mode, and in hybrid
+// mode when the API has an endpoint for it.
+func (a *Agent) writesThroughAPI(method, table string) bool {
+	switch a.cfg.SourceMode {
+	case "api":
+		return true
+	case "hybrid":
+		tables, ok := apiWriteMethods[method]
+		if !ok {
+			return false
+		}
+		if tables == nil {
+			return true
+		}
+		for _, t := range tables {
+			if t == table {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeDB returns the sqlite handle for a write to tables that goes to the database file. In
+// hybrid mode that bypasses TLS, so it is refused unless every table is in hybridDirectWrites.
+// writes is false for previews and dry runs, which are rolled back.
+func (a *Agent) writeDB(method string, writes bool, tables ...string) (*sql.DB, error) {
+	sqlDB, err := a.directDB(method)
+	if err != nil {
+		return nil, err
+	}
+	if writes && a.cfg.SourceMode == "hybrid" {
+		for _, table := range tables {
+			if !a.hybridDirectWrite(table) {
+				return nil, fmt.Errorf("%s writes %s in the database file, which hybrid mode only allows for tables in hybridDirectWrites", method, table)
+			}
+		}
+	}
+	return sqlDB, nil
+}
+
+func (a *Agent) hybridDirectWrite(table string) bool {
+	for _, t := range a.cfg.HybridDirectWrites {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+// ledgerTables lists the token ledger table when the ledger is on, so that writes which also
+// record token changes are checked against hybridDirectWrites for it.
+func (a *Agent) ledgerTables() []string {
+	if !a.cfg.TokenLedger {
+		return nil
+	}
+	return []string{db.TokenLedgerTable}
+}
+
+func (a *Agent) playerMerge(ctx context.Context, sourceBaid, targetBaid int, preview bool) (map[string]any, error) {
+	sqlDB, err := a.writeDB("player.merge", true, append(db.PlayerTables(), a.ledgerTables()...)...)
+	if err != nil {
+		return nil, err
+	}
+	result, err := db.MergePlayers(ctx, sqlDB, sourceBaid, targetBaid, preview, a.cfg.TokenLedger, a.cfg.AllowWrite)
+	if err != nil || preview {
+		return result, err
+	}
+	if err := a.updatePrunedHistory(func(h *db.PrunedHistory) { h.MovePlayer(sourceBaid, targetBaid) }); err != nil {
+		return nil, fmt.Errorf("merged, but updating the pruned history failed: %w", err)
+	}
+	return result, nil
+}
+
+func (a *Agent) playerRebuildBest(ctx context.Context, baid *int, apply bool, exact bool) (map[string]any, error) {
+	sqlDB, err := a.writeDB("player.rebuildBest", apply, "SongBestData")
+	if err != nil {
+		return nil, err
+	}
+	pruned, err := db.LoadPrunedHistory(db.PrunedHistoryPath(a.cfg.DBPath))
+	if err != nil {
+		return nil, fmt.Errorf("pruned history: %w", err)
+	}
+	return db.RebuildSongBest(ctx, sqlDB, baid, apply, exact, pruned, a.cfg.AllowWrite)
+}
+
+func (a *Agent) playerStats(ctx context.Context, baid int) (*db.PlayerStats, error) {
+	if a.cfg.SourceMode == "api" {
+		if a.api == nil {
+			return nil, errors.New("api client is not configured")
+		}
+		return a.api.PlayerStats(ctx, baid)
+	}
+	if a.db == nil {
+		return nil, errors.New("database is not configured")
+	}
+	return db.PlayerStatsDirect(ctx, a.db, baid)
+}
+
+func (a *Agent) leaderboardSong(ctx context.Context, params protocol.LeaderboardSongParams) (map[string]any, error) {
+	sqlDB, err := a.directDB("leaderboard.song")
+	if err != nil {
+		return nil, err
+	}
+	return db.SongLeaderboard(ctx, sqlDB, params.SongID, params.Difficulty, params.Limit, params.Offset, params.Baid)
+}
+
+func (a *Agent) leaderboardOverall(ctx context.Context, params protocol.LeaderboardOverallParams) (map[string]any, error) {
+	sqlDB, err := a.directDB("leaderboard.overall")
+	if err != nil {
+		return nil, err
+	}
+	return db.OverallLeaderboard(ctx, sqlDB, params.By, params.DanType, params.Limit, params.Offset, params.Baid)
+}
+
+func (a *Agent) playerCreate(ctx context.Context, params protocol.PlayerCreateParams) (map[string]any, error) {
+	sqlDB, err := a.writeDB("player.create", true, append([]string{"UserData", "Card", "Credential", "Tokens"}, a.ledgerTables()...)...)
+	if err != nil {
+		return nil, err
+	}
+	player := db.NewPlayer{
+		AccessCode:   params.AccessCode,
+		MyDonName:    params.MyDonName,
+		Title:        params.Title,
+		TitlePlateID: params.TitlePlateID,
+		Costume:      params.Costume,
+		Password:     params.Password,
+		Tokens:       params.Tokens,
+	}
+	return db.CreatePlayer(ctx, sqlDB, player, a.cfg.TokenLedger, a.cfg.AllowWrite)
+}
+
+func (a *Agent) playerDelete(ctx context.Context, baid int, anonymize bool) (map[string]any, error) {
+	var result map[string]any
+	var err error
+	if !anonymize && a.writesThroughAPI("player.delete", "") {
+		if a.api == nil {
+			return nil, errors.New("api client is not configured")
+		}
+		if a.db == nil {
+			return nil, errors.New("player.delete reads the database file for its pre-delete export")
+		}
+		result, err = a.api.DeletePlayer(ctx, a.db, baid, db.PlayerExportDir(a.cfg.DBPath), a.cfg.AllowWrite)
+	} else {
+		sqlDB, dbErr := a.writeDB("player.delete", true, db.PlayerTables()...)
+		if dbErr != nil {
+			return nil, dbErr
+		}
+		result, err = db.DeletePlayer(ctx, sqlDB, baid, anonymize, db.PlayerExportDir(a.cfg.DBPath), a.cfg.AllowWrite)
+	}
+	if err != nil || anonymize {
+		return result, err
+	}
+	if err := a.updatePrunedHistory(func(h *db.PrunedHistory) { h.RemovePlayer(baid) }); err != nil {
+		return nil, fmt.Errorf("deleted, but updating the pruned history failed: %w", err)
+	}
+	return result, nil
+}
+
+func (a *Agent) playerProfileUpdate(ctx context.Context, params protocol.PlayerProfileUpdateParams) (map[string]any, error) {
+	update := db.ProfileUpdate{
+		MyDonName:                    params.MyDonName,
+		MyDonNameLanguage:            params.MyDonNameLanguage,
+		Title:                        params.Title,
+		TitlePlateID:                 params.TitlePlateID,
+		ColorBody:                    params.ColorBody,
+		ColorFace:                    params.ColorFace,
+		ColorLimb:                    params.ColorLimb,
+		Costume:                      params.Costume,
+		IsVoiceOn:                    params.IsVoiceOn,
+		IsSkipOn:                     params.IsSkipOn,
+		NotesPosition:                params.NotesPosition,
+		DisplayAchievement:           params.DisplayAchievement,
+		AchievementDisplayDifficulty: params.AchievementDisplayDifficulty,
+		DisplayDan:                   params.DisplayDan,
+	}
+	if a.writesThroughAPI("player.profile.update", "") {
+		if a.api == nil {
+			return nil, errors.New("api client is not configured")
+		}
+		return a.api.UpdateProfile(ctx, params.Baid, update, a.cfg.AllowWrite)
+	}
+	if a.db == nil {
+		return nil, errors.New("database is not configured")
+	}
+	return db.UpdateProfile(ctx, a.db, params.Baid, update, a.cfg.AllowWrite)
+}
+
+func (a *Agent) playerFavorites(ctx context.Context, method string, params protocol.PlayerFavoritesParams) (map[string]any, error) {
+	if (method == "player.favorites.add" || method == "player.favorites.remove") && a.writesThroughAPI(method, "") {
+		if a.api == nil {
+			return nil, errors.New("api client is not configured")
+		}
+		if method == "player.favorites.add" {
+			return a.api.AddFavorites(ctx, params.Baid, params.SongIDs, a.cfg.AllowWrite)
+		}
+		return a.api.RemoveFavorites(ctx, params.Baid, params.SongIDs, a.cfg.AllowWrite)
+	}
+	sqlDB, err := a.writeDB(method, method != "player.favorites.list", "UserData")
+	if err != nil {
+		return nil, err
+	}
+	switch method {
+	case "player.favorites.add":
+		return db.AddFavorites(ctx, sqlDB, params.Baid, params.SongIDs, a.cfg.AllowWrite)
+	case "player.favorites.remove":
+		return db.RemoveFavorites(ctx, sqlDB, params.Baid, params.SongIDs, a.cfg.AllowWrite)
+	case "player.favorites.reorder":
+		return db.ReorderFavorites(ctx, sqlDB, params.Baid, params.SongIDs, a.cfg.AllowWrite)
+	default:
+		return db.ListFavorites(ctx, sqlDB, params.Baid)
+	}
+}
+
+func (a *Agent) sessions(ctx context.Context, method string, params protocol.SessionsParams) (map[string]any, error) {
+	query := db.SessionQuery{
+		Baid:       params.Baid,
+		From:       params.From,
+		To:         params.To,
+		GapMinutes: params.GapMinutes,
+		Limit:      params.Limit,
+		Offset:     params.Offset,
+	}
+	if method == "sessions.list" && a.cfg.SourceMode == "api" {
+		if a.api == nil {
+			return nil, errors.New("api client is not configured")
+		}
+		return a.api.ListSessions(ctx, query)
+	}
+	sqlDB, err := a.directDB(method)
+	if err != nil {
+		return nil, err
+	}
+	if method == "sessions.daily" {
+		return db.DailySessionSummary(ctx, sqlDB, query)
+	}
+	return db.ListSessions(ctx, sqlDB, query)
+}
+
+func (a *Agent) analyticsUsage(ctx context.Context, params protocol.AnalyticsUsageParams) (map[string]any, error) {
+	sqlDB, err := a.directDB("analytics.usage")
+	if err != nil {
+		return nil, err
+	}
+	zone := params.TimeZone
+	if zone == "" {
+		zone = a.cfg.TimeZone
+	}
+	loc := time.Local
+	if zone != "" {
+		loc, err = time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone: %s", zone)
+		}
+	}
+
+	query := db.UsageQuery{From: params.From, To: params.To, Top: params.Top, Location: loc}
+	compute := func() (*db.UsageReport, error) { return db.UsageAnalytics(ctx, sqlDB, query) }
+	var report *db.UsageReport
+	cached := false
+	if params.Refresh {
+		report, err = compute()
+	} else {
+		report, cached, err = a.usageCache.Get(query, compute)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"cached": cached, "usage": report}, nil
+}
+
+func (a *Agent) prunePolicy() db.PrunePolicy {
+	archiveDir := a.cfg.PruneArchiveDir
+	if archiveDir == "" && a.cfg.DBPath != "" {
+		archiveDir = filepath.Join(filepath.Dir(a.cfg.DBPath), "archive")
+	}
+	return db.PrunePolicy{
+		KeepDays:    a.cfg.RetentionDays,
+		KeepPlays:   a.cfg.RetentionPlays,
+		ArchiveDir:  archiveDir,
+		HistoryPath: db.PrunedHistoryPath(a.cfg.DBPath),
+		Vacuum:      a.cfg.PruneVacuum,
+	}
+}
+
+// prunedHistory returns the plays pruned from this source's database, read once and kept until
+// a prune, merge or delete changes them.
+func (a *Agent) prunedHistory() (*db.PrunedHistory, error) {
+	if history := a.pruned.Load(); history != nil {
+		return history, nil
+	}
+	history, err := db.LoadPrunedHistory(db.PrunedHistoryPath(a.cfg.DBPath))
+	if err != nil {
+		return nil, fmt.Errorf("pruned history: %w", err)
+	}
+	a.pruned.Store(history)
+	return history, nil
+}
+
+// updatePrunedHistory applies change to the pruned history file. It holds pruneMu so it cannot
+// interleave with a prune adding to the same file.
+func (a *Agent) updatePrunedHistory(change func(*db.PrunedHistory)) error {
+	if a.cfg.DBPath == "" {
+		return nil
+	}
+	a.pruneMu.Lock()
+	defer a.pruneMu.Unlock()
+	defer a.pruned.Store(nil)
+	path := db.PrunedHistoryPath(a.cfg.DBPath)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	history, err := db.LoadPrunedHistory(path)
+	if err != nil {
+		return err
+	}
+	change(history)
+	return history.Save(path)
+}
+
+// dbPrune applies the configured retention policy; params override single rules for this run.
+func (a *Agent) dbPrune(ctx context.Context, params protocol.DBPruneParams) (map[string]any, error) {
+	sqlDB, err := a.writeDB("db.prune", !params.Preview, "SongPlayData")
+	if err != nil {
+		return nil, err
+	}
+	policy := a.prunePolicy()
+	if params.KeepDays != nil {
+		policy.KeepDays = *params.KeepDays
+	}
+	if params.KeepPlays != nil {
+		policy.KeepPlays = *params.KeepPlays
+	}
+	if params.Vacuum != nil {
+		policy.Vacuum = *params.Vacuum
+	}
+	policy.Preview = params.Preview
+
+	if !a.pruneMu.TryLock() {
+		return nil, errors.New("a prune is already running")
+	}
+	defer a.pruneMu.Unlock()
+	report, err := db.PruneSongPlays(ctx, sqlDB, policy, a.cfg.AllowWrite)
+	a.pruned.Store(nil)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"prune": report}, nil
+}
+
+// runPruneSchedule applies the retention policy every PruneInterval until ctx is done. It runs
+// independently of the controller connection.
+func (a *Agent) runPruneSchedule(ctx context.Context) {
+	policy := a.prunePolicy()
+	switch {
+	case a.db == nil:
+		a.logger.Warnf("Scheduled prune%s needs direct mode, not running it", a.sourceLabel())
+		return
+	case !a.cfg.AllowWrite:
+		a.logger.Warnf("Scheduled prune%s needs allowWrite, not running it", a.sourceLabel())
+		return
+	case a.cfg.SourceMode == "hybrid" && !a.hybridDirectWrite("SongPlayData"):
+		a.logger.Warnf("Scheduled prune%s needs SongPlayData in hybridDirectWrites, not running it", a.sourceLabel())
+		return
+	case !policy.Enabled():
+		a.logger.Warnf("Scheduled prune%s has no retentionDays or retentionPlays, not running it", a.sourceLabel())
+		return
+	}
+
+	ticker := time.NewTicker(a.cfg.PruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if a.shutdown.Load() {
+			return
+		}
+		if !a.pruneMu.TryLock() {
+			continue
+		}
+		a.inflight.Add(1)
+		report, err := db.PruneSongPlays(ctx, a.db, policy, true)
+		a.pruned.Store(nil)
+		a.inflight.Done()
+		a.pruneMu.Unlock()
+		a.resultCache.Invalidate()
+		if err != nil {
+			a.logger.Errorf("scheduled prune%s: %v", a.sourceLabel(), err)
+			continue
+		}
+		if report.Deleted > 0 {
+			a.logger.Infof("Pruned %d plays from SongPlayData%s (archived to %s)", report.Deleted, a.sourceLabel(), report.Archive)
+		}
+	}
+}
+
+func (a *Agent) playerUnlocksGet(ctx context.Context, baid int) (map[string]any, error) {
+	sqlDB, err := a.directDB("player.unlocks.get")
+	if err != nil {
+		return nil, err
+	}
+	return db.GetUnlocks(ctx, sqlDB, baid)
+}
+
+func (a *Agent) playerUnlocksChange(ctx context.Context, method string, params protocol.PlayerUnlocksChangeParams) (map[string]any, error) {
+	sqlDB, err := a.writeDB(method, true, "UserData")
+	if err != nil {
+		return nil, err
+	}
+	revoke := method == "player.unlocks.revoke"
+	return db.ChangeUnlocks(ctx, sqlDB, params.Baids, params.All, params.Unlocks, revoke, a.cfg.AllowWrite)
+}
+
+func (a *Agent) tokensGrant(ctx context.Context, params protocol.TokensGrantParams) (map[string]any, error) {
+	sqlDB, err := a.writeDB("tokens.grant", true, "Tokens", db.TokenLedgerTable)
+	if err != nil {
+		return nil, err
+	}
+	filter := db.TokenFilter{Baids: params.Baids, All: params.All, PlayedWithinDays: params.PlayedWithinDays}
+	return db.GrantTokens(ctx, sqlDB, filter, params.TokenID, params.Count, params.Reason, a.cfg.AllowWrite)
+}
+
+func (a *Agent) tokensSet(ctx context.Context, params protocol.TokensSetParams) (map[string]any, error) {
+	sqlDB, err := a.writeDB("tokens.set", true, "Tokens", db.TokenLedgerTable)
+	if err != nil {
+		return nil, err
+	}
+	return db.SetTokens(ctx, sqlDB, params.Baid, params.TokenID, params.Count, params.Reason, a.cfg.AllowWrite)
+}
+
+func (a *Agent) tokensHistory(ctx context.Context, params protocol.TokensHistoryParams) (map[string]any, error) {
+	sqlDB, err := a.directDB("tokens.history")
+	if err != nil {
+		return nil, err
+	}
+	return db.TokenHistory(ctx, sqlDB, params.Baid, params.TokenID, params.Limit, params.Offset)
+}
+
+func (a *Agent) credentialSet(ctx context.Context, params protocol.CredentialSetParams) (map[string]any, error) {
+	sqlDB, err := a.writeDB("credential.set", true, "Credential")
+	if err != nil {
+		return nil, err
+	}
+	return db.SetPassword(ctx, sqlDB, params.Baid, params.Password, a.resetCodes, params.ResetCode, a.cfg.AllowWrite)
+}
+
+func (a *Agent) credentialReset(ctx context.Context, baid int) (map[string]any, error) {
+	sqlDB, err := a.directDB("credential.reset")
+	if err != nil {
+		return nil, err
+	}
+	return db.IssueResetCode(ctx, sqlDB, a.resetCodes, baid, a.cfg.AllowWrite)
+}
+
+func (a *Agent) cardBind(ctx context.Context, baid int, accessCode string) (map[string]any, error) {
+	if a.writesThroughAPI("card.bind", "") {
+		if a.api == nil {
+			return nil, errors.New("api client is not configured")
+		}
+		return a.api.CardBind(ctx, baid, accessCode, a.cfg.AllowWrite)
+	}
+	if a.db == nil {
+		return nil, errors.New("database is not configured")
+	}
+	return db.CardBind(ctx, a.db, baid, accessCode, a.cfg.AllowWrite)
+}
+
+func (a *Agent) cardUnbind(ctx context.Context, accessCode string, force bool) (map[string]any, error) {
+	if a.writesThroughAPI("card.unbind", "") {
+		if a.api == nil {
+			return nil, errors.New("api client is not configured")
+		}
+		return a.api.CardUnbind(ctx, accessCode, force, a.cfg.AllowWrite)
+	}
+	if a.db == nil {
+		return nil, errors.New("database is not configured")
+	}
+	return db.CardUnbind(ctx, a.db, accessCode, force, a.cfg.AllowWrite)
+}
+
+func (a *Agent) cardTransfer(ctx context.Context, accessCode string, targetBaid int, force bool) (map[string]any, error) {
+	if a.writesThroughAPI("card.transfer", "") {
+		if a.api == nil {
+			return nil, errors.New("api client is not configured")
+		}
+		return a.api.CardTransfer(ctx, accessCode, targetBaid, force, a.cfg.AllowWrite)
+	}
+	if a.db == nil {
+		return nil, errors.New("database is not configured")
+	}
+	return db.CardTransfer(ctx, a.db, accessCode, targetBaid, force, a.cfg.AllowWrite)
+}
+
+func (a *Agent) cardLookup(ctx context.Context, accessCode string) (map[string]any, error) {
+	if a.cfg.SourceMode == "api" {
+		if a.api == nil {
+			return nil, errors.New("api client is not configured")
+		}
+		return a.api.CardLookup(ctx, accessCode)
+	}
+	if a.db == nil {
+		return nil, errors.New("database is not configured")
+	}
+	return db.CardLookup(ctx, a.db, accessCode)
+}
+
+func (a *Agent) syncExport(ctx context.Context, since string) (*db.ChangeSet, error) {
+	sqlDB, err := a.directDB("sync.export")
+	if err != nil {
+		return nil, err
+	}
+	return db.ExportChangeSet(ctx, sqlDB, a.cfg.AgentID, since)
+}
+
+func (a *Agent) syncApply(ctx context.Context, params protocol.SyncApplyParams) (*db.SyncReport, error) {
+	sqlDB, err := a.writeDB("sync.apply", true, "SongBestData", "AiScoreData", "DanScoreData", "DanStageScoreData")
+	if err != nil {
+		return nil, err
+	}
+
+	statePath := db.SyncStatePath(a.cfg.DBPath)
+	state, err := db.LoadSyncState(statePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var report *db.SyncReport
+	if params.FromDBPath != "" {
+		from, err := a.syncSource(params.FromDBPath)
+		if err != nil {
+			return nil, err
+		}
+		origin, err := filepath.Abs(from.cfg.DBPath)
+		if err != nil {
+			return nil, err
+		}
+		srcDB := from.db
+
+		report, err = db.SyncDatabases(ctx, srcDB, sqlDB, origin, state, params.Full, params.DryRun, a.cfg.AllowWrite)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var changeSet db.ChangeSet
+		if err := json.Unmarshal(params.ChangeSet, &changeSet); err != nil {
+			return nil, fmt.Errorf("invalid changeSet: %w", err)
+		}
+		report, err = db.ApplyTrackedChangeSet(ctx, sqlDB, &changeSet, state, params.DryRun, a.cfg.AllowWrite)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !params.DryRun {
+		if err := state.Save(statePath); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// syncSource returns the source whose database file is path. Only the database files of the
+// configured sources can be synced from, so a request cannot open or create other files.
+func (a *Agent) syncSource(path string) (*Agent, error) {
+	want, err := os.Stat(path)
+	if err == nil {
+		for _, src := range a.root.allSources() {
+			if src == a || src.db == nil {
+				continue
+			}
+			if info, err := os.Stat(src.cfg.DBPath); err == nil && os.SameFile(want, info) {
+				return src, nil
+			}
 		}
-		return a.api.TableDelete(ctx, table, filters, a.cfg.AllowWrite)
-	}
-	if a.db == nil {
-		return nil, errors.New("database is not configured")
 	}
-	return db.TableDelete(ctx, a.db, table, filters, a.cfg.AllowWrite)
+	return nil, fmt.Errorf("fromDbPath must be the database of another configured source: %s", path)
 }
 
 type movieDataEntry struct {
@@ -5,6 +5,8 @@ import (
 	"flag"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -21,28 +23,126 @@ type Config struct {
 	PingInterval   time.Duration
 	ReconnectDelay time.Duration
 	RequestTimeout time.Duration
+
+	// Events lists the change feed event types pushed to the controller; empty disables the feed
+	// and "*" subscribes to all of them.
+	Events            []string
+	EventPollInterval time.Duration
+
+	// TimeZone is the IANA zone analytics are bucketed in; empty means the cabinet's local zone.
+	TimeZone          string
+	AnalyticsCacheTTL time.Duration
+
+	// Retention policy for SongPlayData; zero disables a rule. PruneInterval schedules the
+	// prune job and is off when zero. PruneArchiveDir defaults to a folder next to the database.
+	RetentionDays   int
+	RetentionPlays  int
+	PruneInterval   time.Duration
+	PruneArchiveDir string
+	PruneVacuum     bool
+
+	// ResultCacheSize is the number of read results kept by the result cache; zero disables it.
+	ResultCacheSize int
+	ResultCacheTTL  time.Duration
+
+	// SlowQueryThreshold is how long a statement may run before it is logged; zero disables it.
+	SlowQueryThreshold time.Duration
+
+	// SQLConsole enables sql.query, which runs arbitrary SELECTs on a read-only connection.
+	SQLConsole bool
+
+	// ExportDir is where table.export writes files; empty means an exports folder next to the
+	// executable.
+	ExportDir string
+	// TransferTimeout replaces RequestTimeout for table.export and table.import, which can run for
+	// minutes on a large table.
+	TransferTimeout time.Duration
+
+	// TokenLedger records token changes in an extra table inside the TLS database, which
+	// tokens.history reads. tokens.grant, tokens.set and tokens.history are refused without it.
+	TokenLedger bool
+
+	// HybridDirectWrites lists the tables hybrid mode may write in the database file when the TLS
+	// API has no endpoint for a write. Other such writes are refused.
+	HybridDirectWrites []string
+
+	// Sources are further data sources served next to the one configured above, which is named
+	// DefaultSource. Requests pick one with a source param.
+	Sources []Source
+}
+
+// DefaultSource names the data source configured by the top-level settings.
+const DefaultSource = "default"
+
+// Source is a named data source, for PCs that host more than one TLS instance. Every setting
+// other than these is shared with the default source.
+type Source struct {
+	Name       string
+	SourceMode string
+	DBPath     string
+	APIBaseURL string
+	APIToken   string
+	AllowWrite bool
+
+	HybridDirectWrites []string
 }
 
 type jsonConfig struct {
-	Controller      string `json:"controller"`
-	Token           string `json:"token"`
-	AgentId         string `json:"agentId"`
-	Source          string `json:"source"`
-	DbPath          string `json:"dbPath"`
-	ApiBaseUrl      string `json:"apiBaseUrl"`
-	ApiToken        string `json:"apiToken"`
-	AllowWrite      bool   `json:"allowWrite"`
-	LogTraffic      bool   `json:"logTraffic"`
-	PingInterval    string `json:"pingInterval"`
-	ReconnectDelay  string `json:"reconnectDelay"`
-	RequestTimeout  string `json:"requestTimeout"`
+	Controller         string       `json:"controller"`
+	Token              string       `json:"token"`
+	AgentId            string       `json:"agentId"`
+	Source             string       `json:"source"`
+	DbPath             string       `json:"dbPath"`
+	ApiBaseUrl         string       `json:"apiBaseUrl"`
+	ApiToken           string       `json:"apiToken"`
+	AllowWrite         bool         `json:"allowWrite"`
+	LogTraffic         bool         `json:"logTraffic"`
+	PingInterval       string       `json:"pingInterval"`
+	ReconnectDelay     string       `json:"reconnectDelay"`
+	RequestTimeout     string       `json:"requestTimeout"`
+	Events             []string     `json:"events"`
+	EventPollInterval  string       `json:"eventPollInterval"`
+	TimeZone           string       `json:"timeZone"`
+	AnalyticsCacheTTL  string       `json:"analyticsCacheTtl"`
+	RetentionDays      int          `json:"retentionDays"`
+	RetentionPlays     int          `json:"retentionPlays"`
+	PruneInterval      string       `json:"pruneInterval"`
+	PruneArchiveDir    string       `json:"pruneArchiveDir"`
+	PruneVacuum        bool         `json:"pruneVacuum"`
+	ResultCacheSize    *int         `json:"resultCacheSize"`
+	ResultCacheTTL     string       `json:"resultCacheTtl"`
+	SlowQueryThreshold string       `json:"slowQueryThreshold"`
+	SQLConsole         bool         `json:"sqlConsole"`
+	ExportDir          string       `json:"exportDir"`
+	TransferTimeout    string       `json:"transferTimeout"`
+	TokenLedger        *bool        `json:"tokenLedger"`
+	HybridDirectWrites []string     `json:"hybridDirectWrites"`
+	Sources            []jsonSource `json:"sources"`
+}
+
+type jsonSource struct {
+	Name       string `json:"name"`
+	Mode       string `json:"mode"`
+	DbPath     string `json:"dbPath"`
+	ApiBaseUrl string `json:"apiBaseUrl"`
+	ApiToken   string `json:"apiToken"`
+	AllowWrite bool   `json:"allowWrite"`
+
+	HybridDirectWrites []string `json:"hybridDirectWrites"`
 }
 
 func FromFlags() Config {
 	cfg := Config{
-		PingInterval:   20 * time.Second,
-		ReconnectDelay: 5 * time.Second,
-		RequestTimeout: 10 * time.Second,
+		PingInterval:       20 * time.Second,
+		ReconnectDelay:     5 * time.Second,
+		RequestTimeout:     10 * time.Second,
+		TransferTimeout:    10 * time.Minute,
+		EventPollInterval:  2 * time.Second,
+		AnalyticsCacheTTL:  5 * time.Minute,
+		ResultCacheSize:    256,
+		ResultCacheTTL:     10 * time.Second,
+		SlowQueryThreshold: 500 * time.Millisecond,
+		TokenLedger:        true,
 	}
 
 	// Try to load from agent-config.json in the same directory as the executable
@@ -76,6 +176,63 @@ func FromFlags() Config {
 						cfg.RequestTimeout = d
 					}
 				}
+				cfg.Events = jcfg.Events
+				if jcfg.EventPollInterval != "" {
+					if d, err := time.ParseDuration(jcfg.EventPollInterval); err == nil {
+						cfg.EventPollInterval = d
+					}
+				}
+				cfg.TimeZone = jcfg.TimeZone
+				if jcfg.AnalyticsCacheTTL != "" {
+					if d, err := time.ParseDuration(jcfg.AnalyticsCacheTTL); err == nil {
+						cfg.AnalyticsCacheTTL = d
+					}
+				}
+				cfg.RetentionDays = jcfg.RetentionDays
+				cfg.RetentionPlays = jcfg.RetentionPlays
+				if jcfg.PruneInterval != "" {
+					if d, err := time.ParseDuration(jcfg.PruneInterval); err == nil {
+						cfg.PruneInterval = d
+					}
+				}
+				cfg.PruneArchiveDir = jcfg.PruneArchiveDir
+				cfg.PruneVacuum = jcfg.PruneVacuum
+				if jcfg.ResultCacheSize != nil {
+					cfg.ResultCacheSize = *jcfg.ResultCacheSize
+				}
+				if jcfg.ResultCacheTTL != "" {
+					if d, err := time.ParseDuration(jcfg.ResultCacheTTL); err == nil {
+						cfg.ResultCacheTTL = d
+					}
+				}
+				if jcfg.SlowQueryThreshold != "" {
+					if d, err := time.ParseDuration(jcfg.SlowQueryThreshold); err == nil {
+						cfg.SlowQueryThreshold = d
+					}
+				}
+				cfg.SQLConsole = jcfg.SQLConsole
+				cfg.ExportDir = jcfg.ExportDir
+				if jcfg.TransferTimeout != "" {
+					if d, err := time.ParseDuration(jcfg.TransferTimeout); err == nil {
+						cfg.TransferTimeout = d
+					}
+				}
+				if jcfg.TokenLedger != nil {
+					cfg.TokenLedger = *jcfg.TokenLedger
+				}
+				cfg.HybridDirectWrites = jcfg.HybridDirectWrites
+				for _, src := range jcfg.Sources {
+					cfg.Sources = append(cfg.Sources, Source{
+						Name:       src.Name,
+						SourceMode: src.Mode,
+						DBPath:     src.DbPath,
+						APIBaseURL: src.ApiBaseUrl,
+						APIToken:   src.ApiToken,
+						AllowWrite: src.AllowWrite,
+
+						HybridDirectWrites: src.HybridDirectWrites,
+					})
+				}
 			}
 		}
 	}
@@ -84,7 +241,7 @@ func FromFlags() Config {
 	flag.StringVar(&cfg.ControllerURL, "controller", getEnv("EKIBEN_CONTROLLER", cfg.ControllerURL), "controller websocket url")
 	flag.StringVar(&cfg.Token, "token", getEnv("EKIBEN_TOKEN", cfg.Token), "agent auth token")
 	flag.StringVar(&cfg.AgentID, "agent-id", getEnv("EKIBEN_AGENT_ID", cfg.AgentID), "agent id")
-	flag.StringVar(&cfg.SourceMode, "source", getEnv("EKIBEN_SOURCE", cfg.SourceMode), "data source mode: direct or api")
+	flag.StringVar(&cfg.SourceMode, "source", getEnv("EKIBEN_SOURCE", cfg.SourceMode), "data source mode: direct, api or hybrid")
 	flag.StringVar(&cfg.DBPath, "db", getEnv("EKIBEN_DB", cfg.DBPath), "path to taiko.db3")
 	flag.StringVar(&cfg.APIBaseURL, "api-base-url", getEnv("EKIBEN_API_BASE_URL", cfg.APIBaseURL), "base url for TLS REST API")
 	flag.StringVar(&cfg.APIToken, "api-token", getEnv("EKIBEN_API_TOKEN", cfg.APIToken), "bearer token for TLS REST API (optional)")
@@ -93,11 +250,40 @@ func FromFlags() Config {
 	flag.DurationVar(&cfg.PingInterval, "ping", getEnvDuration("EKIBEN_PING", cfg.PingInterval), "ping interval")
 	flag.DurationVar(&cfg.ReconnectDelay, "reconnect", getEnvDuration("EKIBEN_RECONNECT", cfg.ReconnectDelay), "reconnect delay")
 	flag.DurationVar(&cfg.RequestTimeout, "timeout", getEnvDuration("EKIBEN_TIMEOUT", cfg.RequestTimeout), "request timeout")
+	events := flag.String("events", getEnv("EKIBEN_EVENTS", strings.Join(cfg.Events, ",")), "comma-separated change feed event types to push, or * for all")
+	flag.DurationVar(&cfg.EventPollInterval, "event-poll", getEnvDuration("EKIBEN_EVENT_POLL", cfg.EventPollInterval), "change feed poll interval")
+	flag.StringVar(&cfg.TimeZone, "timezone", getEnv("EKIBEN_TIMEZONE", cfg.TimeZone), "IANA time zone for analytics buckets (default: local)")
+	flag.DurationVar(&cfg.AnalyticsCacheTTL, "analytics-cache", getEnvDuration("EKIBEN_ANALYTICS_CACHE", cfg.AnalyticsCacheTTL), "how long analytics results are cached (0 disables)")
+	flag.IntVar(&cfg.RetentionDays, "retention-days", getEnvInt("EKIBEN_RETENTION_DAYS", cfg.RetentionDays), "keep SongPlayData rows younger than this many days (0 disables)")
+	flag.IntVar(&cfg.RetentionPlays, "retention-plays", getEnvInt("EKIBEN_RETENTION_PLAYS", cfg.RetentionPlays), "keep each player's last this many plays (0 disables)")
+	flag.DurationVar(&cfg.PruneInterval, "prune-interval", getEnvDuration("EKIBEN_PRUNE_INTERVAL", cfg.PruneInterval), "how often the retention policy is applied (0 disables)")
+	flag.StringVar(&cfg.PruneArchiveDir, "prune-archive", getEnv("EKIBEN_PRUNE_ARCHIVE", cfg.PruneArchiveDir), "directory pruned rows are archived to (default: archive next to the db)")
+	flag.BoolVar(&cfg.PruneVacuum, "prune-vacuum", getEnvBool("EKIBEN_PRUNE_VACUUM", cfg.PruneVacuum), "VACUUM the database after pruning")
+	flag.IntVar(&cfg.ResultCacheSize, "result-cache", getEnvInt("EKIBEN_RESULT_CACHE", cfg.ResultCacheSize), "number of read results to cache (0 disables)")
+	flag.DurationVar(&cfg.ResultCacheTTL, "result-cache-ttl", getEnvDuration("EKIBEN_RESULT_CACHE_TTL", cfg.ResultCacheTTL), "maximum age of a cached read result (0: until the data changes)")
+	flag.DurationVar(&cfg.SlowQueryThreshold, "slow-query", getEnvDuration("EKIBEN_SLOW_QUERY", cfg.SlowQueryThreshold), "log database statements slower than this (0 disables)")
+	flag.BoolVar(&cfg.SQLConsole, "sql-console", getEnvBool("EKIBEN_SQL_CONSOLE", cfg.SQLConsole), "allow read-only SQL through sql.query")
+	flag.StringVar(&cfg.ExportDir, "export-dir", getEnv("EKIBEN_EXPORT_DIR", cfg.ExportDir), "directory table.export writes files to (default: exports next to the executable)")
+	flag.DurationVar(&cfg.TransferTimeout, "transfer-timeout", getEnvDuration("EKIBEN_TRANSFER_TIMEOUT", cfg.TransferTimeout), "timeout for table.export and table.import")
+	flag.BoolVar(&cfg.TokenLedger, "token-ledger", getEnvBool("EKIBEN_TOKEN_LEDGER", cfg.TokenLedger), "record token changes in a ledger table inside the TLS database")
+	hybridDirectWrites := flag.String("hybrid-direct-writes", getEnv("EKIBEN_HYBRID_DIRECT_WRITES", strings.Join(cfg.HybridDirectWrites, ",")), "comma-separated tables hybrid mode may write in the database file when TLS has no endpoint")
 
 	flag.Parse()
+	cfg.Events = splitList(*events)
+	cfg.HybridDirectWrites = splitList(*hybridDirectWrites)
 	return cfg
 }
 
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func getEnv(key, fallback string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
@@ -115,6 +301,15 @@ func getEnvBool(key string, fallback bool) bool {
 	return fallback
 }
 
+func getEnvInt(key string, fallback int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return fallback
+}
+
 func getEnvDuration(key string, fallback time.Duration) time.Duration {
 	if v := os.Getenv(key); v != "" {
 		if d, err := time.ParseDuration(v); err == nil {
@@ -0,0 +1,231 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUsageDays = 30
+	defaultUsageTop  = 10
+	maxUsageTop      = 100
+)
+
+// UsageQuery selects the date range to aggregate. From and To are inclusive YYYY-MM-DD dates in
+// Location, which is also the zone plays are bucketed in. PlayTime itself is stored in cabinet
+// local time.
+type UsageQuery struct {
+	From     string
+	To       string
+	Top      int
+	Location *time.Location
+}
+
+type UsageReport struct {
+	From             string          `json:"from"`
+	To               string          `json:"to"`
+	TimeZone         string          `json:"timeZone"`
+	TotalPlays       int             `json:"totalPlays"`
+	UniquePlayers    int             `json:"uniquePlayers"`
+	NewPlayers       int             `json:"newPlayers"`
+	ReturningPlayers int             `json:"returningPlayers"`
+	ByHour           [24]int         `json:"byHour"`
+	ByWeekday        [7]int          `json:"byWeekday"`
+	ByDate           []UsageDay      `json:"byDate"`
+	MostPlayed       []SongPlayCount `json:"mostPlayed"`
+	LeastPlayed      []SongPlayCount `json:"leastPlayed"`
+	DifficultyMix    map[int]int     `json:"difficultyMix"`
+	GeneratedAt      string          `json:"generatedAt"`
+}
+
+type UsageDay struct {
+	Date    string `json:"date"`
+	Plays   int    `json:"plays"`
+	Players int    `json:"players"`
+}
+
+// UsageAnalytics aggregates SongPlayData over the query range. A player is new when their first
+// play ever falls in the range, and returning when they also played before it.
+func UsageAnalytics(ctx context.Context, db *sql.DB, query UsageQuery) (*UsageReport, error) {
+	loc := query.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	top := query.Top
+	if top == 0 {
+		top = defaultUsageTop
+	}
+	if top < 0 || top > maxUsageTop {
+		return nil, fmt.Errorf("top must be between 1 and %d", maxUsageTop)
+	}
+
+	now := time.Now().In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	start, end := today.AddDate(0, 0, -defaultUsageDays+1), today.AddDate(0, 0, 1)
+	if query.From != "" {
+		t, err := time.ParseInLocation("2006-01-02", query.From, loc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from date: %s", query.From)
+		}
+		start = t
+	}
+	if query.To != "" {
+		t, err := time.ParseInLocation("2006-01-02", query.To, loc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid to date: %s", query.To)
+		}
+		end = t.AddDate(0, 0, 1)
+	}
+	if !start.Before(end) {
+		return nil, errors.New("from must not be after to")
+	}
+
+	// The bounds are converted to cabinet local time so they compare with the stored text.
+	lower := start.In(time.Local).Format(dbTimeLayout)
+	upper := end.In(time.Local).Format(dbTimeLayout)
+	rows, err := queryRows(ctx, db,
+		"SELECT Baid, SongId, Difficulty, PlayTime FROM SongPlayData WHERE PlayTime >= ? AND PlayTime < ?", lower, upper)
+	if err != nil {
+		return nil, err
+	}
+	firstRows, err := queryRows(ctx, db, "SELECT Baid, MIN(PlayTime) AS FirstPlay FROM SongPlayData GROUP BY Baid")
+	if err != nil {
+		return nil, err
+	}
+
+	report := &UsageReport{
+		From:          start.Format("2006-01-02"),
+		To:            end.AddDate(0, 0, -1).Format("2006-01-02"),
+		TimeZone:      loc.String(),
+		ByDate:        []UsageDay{},
+		MostPlayed:    []SongPlayCount{},
+		LeastPlayed:   []SongPlayCount{},
+		DifficultyMix: map[int]int{},
+		GeneratedAt:   time.Now().Format(time.RFC3339),
+	}
+
+	players := make(map[int]struct{})
+	songs := make(map[int]int)
+	days := make(map[string]*UsageDay)
+	dayPlayers := make(map[string]map[int]struct{})
+	for _, row := range rows {
+		at, ok := parseDBTime(row["PlayTime"])
+		if !ok {
+			continue
+		}
+		at = at.In(loc)
+		baid := rowInt(row, "Baid")
+
+		report.TotalPlays++
+		report.ByHour[at.Hour()]++
+		report.ByWeekday[int(at.Weekday())]++
+		report.DifficultyMix[rowInt(row, "Difficulty")]++
+		songs[rowInt(row, "SongId")]++
+		players[baid] = struct{}{}
+
+		date := at.Format("2006-01-02")
+		day, ok := days[date]
+		if !ok {
+			day = &UsageDay{Date: date}
+			days[date] = day
+			dayPlayers[date] = make(map[int]struct{})
+		}
+		day.Plays++
+		dayPlayers[date][baid] = struct{}{}
+	}
+	report.UniquePlayers = len(players)
+
+	for _, row := range firstRows {
+		baid := rowInt(row, "Baid")
+		if _, ok := players[baid]; !ok {
+			continue
+		}
+		if fmt.Sprintf("%v", row["FirstPlay"]) >= lower {
+			report.NewPlayers++
+		} else {
+			report.ReturningPlayers++
+		}
+	}
+
+	for date, day := range days {
+		day.Players = len(dayPlayers[date])
+		report.ByDate = append(report.ByDate, *day)
+	}
+	sort.Slice(report.ByDate, func(i, j int) bool { return report.ByDate[i].Date < report.ByDate[j].Date })
+
+	counts := make([]SongPlayCount, 0, len(songs))
+	for songID, plays := range songs {
+		counts = append(counts, SongPlayCount{SongID: songID, Plays: plays})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Plays != counts[j].Plays {
+			return counts[i].Plays > counts[j].Plays
+		}
+		return counts[i].SongID < counts[j].SongID
+	})
+	report.MostPlayed = append(report.MostPlayed, counts[:min(top, len(counts))]...)
+	for i := len(counts) - 1; i >= 0 && len(report.LeastPlayed) < top; i-- {
+		report.LeastPlayed = append(report.LeastPlayed, counts[i])
+	}
+
+	return report, nil
+}
+
+// UsageCache keeps analytics reports for a fixed time, since they scan the whole play history
+// and the numbers barely move between two dashboard refreshes.
+type UsageCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]usageCacheEntry
+}
+
+type usageCacheEntry struct {
+	report  *UsageReport
+	expires time.Time
+}
+
+func NewUsageCache(ttl time.Duration) *UsageCache {
+	return &UsageCache{ttl: ttl, entries: make(map[string]usageCacheEntry)}
+}
+
+// Get returns the cached report for query, computing it with fn on a miss. A zero TTL disables
+// the cache.
+func (c *UsageCache) Get(query UsageQuery, fn func() (*UsageReport, error)) (*UsageReport, bool, error) {
+	if c == nil || c.ttl <= 0 {
+		report, err := fn()
+		return report, false, err
+	}
+	loc := query.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	key := fmt.Sprintf("%s|%s|%d|%s", query.From, query.To, query.Top, loc)
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.report, true, nil
+	}
+
+	report, err := fn()
+	if err != nil {
+		return nil, false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = usageCacheEntry{report: report, expires: now.Add(c.ttl)}
+	return report, false, nil
+}
@@ -0,0 +1,251 @@
+package db
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Result cache limits. An entry larger than resultCacheMaxEntryBytes is not cached at all, since
+// one such result would push out many small ones.
+const (
+	resultCacheMaxBytes      = 32 << 20
+	resultCacheMaxEntryBytes = 4 << 20
+)
+
+// ResultCache keeps encoded read results keyed by the normalized request. In direct mode it
+// follows PRAGMA data_version on its own connection and drops everything once another connection
+// (TLS, or the agent's own pool) commits. TTL bounds how old an entry may get, which is the only
+// thing that ages entries in api mode where TLS writes are not visible to the agent, so a TTL is
+// required there.
+type ResultCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	entries    map[string]*list.Element
+	order      *list.List
+	bytes      int
+	generation uint64
+
+	// versionMu guards the connection data_version is read on. It is separate from mu so that
+	// the round trip does not hold up the rest of the cache.
+	versionMu   sync.Mutex
+	db          *sql.DB
+	conn        *sql.Conn
+	dataVersion int64
+
+	hits          int64
+	misses        int64
+	invalidations int64
+	evictions     int64
+}
+
+type resultCacheEntry struct {
+	key     string
+	data    []byte
+	expires time.Time
+}
+
+type CacheStats struct {
+	Enabled       bool    `json:"enabled"`
+	Entries       int     `json:"entries"`
+	Bytes         int     `json:"bytes"`
+	MaxEntries    int     `json:"maxEntries"`
+	MaxBytes      int     `json:"maxBytes"`
+	TTLSeconds    float64 `json:"ttlSeconds"`
+	Hits          int64   `json:"hits"`
+	Misses        int64   `json:"misses"`
+	HitRate       float64 `json:"hitRate"`
+	Invalidations int64   `json:"invalidations"`
+	Evictions     int64   `json:"evictions"`
+}
+
+// NewResultCache returns a cache holding up to maxEntries results; zero disables it. db is nil in
+// api mode.
+func NewResultCache(db *sql.DB, maxEntries int, ttl time.Duration) *ResultCache {
+	return &ResultCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+		db:         db,
+	}
+}
+
+func (c *ResultCache) enabled() bool {
+	return c != nil && c.maxEntries > 0
+}
+
+// lookup returns the cached data for key and the generation to pass to store on a miss.
+func (c *ResultCache) lookup(ctx context.Context, key string) ([]byte, uint64, bool) {
+	changed := c.dataChanged(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if changed {
+		c.invalidate()
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*resultCacheEntry)
+		if c.ttl <= 0 || time.Now().Before(entry.expires) {
+			c.order.MoveToFront(elem)
+			c.hits++
+			return entry.data, c.generation, true
+		}
+		c.remove(elem)
+	}
+	c.misses++
+	return nil, c.generation, false
+}
+
+// store adds data under key unless the cache was invalidated since the lookup that returned
+// generation, in which case data may already be stale.
+func (c *ResultCache) store(key string, generation uint64, data []byte) {
+	if len(data) > resultCacheMaxEntryBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	entry := &resultCacheEntry{key: key, data: data, expires: time.Now().Add(c.ttl)}
+	c.entries[key] = c.order.PushFront(entry)
+	c.bytes += len(data)
+	for len(c.entries) > c.maxEntries || c.bytes > resultCacheMaxBytes {
+		c.remove(c.order.Back())
+		c.evictions++
+	}
+}
+
+func (c *ResultCache) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*resultCacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= len(entry.data)
+}
+
+// Invalidate drops every entry. The agent calls it after each of its own writes.
+func (c *ResultCache) Invalidate() {
+	if !c.enabled() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidate()
+}
+
+func (c *ResultCache) invalidate() {
+	c.generation++
+	if len(c.entries) == 0 {
+		return
+	}
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	c.bytes = 0
+	c.invalidations++
+}
+
+// dataChanged reports whether the database changed since the previous check. A failing
+// connection is dropped and counts as a change, as its version cannot be trusted.
+func (c *ResultCache) dataChanged(ctx context.Context) bool {
+	if c.db == nil {
+		return false
+	}
+	c.versionMu.Lock()
+	defer c.versionMu.Unlock()
+	if c.conn == nil {
+		conn, err := c.db.Conn(ctx)
+		if err != nil {
+			return true
+		}
+		c.conn = conn
+		c.dataVersion = -1
+	}
+	var version int64
+	if err := c.conn.QueryRowContext(ctx, "PRAGMA data_version").Scan(&version); err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return true
+	}
+	if version != c.dataVersion {
+		c.dataVersion = version
+		return true
+	}
+	return false
+}
+
+func (c *ResultCache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := CacheStats{
+		Enabled:       c.enabled(),
+		Entries:       len(c.entries),
+		Bytes:         c.bytes,
+		MaxEntries:    c.maxEntries,
+		MaxBytes:      resultCacheMaxBytes,
+		TTLSeconds:    c.ttl.Seconds(),
+		Hits:          c.hits,
+		Misses:        c.misses,
+		Invalidations: c.invalidations,
+		Evictions:     c.evictions,
+	}
+	if total := c.hits + c.misses; total > 0 {
+		stats.HitRate = float64(c.hits) / float64(total)
+	}
+	return stats
+}
+
+type bypassCacheKey struct{}
+
+// bypassCache marks ctx so doJSON reads past the cache. Reads that a write is based on use it, so
+// a stale cached row is never written back.
+func bypassCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassCacheKey{}, true)
+}
+
+func cacheBypassed(ctx context.Context) bool {
+	bypass, _ := ctx.Value(bypassCacheKey{}).(bool)
+	return bypass
+}
+
+// CachedResult returns the cached result for key, or runs fn and caches what it returns. Hits are
+// decoded from JSON, so numbers come back as float64; the controller only ever sees the JSON.
+func CachedResult(ctx context.Context, c *ResultCache, key string, fn func() (map[string]any, error)) (map[string]any, error) {
+	if !c.enabled() || key == "" {
+		return fn()
+	}
+	data, generation, ok := c.lookup(ctx, key)
+	if ok {
+		var result map[string]any
+		if err := json.Unmarshal(data, &result); err == nil {
+			return result, nil
+		}
+	}
+	result, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	if data, err := json.Marshal(result); err == nil {
+		c.store(key, generation, data)
+	}
+	return result, nil
+}
+
+// CacheKey normalizes a request into a cache key. Maps are encoded with sorted keys, so filters
+// given in a different order share an entry.
+func CacheKey(method string, params any) string {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return ""
+	}
+	return method + " " + string(data)
+}
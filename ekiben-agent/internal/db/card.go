@@ -0,0 +1,382 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// NormalizeAccessCode uppercases a card access code and strips the separators people type when
+// copying it from a card. The result must be a 20 digit access code or a 16 digit FeliCa IDm. Only
+// new bindings are checked this strictly; see cleanAccessCode.
+func NormalizeAccessCode(code string) (string, error) {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(code) {
+		switch {
+		case isAccessCodeSeparator(r):
+			continue
+		case (r >= '0' && r <= '9') || (r >= 'A' && r <= 'F'):
+			b.WriteRune(r)
+		default:
+			return "", fmt.Errorf("invalid access code: unexpected character %q", r)
+		}
+	}
+
+	normalized := b.String()
+	if len(normalized) != 16 && len(normalized) != 20 {
+		return "", fmt.Errorf("invalid access code: expected 16 or 20 characters, got %d", len(normalized))
+	}
+	return normalized, nil
+}
+
+func isAccessCodeSeparator(r rune) bool {
+	return r == ' ' || r == '-' || r == ':' || r == '.' || r == '\t'
+}
+
+// cleanAccessCode uppercases an access code that should already be bound and strips the same
+// separators as NormalizeAccessCode, without its character and length checks: cards bound by TLS
+// itself or by older tools need not fit it, and must still be found. It returns the codes to try
+// in order, the stripped code first and then the trimmed code as typed, if that differs, so that
+// legacy codes stored with separators still match.
+func cleanAccessCode(code string) ([]string, error) {
+	trimmed := strings.ToUpper(strings.TrimSpace(code))
+	stripped := strings.Map(func(r rune) rune {
+		if isAccessCodeSeparator(r) {
+			return -1
+		}
+		return r
+	}, trimmed)
+	if stripped == "" {
+		return nil, errors.New("access code is required")
+	}
+	if stripped == trimmed {
+		return []string{stripped}, nil
+	}
+	return []string{stripped, trimmed}, nil
+}
+
+// cardOwner returns the Baid the first of codes that is bound belongs to, along with that code as
+// stored. Codes are matched regardless of case. When none is bound it returns the first code and
+// a Baid of 0.
+func cardOwner(ctx context.Context, q querier, codes ...string) (string, int, error) {
+	for _, code := range codes {
+		var stored string
+		var baid int
+		err := q.QueryRowContext(ctx, "SELECT AccessCode, Baid FROM Card WHERE AccessCode = ? COLLATE NOCASE ORDER BY AccessCode LIMIT 1", code).Scan(&stored, &baid)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		return stored, baid, err
+	}
+	return codes[0], 0, nil
+}
+
+func cardCount(ctx context.Context, q querier, baid int) (int, error) {
+	var count int
+	err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM Card WHERE Baid = ?", baid).Scan(&count)
+	return count, err
+}
+
+func CardBind(ctx context.Context, db *sql.DB, baid int, accessCode string, allowWrite bool) (map[string]any, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+	code, err := NormalizeAccessCode(accessCode)
+	if err != nil {
+		return nil, err
+	}
+
+	err = withTx(ctx, db, true, func(tx *sql.Tx) error {
+		if err := requirePlayer(ctx, tx, baid); err != nil {
+			return err
+		}
+		_, owner, err := cardOwner(ctx, tx, code)
+		if err != nil {
+			return err
+		}
+		if err := checkUnbound(code, owner, baid); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO Card (AccessCode, Baid) VALUES (?, ?)", code, baid)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"ok": true, "accessCode": code, "baid": baid}, nil
+}
+
+// CardUnbind removes an access code. Unless force is set it refuses to remove a player's last
+// card, since the player could no longer log in on the cabinet.
+func CardUnbind(ctx context.Context, db *sql.DB, accessCode string, force bool, allowWrite bool) (map[string]any, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+	codes, err := cleanAccessCode(accessCode)
+	if err != nil {
+		return nil, err
+	}
+
+	var code string
+	var owner int
+	err = withTx(ctx, db, true, func(tx *sql.Tx) error {
+		code, owner, err = cardOwner(ctx, tx, codes...)
+		if err != nil {
+			return err
+		}
+		if owner == 0 {
+			return fmt.Errorf("access code not found: %s", code)
+		}
+		count, err := cardCount(ctx, tx, owner)
+		if err != nil {
+			return err
+		}
+		if err := checkNotLastCard(owner, count, force); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM Card WHERE AccessCode = ?", code)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"ok": true, "accessCode": code, "baid": owner}, nil
+}
+
+// CardTransfer moves an access code to targetBaid, with the same last-card check as CardUnbind.
+func CardTransfer(ctx context.Context, db *sql.DB, accessCode string, targetBaid int, force bool, allowWrite bool) (map[string]any, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+	codes, err := cleanAccessCode(accessCode)
+	if err != nil {
+		return nil, err
+	}
+
+	var code string
+	var owner int
+	err = withTx(ctx, db, true, func(tx *sql.Tx) error {
+		if err := requirePlayer(ctx, tx, targetBaid); err != nil {
+			return err
+		}
+		code, owner, err = cardOwner(ctx, tx, codes...)
+		if err != nil {
+			return err
+		}
+		if owner == 0 {
+			return fmt.Errorf("access code not found: %s", code)
+		}
+		if owner == targetBaid {
+			return fmt.Errorf("access code is already bound to baid %d", targetBaid)
+		}
+		count, err := cardCount(ctx, tx, owner)
+		if err != nil {
+			return err
+		}
+		if err := checkNotLastCard(owner, count, force); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE Card SET Baid = ? WHERE AccessCode = ?", targetBaid, code)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"ok": true, "accessCode": code, "fromBaid": owner, "baid": targetBaid}, nil
+}
+
+func CardLookup(ctx context.Context, db *sql.DB, accessCode string) (map[string]any, error) {
+	codes, err := cleanAccessCode(accessCode)
+	if err != nil {
+		return nil, err
+	}
+
+	code, owner, err := cardOwner(ctx, db, codes...)
+	if err != nil {
+		return nil, err
+	}
+	if owner == 0 {
+		return map[string]any{"found": false, "accessCode": code}, nil
+	}
+
+	rows, err := queryRows(ctx, db, "SELECT AccessCode FROM Card WHERE Baid = ? ORDER BY AccessCode", owner)
+	if err != nil {
+		return nil, err
+	}
+	cards := make([]string, 0, len(rows))
+	for _, row := range rows {
+		cards = append(cards, fmt.Sprintf("%v", row["AccessCode"]))
+	}
+
+	var name sql.NullString
+	if err := db.QueryRowContext(ctx, "SELECT MyDonName FROM UserData WHERE Baid = ?", owner).Scan(&name); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	return map[string]any{
+		"found":      true,
+		"accessCode": code,
+		"baid":       owner,
+		"myDonName":  name.String,
+		"cards":      cards,
+	}, nil
+}
+
+func checkUnbound(code string, owner, baid int) error {
+	switch {
+	case owner == 0:
+		return nil
+	case owner == baid:
+		return fmt.Errorf("access code %s is already bound to this player", code)
+	default:
+		return fmt.Errorf("access code %s is already bound to baid %d", code, owner)
+	}
+}
+
+func checkNotLastCard(baid, count int, force bool) error {
+	if count <= 1 && !force {
+		return fmt.Errorf("baid %d would be left without a card (use force to allow)", baid)
+	}
+	return nil
+}
+
+func (c *APIClient) cardOwner(ctx context.Context, codes ...string) (string, int, error) {
+	rows, err := c.listCards(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+	for _, code := range codes {
+		for _, row := range rows {
+			if stored := fmt.Sprintf("%v", row["AccessCode"]); strings.EqualFold(stored, code) {
+				baid, _ := anyToIntNoError(row["Baid"])
+				return stored, baid, nil
+			}
+		}
+	}
+	return codes[0], 0, nil
+}
+
+func (c *APIClient) CardBind(ctx context.Context, baid int, accessCode string, allowWrite bool) (map[string]any, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+	ctx = bypassCache(ctx)
+	code, err := NormalizeAccessCode(accessCode)
+	if err != nil {
+		return nil, err
+	}
+	_, owner, err := c.cardOwner(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkUnbound(code, owner, baid); err != nil {
+		return nil, err
+	}
+
+	body := map[string]any{"baid": baid, "accessCode": code}
+	if err := c.doJSON(ctx, http.MethodPost, "/api/Cards/BindAccessCode", body, nil); err != nil {
+		return nil, err
+	}
+	return map[string]any{"ok": true, "accessCode": code, "baid": baid}, nil
+}
+
+func (c *APIClient) CardUnbind(ctx context.Context, accessCode string, force bool, allowWrite bool) (map[string]any, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+	ctx = bypassCache(ctx)
+	codes, err := cleanAccessCode(accessCode)
+	if err != nil {
+		return nil, err
+	}
+	code, owner, err := c.cardOwner(ctx, codes...)
+	if err != nil {
+		return nil, err
+	}
+	if owner == 0 {
+		return nil, fmt.Errorf("access code not found: %s", code)
+	}
+	cards, err := c.cardsByBaid(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNotLastCard(owner, len(cards), force); err != nil {
+		return nil, err
+	}
+
+	if err := c.doJSON(ctx, http.MethodDelete, "/api/Cards/"+url.PathEscape(code), nil, nil); err != nil {
+		return nil, err
+	}
+	return map[string]any{"ok": true, "accessCode": code, "baid": owner}, nil
+}
+
+// CardTransfer unbinds and rebinds the code through the API. The API has no transactions, so if
+// the rebind fails the code is bound back to its previous owner.
+func (c *APIClient) CardTransfer(ctx context.Context, accessCode string, targetBaid int, force bool, allowWrite bool) (map[string]any, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+	ctx = bypassCache(ctx)
+	codes, err := cleanAccessCode(accessCode)
+	if err != nil {
+		return nil, err
+	}
+	code, owner, err := c.cardOwner(ctx, codes...)
+	if err != nil {
+		return nil, err
+	}
+	if owner == 0 {
+		return nil, fmt.Errorf("access code not found: %s", code)
+	}
+	if owner == targetBaid {
+		return nil, fmt.Errorf("access code is already bound to baid %d", targetBaid)
+	}
+	cards, err := c.cardsByBaid(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNotLastCard(owner, len(cards), force); err != nil {
+		return nil, err
+	}
+
+	if err := c.doJSON(ctx, http.MethodDelete, "/api/Cards/"+url.PathEscape(code), nil, nil); err != nil {
+		return nil, err
+	}
+	body := map[string]any{"baid": targetBaid, "accessCode": code}
+	if err := c.doJSON(ctx, http.MethodPost, "/api/Cards/BindAccessCode", body, nil); err != nil {
+		restore := map[string]any{"baid": owner, "accessCode": code}
+		if restoreErr := c.doJSON(ctx, http.MethodPost, "/api/Cards/BindAccessCode", restore, nil); restoreErr != nil {
+			return nil, fmt.Errorf("%w (restoring baid %d also failed: %v)", err, owner, restoreErr)
+		}
+		return nil, err
+	}
+	return map[string]any{"ok": true, "accessCode": code, "fromBaid": owner, "baid": targetBaid}, nil
+}
+
+func (c *APIClient) CardLookup(ctx context.Context, accessCode string) (map[string]any, error) {
+	codes, err := cleanAccessCode(accessCode)
+	if err != nil {
+		return nil, err
+	}
+	code, owner, err := c.cardOwner(ctx, codes...)
+	if err != nil {
+		return nil, err
+	}
+	if owner == 0 {
+		return map[string]any{"found": false, "accessCode": code}, nil
+	}
+
+	rows, err := c.cardsByBaid(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	cards := make([]string, 0, len(rows))
+	for _, row := range rows {
+		cards = append(cards, fmt.Sprintf("%v", row["AccessCode"]))
+	}
+	return map[string]any{"found": true, "accessCode": code, "baid": owner, "cards": cards}, nil
+}
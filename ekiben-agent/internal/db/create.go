@@ -0,0 +1,187 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// costumeParts maps the costume part names used in requests to their UserData columns.
+var costumeParts = map[string]string{
+	"kigurumi": "CurrentKigurumi",
+	"head":     "CurrentHead",
+	"body":     "CurrentBody",
+	"face":     "CurrentFace",
+	"puchi":    "CurrentPuchi",
+}
+
+// costumeDataOrder is the order of the parts packed into the legacy CostumeData column.
+var costumeDataOrder = []string{"CurrentKigurumi", "CurrentHead", "CurrentBody", "CurrentFace", "CurrentPuchi"}
+
+type NewPlayer struct {
+	AccessCode   string
+	MyDonName    *string
+	Title        *string
+	TitlePlateID *int
+	Costume      map[string]int
+	Password     string
+	Tokens       map[int]int
+}
+
+// CreatePlayer writes a UserData row with game defaults, binds the access code and optionally
+// creates the Credential and Tokens rows, all in one transaction. With ledger set the starting
+// tokens are recorded in the token ledger.
+func CreatePlayer(ctx context.Context, db *sql.DB, player NewPlayer, ledger bool, allowWrite bool) (map[string]any, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+
+	code, err := NormalizeAccessCode(player.AccessCode)
+	if err != nil {
+		return nil, err
+	}
+	values, err := newPlayerValues(player, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if player.Password != "" {
+		if err := validatePassword(player.Password); err != nil {
+			return nil, err
+		}
+	}
+	for id, count := range player.Tokens {
+		if count < 0 {
+			return nil, fmt.Errorf("token %d count must not be negative", id)
+		}
+	}
+
+	var baid int64
+	err = withTx(ctx, db, true, func(tx *sql.Tx) error {
+		_, owner, err := cardOwner(ctx, tx, code)
+		if err != nil {
+			return err
+		}
+		if err := checkUnbound(code, owner, 0); err != nil {
+			return err
+		}
+
+		cols, args, err := buildInsert("UserData", values)
+		if err != nil {
+			return err
+		}
+		placeholders := make([]string, len(cols))
+		for i := range cols {
+			placeholders[i] = "?"
+		}
+		query := fmt.Sprintf("INSERT INTO UserData (%s) VALUES (%s)", strings.Join(cols, ", "), strings.Join(placeholders, ", "))
+		res, err := tx.ExecContext(ctx, query, normalizeArgs(args)...)
+		if err != nil {
+			return err
+		}
+		baid, err = res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, "INSERT INTO Card (AccessCode, Baid) VALUES (?, ?)", code, baid); err != nil {
+			return err
+		}
+
+		if player.Password != "" {
+			salt, err := newSalt()
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, "INSERT INTO Credential (Baid, Password, Salt) VALUES (?, ?, ?)",
+				baid, hashPassword(player.Password, salt), salt); err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		for id, count := range player.Tokens {
+			if _, err := tx.ExecContext(ctx, "INSERT INTO Tokens (Baid, Id, Count) VALUES (?, ?, ?)", baid, id, count); err != nil {
+				return err
+			}
+			if ledger && count != 0 {
+				if err := recordTokenChange(ctx, tx, int(baid), id, count, count, "create", "player created", now); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]any{
+		"ok":         true,
+		"baid":       baid,
+		"accessCode": code,
+		"credential": player.Password != "",
+		"tokens":     len(player.Tokens),
+	}, nil
+}
+
+// newPlayerValues applies and validates the requested name, title and costume on top of the
+// game defaults. Equipped costume parts are added to the matching unlock list.
+func newPlayerValues(player NewPlayer, now time.Time) (map[string]any, error) {
+	values := newUserDefaults(now)
+
+	if player.MyDonName != nil {
+		if err := validateDonName(*player.MyDonName); err != nil {
+			return nil, err
+		}
+		values["MyDonName"] = *player.MyDonName
+	}
+	if player.Title != nil {
+		if err := validateTitle(*player.Title); err != nil {
+			return nil, err
+		}
+		values["Title"] = *player.Title
+	}
+	if player.TitlePlateID != nil {
+		if *player.TitlePlateID < 0 {
+			return nil, errors.New("TitlePlateId must not be negative")
+		}
+		values["TitlePlateId"] = *player.TitlePlateID
+	}
+
+	parts := make([]string, 0, len(player.Costume))
+	for part := range player.Costume {
+		parts = append(parts, part)
+	}
+	sort.Strings(parts)
+	for _, part := range parts {
+		id := player.Costume[part]
+		column, ok := costumeParts[part]
+		if !ok {
+			return nil, fmt.Errorf("unknown costume part: %s", part)
+		}
+		if id < 0 {
+			return nil, fmt.Errorf("costume %s must not be negative", part)
+		}
+		values[column] = id
+
+		unlockColumn := CostumeColumns[column]
+		unlocked, err := decodeIDList(values[unlockColumn])
+		if err != nil {
+			return nil, err
+		}
+		merged, _ := unionIDs(unlocked, []int{id})
+		values[unlockColumn] = encodeIDList(merged)
+	}
+
+	costume := make([]int, len(costumeDataOrder))
+	for i, column := range costumeDataOrder {
+		costume[i], _ = anyToIntNoError(values[column])
+	}
+	values["CostumeData"] = encodeIDList(costume)
+
+	return values, nil
+}
@@ -0,0 +1,237 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 64
+	// minPasswordRunes is how many different characters a password needs, which refuses
+	// repetitive choices such as "a1a1a1a1".
+	minPasswordRunes  = 4
+	resetCodeTTL      = 15 * time.Minute
+	resetCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+// commonPasswords are refused outright even though they pass the character class checks.
+var commonPasswords = map[string]struct{}{
+	"password1": {}, "password123": {}, "passw0rd": {}, "qwerty123": {}, "abc12345": {},
+	"12345678a": {}, "iloveyou1": {}, "letmein1": {}, "welcome1": {}, "taiko123": {},
+	"donchan1": {}, "katsu123": {},
+}
+
+// newSalt returns a salt in the format TLS writes to Credential.Salt: 32 random bytes, base64.
+func newSalt() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+// hashPassword computes Credential.Password the way the TLS web UI does: the base64 SHA-256 of
+// the password followed by the salt string.
+func hashPassword(password, salt string) string {
+	sum := sha256.Sum256([]byte(password + salt))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// validatePassword refuses short passwords, passwords made of a single character class or of
+// only a few different characters, and a small list of common choices. Lengths are counted in
+// characters, not bytes.
+func validatePassword(password string) error {
+	length := utf8.RuneCountInString(password)
+	if length < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	if length > maxPasswordLength {
+		return fmt.Errorf("password must be at most %d characters", maxPasswordLength)
+	}
+
+	var letters, digits, others bool
+	distinct := make(map[rune]struct{})
+	for _, r := range password {
+		distinct[r] = struct{}{}
+		switch {
+		case unicode.IsControl(r):
+			return errors.New("password contains a control character")
+		case unicode.IsLetter(r):
+			letters = true
+		case unicode.IsDigit(r):
+			digits = true
+		default:
+			others = true
+		}
+	}
+	classes := 0
+	for _, ok := range []bool{letters, digits, others} {
+		if ok {
+			classes++
+		}
+	}
+	if classes < 2 {
+		return errors.New("password must mix at least two of letters, digits and symbols")
+	}
+	if len(distinct) < minPasswordRunes {
+		return fmt.Errorf("password must use at least %d different characters", minPasswordRunes)
+	}
+	if _, ok := commonPasswords[strings.ToLower(password)]; ok {
+		return errors.New("password is too common")
+	}
+	return nil
+}
+
+// SetPassword validates password and stores a fresh salt and hash for baid. The hash is never
+// returned. When resetCode is set it must be the code issued for baid by IssueResetCode; it is
+// only consumed together with a successful write, and stays usable when the write fails.
+func SetPassword(ctx context.Context, db *sql.DB, baid int, password string, codes *ResetCodes, resetCode string, allowWrite bool) (map[string]any, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+	if err := validatePassword(password); err != nil {
+		return nil, err
+	}
+	if resetCode != "" && codes == nil {
+		return nil, errors.New("invalid or expired reset code")
+	}
+	salt, err := newSalt()
+	if err != nil {
+		return nil, err
+	}
+
+	var created bool
+	var restoreCode func()
+	err = withTx(ctx, db, true, func(tx *sql.Tx) error {
+		if err := requirePlayer(ctx, tx, baid); err != nil {
+			return err
+		}
+		var count int
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM Credential WHERE Baid = ?", baid).Scan(&count); err != nil {
+			return err
+		}
+		created = count == 0
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO Credential (Baid, Password, Salt) VALUES (?, ?, ?)
+			ON CONFLICT (Baid) DO UPDATE SET Password = excluded.Password, Salt = excluded.Salt`,
+			baid, hashPassword(password, salt), salt)
+		if err != nil {
+			return err
+		}
+		if resetCode != "" {
+			var ok bool
+			if restoreCode, ok = codes.Redeem(baid, resetCode); !ok {
+				return errors.New("invalid or expired reset code")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if restoreCode != nil {
+			// The commit failed after the code was redeemed.
+			restoreCode()
+		}
+		return nil, err
+	}
+	return map[string]any{"ok": true, "baid": baid, "created": created}, nil
+}
+
+// IssueResetCode hands out a one-time code the controller can show to the player, who then
+// passes it to credential.set along with the new password. The current password is left as it
+// is, so it keeps working until credential.set replaces it.
+func IssueResetCode(ctx context.Context, db *sql.DB, codes *ResetCodes, baid int, allowWrite bool) (map[string]any, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+	if err := requirePlayer(ctx, db, baid); err != nil {
+		return nil, err
+	}
+	code, expires, err := codes.Issue(baid)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"baid": baid, "resetCode": code, "expiresAt": expires.Format(time.RFC3339)}, nil
+}
+
+// ResetCodes keeps the one-time password reset codes handed out by credential.reset. Codes live
+// in memory only, expire after 15 minutes and are consumed by the first successful use.
+type ResetCodes struct {
+	mu    sync.Mutex
+	codes map[int]resetCode
+}
+
+type resetCode struct {
+	hash    [32]byte
+	expires time.Time
+}
+
+func NewResetCodes() *ResetCodes {
+	return &ResetCodes{codes: make(map[int]resetCode)}
+}
+
+// Issue creates a reset code for baid, replacing any earlier one.
+func (r *ResetCodes) Issue(baid int) (string, time.Time, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", time.Time{}, err
+	}
+	var b strings.Builder
+	for i, v := range buf {
+		if i == 4 {
+			b.WriteByte('-')
+		}
+		b.WriteByte(resetCodeAlphabet[int(v)%len(resetCodeAlphabet)])
+	}
+	code := b.String()
+	expires := time.Now().Add(resetCodeTTL)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.purge()
+	r.codes[baid] = resetCode{hash: sha256.Sum256([]byte(code)), expires: expires}
+	return code, expires, nil
+}
+
+// Redeem reports whether code is the current reset code for baid and consumes it. restore puts
+// the code back, unless a new one was issued in the meantime.
+func (r *ResetCodes) Redeem(baid int, code string) (restore func(), ok bool) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	hash := sha256.Sum256([]byte(code))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.purge()
+	entry, ok := r.codes[baid]
+	if !ok || subtle.ConstantTimeCompare(entry.hash[:], hash[:]) != 1 {
+		return nil, false
+	}
+	delete(r.codes, baid)
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if _, issued := r.codes[baid]; !issued {
+			r.codes[baid] = entry
+		}
+	}, true
+}
+
+func (r *ResetCodes) purge() {
+	now := time.Now()
+	for baid, entry := range r.codes {
+		if now.After(entry.expires) {
+			delete(r.codes, baid)
+		}
+	}
+}
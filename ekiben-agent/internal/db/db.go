@@ -76,11 +76,19 @@ func Open(dbPath string) (*sql.DB, error) {
 	if dbPath == "" {
 		return nil, errors.New("db path is required")
 	}
+	return open(dbPath)
+}
 
-	db, err := sql.Open("sqlite", dbPath)
-	if err != nil {
-		return nil, err
+// OpenReadOnly opens a second handle on the database whose connections refuse to write.
+func OpenReadOnly(dbPath string) (*sql.DB, error) {
+	if dbPath == "" {
+		return nil, errors.New("db path is required")
 	}
+	return open(dbPath + "?_pragma=query_only(1)")
+}
+
+func open(dsn string) (*sql.DB, error) {
+	db := sql.OpenDB(timedConnector{dsn: dsn})
 
 	db.SetMaxOpenConns(5)
 	db.SetMaxIdleConns(2)
@@ -141,10 +149,41 @@ func QueryNamed(ctx context.Context, db *sql.DB, name string, args []any, allowW
 }
 
 func TableSelect(ctx context.Context, db *sql.DB, table string, columns []string, filters map[string]any, orderBy []OrderBy, limit *int, offset *int) (map[string]any, error) {
-	cols, err := validateTableAndColumns(table, columns)
+	query, args, err := buildSelect(table, columns, filters, orderBy, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	started := time.Now()
+	defer func() { trafficFor(db).record(table, filters, orderBy, time.Since(started)) }()
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result, err := rowsToMaps(rows)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"rows": result}, nil
+}
+
+// ExplainTableSelect returns the query plan of the statement TableSelect would run, without
+// running it.
+func ExplainTableSelect(ctx context.Context, db *sql.DB, table string, columns []string, filters map[string]any, orderBy []OrderBy, limit *int, offset *int) (map[string]any, error) {
+	query, args, err := buildSelect(table, columns, filters, orderBy, limit, offset)
 	if err != nil {
 		return nil, err
 	}
+	return explain(ctx, db, query, args)
+}
+
+func buildSelect(table string, columns []string, filters map[string]any, orderBy []OrderBy, limit *int, offset *int) (string, []any, error) {
+	cols, err := validateTableAndColumns(table, columns)
+	if err != nil {
+		return "", nil, err
+	}
 
 	selectCols := "*"
 	if len(cols) > 0 {
@@ -153,12 +192,12 @@ func TableSelect(ctx context.Context, db *sql.DB, table string, columns []string
 
 	whereSQL, args, err := buildWhere(table, filters)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 
 	orderSQL, err := buildOrderBy(table, orderBy)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 
 	limitSQL := ""
@@ -171,18 +210,7 @@ func TableSelect(ctx context.Context, db *sql.DB, table string, columns []string
 		args = append(args, *offset)
 	}
 
-	query := fmt.Sprintf("SELECT %s FROM %s%s%s%s", selectCols, quoteIdent(table), whereSQL, orderSQL, limitSQL)
-	rows, err := db.QueryContext(ctx, query, args...)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	result, err := rowsToMaps(rows)
-	if err != nil {
-		return nil, err
-	}
-	return map[string]any{"rows": result}, nil
+	return fmt.Sprintf("SELECT %s FROM %s%s%s%s", selectCols, quoteIdent(table), whereSQL, orderSQL, limitSQL), args, nil
 }
 
 func TableInsert(ctx context.Context, db *sql.DB, table string, values map[string]any, allowWrite bool) (map[string]any, error) {
@@ -430,20 +458,30 @@ func normalizeArgs(args []any) []any {
 }
 
 func rowsToMaps(rows *sql.Rows) ([]map[string]any, error) {
+	result, _, err := rowsToMapsLimit(rows, 0)
+	return result, err
+}
+
+// rowsToMapsLimit reads at most limit rows, or all of them when limit is zero, and reports
+// whether rows were left over.
+func rowsToMapsLimit(rows *sql.Rows, limit int) ([]map[string]any, bool, error) {
 	cols, err := rows.Columns()
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	result := make([]map[string]any, 0)
 	for rows.Next() {
+		if limit > 0 && len(result) == limit {
+			return result, true, nil
+		}
 		values := make([]any, len(cols))
 		ptrs := make([]any, len(cols))
 		for i := range values {
 			ptrs[i] = &values[i]
 		}
 		if err := rows.Scan(ptrs...); err != nil {
-			return nil, err
+			return nil, false, err
 		}
 
 		row := make(map[string]any, len(cols))
@@ -452,5 +490,5 @@ func rowsToMaps(rows *sql.Rows) ([]map[string]any, error) {
 		}
 		result = append(result, row)
 	}
-	return result, rows.Err()
+	return result, false, rows.Err()
 }
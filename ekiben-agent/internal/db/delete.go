@@ -0,0 +1,167 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PlayerExport holds every row keyed by one Baid, per table.
+type PlayerExport struct {
+	Baid       int                         `json:"baid"`
+	ExportedAt string                      `json:"exportedAt"`
+	Tables     map[string][]map[string]any `json:"tables"`
+}
+
+// PlayerExportDir returns where pre-delete exports for the database at dbPath are written.
+func PlayerExportDir(dbPath string) string {
+	return filepath.Join(filepath.Dir(dbPath), "ekiben-exports")
+}
+
+// ExportPlayer reads every row of baid. Hidden columns such as password hashes are left out, as
+// the export is a plain file next to the database.
+func ExportPlayer(ctx context.Context, q querier, baid int) (*PlayerExport, error) {
+	export := &PlayerExport{
+		Baid:       baid,
+		ExportedAt: time.Now().Format(time.RFC3339),
+		Tables:     make(map[string][]map[string]any),
+	}
+	for _, table := range PlayerTables() {
+		rows, err := queryRows(ctx, q, fmt.Sprintf("SELECT * FROM %s WHERE Baid = ?", quoteIdent(table)), baid)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", table, err)
+		}
+		for _, row := range rows {
+			for _, col := range hiddenColumns[table] {
+				delete(row, col)
+			}
+		}
+		export.Tables[table] = rows
+	}
+	return export, nil
+}
+
+func (e *PlayerExport) save(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	content, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	content = append(content, '\n')
+
+	path := filepath.Join(dir, fmt.Sprintf("player-%d-%s.json", e.Baid, time.Now().Format("20060102-150405")))
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// DeletePlayer removes baid from every player table in one transaction. With anonymize set the
+// scores are kept for leaderboards, but the name and title are cleared and the cards and
+// credentials are removed. Either way the player's rows are exported to exportDir first, and the
+// transaction is abandoned if the export cannot be written. The export is removed again when the
+// transaction does not commit.
+func DeletePlayer(ctx context.Context, db *sql.DB, baid int, anonymize bool, exportDir string, allowWrite bool) (map[string]any, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+	if exportDir == "" {
+		return nil, errors.New("export directory is required")
+	}
+
+	var exportPath string
+	var affected map[string]int64
+	err := withTx(ctx, db, true, func(tx *sql.Tx) error {
+		if err := requirePlayer(ctx, tx, baid); err != nil {
+			return err
+		}
+
+		export, err := ExportPlayer(ctx, tx, baid)
+		if err != nil {
+			return err
+		}
+		exportPath, err = export.save(exportDir)
+		if err != nil {
+			return fmt.Errorf("pre-delete export: %w", err)
+		}
+
+		if anonymize {
+			affected, err = anonymizePlayer(ctx, tx, baid)
+		} else {
+			affected, err = deletePlayerRows(ctx, tx, baid)
+		}
+		return err
+	})
+	if err != nil {
+		if exportPath != "" {
+			os.Remove(exportPath)
+		}
+		return nil, err
+	}
+
+	key := "deleted"
+	if anonymize {
+		key = "anonymized"
+	}
+	return map[string]any{"ok": true, "baid": baid, key: affected, "export": exportPath}, nil
+}
+
+func anonymizePlayer(ctx context.Context, q querier, baid int) (map[string]int64, error) {
+	affected := make(map[string]int64)
+	for _, table := range []string{"Card", "Credential"} {
+		res, err := q.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE Baid = ?", quoteIdent(table)), baid)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", table, err)
+		}
+		affected[table], _ = res.RowsAffected()
+	}
+
+	res, err := q.ExecContext(ctx, "UPDATE UserData SET MyDonName = '', Title = '' WHERE Baid = ?", baid)
+	if err != nil {
+		return nil, fmt.Errorf("UserData: %w", err)
+	}
+	affected["UserData"], _ = res.RowsAffected()
+	return affected, nil
+}
+
+// DeletePlayer deletes baid through the TLS API, so TLS drops the player from its own state too.
+// The export is read from q, the database file, and written to exportDir first; it is removed
+// again when the API refuses the delete. The API cannot anonymize a player.
+func (c *APIClient) DeletePlayer(ctx context.Context, q querier, baid int, exportDir string, allowWrite bool) (map[string]any, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+	if exportDir == "" {
+		return nil, errors.New("export directory is required")
+	}
+	if err := requirePlayer(ctx, q, baid); err != nil {
+		return nil, err
+	}
+
+	export, err := ExportPlayer(ctx, q, baid)
+	if err != nil {
+		return nil, err
+	}
+	exportPath, err := export.save(exportDir)
+	if err != nil {
+		return nil, fmt.Errorf("pre-delete export: %w", err)
+	}
+	if err := c.doJSON(ctx, http.MethodDelete, fmt.Sprintf("/api/Users/%d", baid), nil, nil); err != nil {
+		os.Remove(exportPath)
+		return nil, err
+	}
+
+	deleted := make(map[string]int64, len(export.Tables))
+	for table, rows := range export.Tables {
+		deleted[table] = int64(len(rows))
+	}
+	return map[string]any{"ok": true, "baid": baid, "deleted": deleted, "export": exportPath}, nil
+}
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Export formats.
+const (
+	ExportCSV    = "csv"
+	ExportNDJSON = "ndjson"
+)
+
+// ExportRequest is a table.select whose rows are written out instead of returned.
+type ExportRequest struct {
+	Table   string
+	Columns []string
+	Filters map[string]any
+	OrderBy []OrderBy
+	Limit   *int
+	Offset  *int
+	Format  string
+}
+
+type ExportStats struct {
+	Table   string   `json:"table"`
+	Format  string   `json:"format"`
+	Columns []string `json:"columns"`
+	Rows    int      `json:"rows"`
+	Bytes   int64    `json:"bytes"`
+}
+
+// ExportTable streams the rows selected by req to w as CSV with a header line, or as one JSON
+// object per line. Rows are written as they are read, so memory use does not grow with the
+// table. Columns outside TableSchemas and hidden columns are left out; asking for one by name
+// is an error.
+func ExportTable(ctx context.Context, db *sql.DB, req ExportRequest, w io.Writer) (*ExportStats, error) {
+	format := strings.ToLower(req.Format)
+	if format == "" {
+		format = ExportCSV
+	}
+	if format != ExportCSV && format != ExportNDJSON {
+		return nil, fmt.Errorf("unknown export format: %s", req.Format)
+	}
+	for _, col := range req.Columns {
+		if err := checkColumn(req.Table, col); err != nil {
+			return nil, err
+		}
+	}
+	query, args, err := buildSelect(req.Table, req.Columns, req.Filters, req.OrderBy, req.Limit, req.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	// With no columns requested the statement selects *, which may include columns that are not
+	// visible.
+	var keep []int
+	visible := make([]string, 0, len(cols))
+	for i, col := range cols {
+		if checkColumn(req.Table, col) == nil {
+			keep = append(keep, i)
+			visible = append(visible, col)
+		}
+	}
+
+	counter := &countingWriter{w: w}
+	buffered := bufio.NewWriterSize(counter, 64<<10)
+	stats := &ExportStats{Table: req.Table, Format: format, Columns: visible}
+	var csvWriter *csv.Writer
+	var encoder *json.Encoder
+	if format == ExportCSV {
+		csvWriter = csv.NewWriter(buffered)
+		if err := csvWriter.Write(visible); err != nil {
+			return nil, err
+		}
+	} else {
+		encoder = json.NewEncoder(buffered)
+	}
+
+	values := make([]any, len(cols))
+	ptrs := make([]any, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	record := make([]string, len(keep))
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		if csvWriter != nil {
+			for i, idx := range keep {
+				record[i] = csvValue(values[idx])
+			}
+			err = csvWriter.Write(record)
+		} else {
+			row := make(map[string]any, len(keep))
+			for i, idx := range keep {
+				row[visible[i]] = values[idx]
+			}
+			err = encoder.Encode(row)
+		}
+		if err != nil {
+			return nil, err
+		}
+		stats.Rows++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if csvWriter != nil {
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return nil, err
+		}
+	}
+	if err := buffered.Flush(); err != nil {
+		return nil, err
+	}
+	stats.Bytes = counter.n
+	return stats, nil
+}
+
+// csvValue formats a value the way spreadsheets read it back: NULL as an empty cell and floats
+// without exponents.
+func csvValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
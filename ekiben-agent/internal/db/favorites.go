@@ -0,0 +1,186 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// maxFavoriteSongs is the size of the favorites list the game keeps per player.
+const maxFavoriteSongs = 500
+
+func readFavorites(ctx context.Context, q querier, baid int) ([]int, error) {
+	var raw sql.NullString
+	err := q.QueryRowContext(ctx, "SELECT FavoriteSongsArray FROM UserData WHERE Baid = ?", baid).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("player not found: %d", baid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !raw.Valid {
+		return []int{}, nil
+	}
+	ids, err := decodeIDList(raw.String)
+	if err != nil {
+		return nil, fmt.Errorf("FavoriteSongsArray: %w", err)
+	}
+	return ids, nil
+}
+
+func checkFavoriteIDs(songIDs []int) error {
+	for _, id := range songIDs {
+		if id < 0 {
+			return errors.New("song id must not be negative")
+		}
+	}
+	return nil
+}
+
+func ListFavorites(ctx context.Context, db *sql.DB, baid int) (map[string]any, error) {
+	favorites, err := readFavorites(ctx, db, baid)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"baid": baid, "favorites": favorites}, nil
+}
+
+// AddFavorites appends songIDs that are not favorites yet, in the given order.
+func AddFavorites(ctx context.Context, db *sql.DB, baid int, songIDs []int, allowWrite bool) (map[string]any, error) {
+	return changeFavorites(ctx, db, baid, songIDs, allowWrite, func(current []int) ([]int, map[string]any, error) {
+		merged, added := unionIDs(current, songIDs)
+		if len(merged) > maxFavoriteSongs {
+			return nil, nil, fmt.Errorf("at most %d favorite songs allowed, would have %d", maxFavoriteSongs, len(merged))
+		}
+		return merged, map[string]any{"added": added}, nil
+	})
+}
+
+// RemoveFavorites drops songIDs from the favorites; ids that are not favorites are ignored.
+func RemoveFavorites(ctx context.Context, db *sql.DB, baid int, songIDs []int, allowWrite bool) (map[string]any, error) {
+	return changeFavorites(ctx, db, baid, songIDs, allowWrite, func(current []int) ([]int, map[string]any, error) {
+		kept, removed := removeIDs(current, songIDs)
+		return kept, map[string]any{"removed": removed}, nil
+	})
+}
+
+// ReorderFavorites replaces the favorites with songIDs, which must hold exactly the current
+// favorites in their new order.
+func ReorderFavorites(ctx context.Context, db *sql.DB, baid int, songIDs []int, allowWrite bool) (map[string]any, error) {
+	return changeFavorites(ctx, db, baid, songIDs, allowWrite, func(current []int) ([]int, map[string]any, error) {
+		ordered, _ := unionIDs(nil, songIDs)
+		if len(ordered) != len(songIDs) {
+			return nil, nil, errors.New("songIds must not contain duplicates")
+		}
+		_, missing := unionIDs(ordered, current)
+		_, extra := unionIDs(current, ordered)
+		if len(missing) > 0 || len(extra) > 0 {
+			return nil, nil, fmt.Errorf("songIds must list the current favorites exactly (missing %v, not favorites %v)", missing, extra)
+		}
+		return ordered, map[string]any{}, nil
+	})
+}
+
+// changeFavorites reads the favorites of baid, applies fn and writes the result back in one
+// transaction. The response carries the decoded list after the change.
+func changeFavorites(ctx context.Context, db *sql.DB, baid int, songIDs []int, allowWrite bool, fn func(current []int) ([]int, map[string]any, error)) (map[string]any, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+	if err := checkFavoriteIDs(songIDs); err != nil {
+		return nil, err
+	}
+
+	var result map[string]any
+	err := withTx(ctx, db, true, func(tx *sql.Tx) error {
+		current, err := readFavorites(ctx, tx, baid)
+		if err != nil {
+			return err
+		}
+		updated, extra, err := fn(current)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE UserData SET FavoriteSongsArray = ? WHERE Baid = ?", encodeIDList(updated), baid); err != nil {
+			return err
+		}
+		result = extra
+		result["baid"] = baid
+		result["favorites"] = updated
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *APIClient) favorites(ctx context.Context, baid int) ([]int, error) {
+	var payload struct {
+		FavoriteSongs []int `json:"favoriteSongs"`
+	}
+	if err := c.doJSON(ctx, http.MethodGet, fmt.Sprintf("/api/FavoriteSongs/%d", baid), nil, &payload); err != nil {
+		return nil, err
+	}
+	if payload.FavoriteSongs == nil {
+		return []int{}, nil
+	}
+	return payload.FavoriteSongs, nil
+}
+
+// setFavorite marks or unmarks one song; the TLS endpoint only takes one song per request.
+func (c *APIClient) setFavorite(ctx context.Context, baid, songID int, favorite bool) error {
+	body := map[string]any{"baid": baid, "songId": songID, "isFavorite": favorite}
+	return c.doJSON(ctx, http.MethodPost, "/api/FavoriteSongs", body, nil)
+}
+
+// AddFavorites adds songIDs through the API, one request per song. The API has no transactions,
+// so when a request fails the songs added before it stay favorites.
+func (c *APIClient) AddFavorites(ctx context.Context, baid int, songIDs []int, allowWrite bool) (map[string]any, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+	ctx = bypassCache(ctx)
+	if err := checkFavoriteIDs(songIDs); err != nil {
+		return nil, err
+	}
+	current, err := c.favorites(ctx, baid)
+	if err != nil {
+		return nil, err
+	}
+	merged, added := unionIDs(current, songIDs)
+	if len(merged) > maxFavoriteSongs {
+		return nil, fmt.Errorf("at most %d favorite songs allowed, would have %d", maxFavoriteSongs, len(merged))
+	}
+	for i, id := range added {
+		if err := c.setFavorite(ctx, baid, id, true); err != nil {
+			return nil, fmt.Errorf("song %d: %w (songs %v were added)", id, err, added[:i])
+		}
+	}
+	return map[string]any{"baid": baid, "favorites": merged, "added": added}, nil
+}
+
+// RemoveFavorites removes songIDs through the API, one request per song, with the same partial
+// failure as AddFavorites.
+func (c *APIClient) RemoveFavorites(ctx context.Context, baid int, songIDs []int, allowWrite bool) (map[string]any, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+	ctx = bypassCache(ctx)
+	if err := checkFavoriteIDs(songIDs); err != nil {
+		return nil, err
+	}
+	current, err := c.favorites(ctx, baid)
+	if err != nil {
+		return nil, err
+	}
+	kept, removed := removeIDs(current, songIDs)
+	for i, id := range removed {
+		if err := c.setFavorite(ctx, baid, id, false); err != nil {
+			return nil, fmt.Errorf("song %d: %w (songs %v were removed)", id, err, removed[:i])
+		}
+	}
+	return map[string]any{"baid": baid, "favorites": kept, "removed": removed}, nil
+}
@@ -0,0 +1,572 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Import modes. Skip leaves rows that collide with an existing row untouched, upsert overwrites the
+// imported columns of the existing row.
+const (
+	ImportInsert = "insert"
+	ImportUpsert = "upsert"
+	ImportSkip   = "skip"
+)
+
+// maxImportErrors is the number of row errors listed in an ImportReport; ErrorCount has them all.
+const maxImportErrors = 100
+
+// errImportRejected rolls back the import transaction when a row failed.
+var errImportRejected = errors.New("import rejected")
+
+type ImportRequest struct {
+	Table  string
+	Format string
+	Mode   string
+	// Columns maps source column names to table columns. Source columns that are not in the map
+	// keep their name; mapping one to "" drops it.
+	Columns map[string]string
+	DryRun  bool
+}
+
+// ImportError is a row that could not be imported. Line is the line of the input the row starts on.
+type ImportError struct {
+	Line    int    `json:"line"`
+	Column  string `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+type ImportReport struct {
+	Table      string        `json:"table"`
+	Format     string        `json:"format"`
+	Mode       string        `json:"mode"`
+	DryRun     bool          `json:"dryRun"`
+	Columns    []string      `json:"columns"`
+	Rows       int           `json:"rows"`
+	Inserted   int           `json:"inserted"`
+	Updated    int           `json:"updated"`
+	Skipped    int           `json:"skipped"`
+	ErrorCount int           `json:"errorCount"`
+	Errors     []ImportError `json:"errors"`
+	Committed  bool          `json:"committed"`
+}
+
+func (r *ImportReport) addError(line int, column string, err error) {
+	r.ErrorCount++
+	if len(r.Errors) < maxImportErrors {
+		r.Errors = append(r.Errors, ImportError{Line: line, Column: column, Message: err.Error()})
+	}
+}
+
+// importColumn is a table column as declared in the database.
+type importColumn struct {
+	name       string
+	affinity   string
+	notNull    bool
+	hasDefault bool
+	pk         int
+}
+
+// ImportTable reads CSV with a header line, or one JSON object per line, from r into a table from
+// TableSchemas. Every value is converted to the declared type of its column. Rows are written in
+// one transaction as they are checked, and the transaction only commits when every row went in,
+// so a dry run reports the same errors as a real import, constraint violations included. A dry run
+// therefore writes too before rolling back: it needs allowWrite, and holds the database write lock,
+// which keeps TLS from saving plays, until the whole input is read.
+func ImportTable(ctx context.Context, db *sql.DB, req ImportRequest, r io.Reader, allowWrite bool) (*ImportReport, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+	if _, ok := TableSchemas[req.Table]; !ok {
+		return nil, fmt.Errorf("unknown table: %s", req.Table)
+	}
+	format := strings.ToLower(req.Format)
+	if format == "" {
+		format = ExportCSV
+	}
+	if format != ExportCSV && format != ExportNDJSON {
+		return nil, fmt.Errorf("unknown import format: %s", req.Format)
+	}
+	mode := strings.ToLower(req.Mode)
+	if mode == "" {
+		mode = ImportInsert
+	}
+	if mode != ImportInsert && mode != ImportUpsert && mode != ImportSkip {
+		return nil, fmt.Errorf("unknown import mode: %s", req.Mode)
+	}
+
+	report := &ImportReport{Table: req.Table, Format: format, Mode: mode, DryRun: req.DryRun, Columns: []string{}, Errors: []ImportError{}}
+	err := withTx(ctx, db, !req.DryRun, func(tx *sql.Tx) error {
+		columns, err := importColumns(ctx, tx, req.Table)
+		if err != nil {
+			return err
+		}
+		im := &importer{tx: tx, table: req.Table, mode: mode, columns: columns, mapping: req.Columns, report: report, stmts: make(map[string]*sql.Stmt)}
+		defer im.close()
+		if mode == ImportUpsert && len(im.primaryKey()) == 0 {
+			return fmt.Errorf("%s has no primary key to upsert on", req.Table)
+		}
+
+		if format == ExportCSV {
+			err = im.readCSV(ctx, r)
+		} else {
+			err = im.readNDJSON(ctx, r)
+		}
+		if err != nil {
+			return err
+		}
+		report.Columns = sortedKeys(im.seen)
+		if report.ErrorCount > 0 {
+			return errImportRejected
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errImportRejected) {
+		return nil, err
+	}
+	report.Committed = err == nil && !req.DryRun
+	return report, nil
+}
+
+// importColumns returns the columns of table that TableSchemas allows, keyed by name.
+func importColumns(ctx context.Context, q querier, table string) (map[string]importColumn, error) {
+	rows, err := queryRows(ctx, q, fmt.Sprintf("PRAGMA table_info(%s)", quoteIdent(table)))
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]importColumn, len(rows))
+	for _, row := range rows {
+		name := fmt.Sprintf("%v", row["name"])
+		if !containsString(TableSchemas[table], name) {
+			continue
+		}
+		columns[name] = importColumn{
+			name:       name,
+			affinity:   columnAffinity(fmt.Sprintf("%v", row["type"])),
+			notNull:    rowInt(row, "notnull") != 0,
+			hasDefault: row["dflt_value"] != nil,
+			pk:         rowInt(row, "pk"),
+		}
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("table not found: %s", table)
+	}
+	return columns, nil
+}
+
+// columnAffinity applies SQLite's rules for turning a declared type into a type affinity.
+func columnAffinity(declared string) string {
+	declared = strings.ToUpper(declared)
+	switch {
+	case strings.Contains(declared, "INT"):
+		return "INTEGER"
+	case strings.Contains(declared, "CHAR"), strings.Contains(declared, "CLOB"), strings.Contains(declared, "TEXT"):
+		return "TEXT"
+	case declared == "", strings.Contains(declared, "BLOB"):
+		return "BLOB"
+	case strings.Contains(declared, "REAL"), strings.Contains(declared, "FLOA"), strings.Contains(declared, "DOUB"):
+		return "REAL"
+	default:
+		return "NUMERIC"
+	}
+}
+
+type importer struct {
+	tx      *sql.Tx
+	table   string
+	mode    string
+	columns map[string]importColumn
+	mapping map[string]string
+	report  *ImportReport
+	stmts   map[string]*sql.Stmt
+	seen    map[string]any
+}
+
+func (im *importer) close() {
+	for _, stmt := range im.stmts {
+		stmt.Close()
+	}
+}
+
+// target returns the table column a source column goes to, or "" when it is dropped.
+func (im *importer) target(source string) string {
+	if target, ok := im.mapping[source]; ok {
+		return target
+	}
+	return source
+}
+
+func (im *importer) primaryKey() []string {
+	var pk []importColumn
+	for _, col := range im.columns {
+		if col.pk > 0 {
+			pk = append(pk, col)
+		}
+	}
+	sort.Slice(pk, func(i, j int) bool { return pk[i].pk < pk[j].pk })
+	names := make([]string, len(pk))
+	for i, col := range pk {
+		names[i] = col.name
+	}
+	return names
+}
+
+// rowidAlias reports whether col is an INTEGER PRIMARY KEY, which SQLite fills in when it is left out.
+func (im *importer) rowidAlias(col importColumn) bool {
+	return col.pk > 0 && col.affinity == "INTEGER" && len(im.primaryKey()) == 1
+}
+
+// checkColumns reports table columns that are missing from a row and cannot be left out.
+func (im *importer) checkColumns(present map[string]any) error {
+	var missing []string
+	for name, col := range im.columns {
+		if _, ok := present[name]; ok {
+			continue
+		}
+		if col.notNull && !col.hasDefault && !im.rowidAlias(col) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("missing columns: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (im *importer) readCSV(ctx context.Context, r io.Reader) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Problems with the header would fail every row, so they fail the import instead.
+	targets := make([]string, len(header))
+	present := make(map[string]any, len(header))
+	for i, source := range header {
+		target := im.target(strings.TrimSpace(source))
+		if target == "" {
+			continue
+		}
+		if _, ok := im.columns[target]; !ok {
+			return fmt.Errorf("unknown column: %s", target)
+		}
+		if _, ok := present[target]; ok {
+			return fmt.Errorf("duplicate column: %s", target)
+		}
+		targets[i] = target
+		present[target] = nil
+	}
+	if err := im.checkColumns(present); err != nil {
+		return err
+	}
+	im.seen = present
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			im.report.Rows++
+			im.report.addError(parseErr.StartLine, "", parseErr.Err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		line, _ := reader.FieldPos(0)
+		im.report.Rows++
+		if len(record) != len(header) {
+			im.report.addError(line, "", fmt.Errorf("expected %d fields, got %d", len(header), len(record)))
+			continue
+		}
+		values := make(map[string]any, len(present))
+		failed := false
+		for i, raw := range record {
+			if targets[i] == "" {
+				continue
+			}
+			col := im.columns[targets[i]]
+			value, err := coerceImportValue(col, csvImportValue(col, raw))
+			if err != nil {
+				im.report.addError(line, col.name, err)
+				failed = true
+				continue
+			}
+			values[col.name] = value
+		}
+		if !failed {
+			im.write(ctx, line, values)
+		}
+	}
+}
+
+// csvImportValue reads an empty cell as NULL, which is how ExportTable writes NULL, except in text
+// columns where it is the empty string.
+func csvImportValue(col importColumn, raw string) any {
+	if raw == "" && col.affinity != "TEXT" {
+		return nil
+	}
+	return raw
+}
+
+func (im *importer) readNDJSON(ctx context.Context, r io.Reader) error {
+	reader := bufio.NewReader(r)
+	im.seen = make(map[string]any)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if text := bytes.TrimSpace(data); len(text) > 0 {
+			im.report.Rows++
+			decoder := json.NewDecoder(bytes.NewReader(text))
+			decoder.UseNumber()
+			var object map[string]any
+			if decodeErr := decoder.Decode(&object); decodeErr != nil {
+				im.report.addError(line, "", decodeErr)
+			} else if decoder.More() {
+				im.report.addError(line, "", errors.New("expected one JSON object per line"))
+			} else {
+				im.importObject(ctx, line, object)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+func (im *importer) importObject(ctx context.Context, line int, object map[string]any) {
+	values := make(map[string]any, len(object))
+	failed := false
+	for _, source := range sortedKeys(object) {
+		target := im.target(source)
+		if target == "" {
+			continue
+		}
+		col, ok := im.columns[target]
+		if !ok {
+			im.report.addError(line, target, errors.New("unknown column"))
+			failed = true
+			continue
+		}
+		if _, ok := values[target]; ok {
+			im.report.addError(line, target, errors.New("duplicate column"))
+			failed = true
+			continue
+		}
+		value, err := coerceImportValue(col, object[source])
+		if err != nil {
+			im.report.addError(line, target, err)
+			failed = true
+			continue
+		}
+		values[target] = value
+		im.seen[target] = nil
+	}
+	if failed {
+		return
+	}
+	if err := im.checkColumns(values); err != nil {
+		im.report.addError(line, "", err)
+		return
+	}
+	im.write(ctx, line, values)
+}
+
+// coerceImportValue converts a CSV string or a decoded JSON value to the type col is declared
+// with. Arrays and objects are stored as JSON text, the way TLS stores its list columns.
+func coerceImportValue(col importColumn, value any) (any, error) {
+	if value == nil {
+		if col.notNull {
+			return nil, errors.New("value is required")
+		}
+		return nil, nil
+	}
+	switch v := value.(type) {
+	case []any, map[string]any:
+		if col.affinity != "TEXT" && col.affinity != "BLOB" {
+			return nil, fmt.Errorf("expected %s, got %T", strings.ToLower(col.affinity), v)
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return string(data), nil
+	case bool:
+		if col.affinity == "TEXT" {
+			return strconv.FormatBool(v), nil
+		}
+		if col.affinity == "REAL" {
+			return nil, fmt.Errorf("expected a number, got %v", v)
+		}
+		if v {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case json.Number:
+		if col.affinity == "TEXT" {
+			return v.String(), nil
+		}
+		return coerceImportNumber(col, v.String())
+	case string:
+		if col.affinity == "TEXT" || col.affinity == "BLOB" {
+			return v, nil
+		}
+		return coerceImportNumber(col, strings.TrimSpace(v))
+	default:
+		return nil, fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+func coerceImportNumber(col importColumn, raw string) (any, error) {
+	switch col.affinity {
+	case "INTEGER":
+		switch strings.ToLower(raw) {
+		case "true":
+			return int64(1), nil
+		case "false":
+			return int64(0), nil
+		}
+		if n, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			return n, nil
+		}
+		if f, err := strconv.ParseFloat(raw, 64); err == nil && f == float64(int64(f)) {
+			return int64(f), nil
+		}
+		return nil, fmt.Errorf("expected an integer, got %q", raw)
+	case "REAL":
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("expected a number, got %q", raw)
+		}
+		return f, nil
+	default:
+		if n, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			return n, nil
+		}
+		if f, err := strconv.ParseFloat(raw, 64); err == nil {
+			return f, nil
+		}
+		return raw, nil
+	}
+}
+
+// write inserts one checked row. Statements are prepared once per set of columns, since NDJSON
+// rows do not all have to carry the same columns.
+func (im *importer) write(ctx context.Context, line int, values map[string]any) {
+	names := sortedKeys(values)
+	if len(names) == 0 {
+		im.report.addError(line, "", errors.New("row has no columns"))
+		return
+	}
+	args := make([]any, len(names))
+	for i, name := range names {
+		args[i] = values[name]
+	}
+
+	existed := false
+	pk := im.primaryKey()
+	if im.mode == ImportUpsert && hasColumns(values, pk) {
+		where := make([]string, len(pk))
+		pkArgs := make([]any, len(pk))
+		for i, name := range pk {
+			where[i] = fmt.Sprintf("%s = ?", quoteIdent(name))
+			pkArgs[i] = values[name]
+		}
+		var one int
+		err := im.tx.QueryRowContext(ctx, fmt.Sprintf("SELECT 1 FROM %s WHERE %s", quoteIdent(im.table), strings.Join(where, " AND ")), pkArgs...).Scan(&one)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			im.report.addError(line, "", err)
+			return
+		}
+		existed = err == nil
+	}
+
+	stmt, err := im.statement(ctx, names)
+	if err != nil {
+		im.report.addError(line, "", err)
+		return
+	}
+	res, err := stmt.ExecContext(ctx, args...)
+	if err != nil {
+		im.report.addError(line, "", err)
+		return
+	}
+	affected, _ := res.RowsAffected()
+	switch {
+	case affected == 0:
+		im.report.Skipped++
+	case existed:
+		im.report.Updated++
+	default:
+		im.report.Inserted++
+	}
+}
+
+func (im *importer) statement(ctx context.Context, names []string) (*sql.Stmt, error) {
+	key := strings.Join(names, ",")
+	if stmt, ok := im.stmts[key]; ok {
+		return stmt, nil
+	}
+	quoted := make([]string, len(names))
+	placeholders := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = quoteIdent(name)
+		placeholders[i] = "?"
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", quoteIdent(im.table), strings.Join(quoted, ", "), strings.Join(placeholders, ", "))
+	switch im.mode {
+	case ImportSkip:
+		query += " ON CONFLICT DO NOTHING"
+	case ImportUpsert:
+		pk := im.primaryKey()
+		var set []string
+		for _, name := range names {
+			if !containsString(pk, name) {
+				set = append(set, fmt.Sprintf("%s = excluded.%s", quoteIdent(name), quoteIdent(name)))
+			}
+		}
+		quotedPK := make([]string, len(pk))
+		for i, name := range pk {
+			quotedPK[i] = quoteIdent(name)
+		}
+		if len(set) == 0 {
+			query += fmt.Sprintf(" ON CONFLICT (%s) DO NOTHING", strings.Join(quotedPK, ", "))
+		} else {
+			query += fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(quotedPK, ", "), strings.Join(set, ", "))
+		}
+	}
+	stmt, err := im.tx.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	im.stmts[key] = stmt
+	return stmt, nil
+}
+
+func hasColumns(values map[string]any, names []string) bool {
+	for _, name := range names {
+		if _, ok := values[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
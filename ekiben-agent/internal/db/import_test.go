@@ -0,0 +1,87 @@
+package db
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCoerceImportValue(t *testing.T) {
+	integer := importColumn{name: "Count", affinity: "INTEGER", notNull: true}
+	nullable := importColumn{name: "Count", affinity: "INTEGER"}
+	rate := importColumn{name: "Rate", affinity: "REAL"}
+	text := importColumn{name: "Name", affinity: "TEXT"}
+	numeric := importColumn{name: "Value", affinity: "NUMERIC"}
+
+	tests := []struct {
+		name    string
+		col     importColumn
+		value   any
+		want    any
+		wantErr string
+	}{
+		{"null in not null column", integer, nil, nil, "value is required"},
+		{"null in nullable column", nullable, nil, nil, ""},
+		{"integer string", integer, "42", int64(42), ""},
+		{"integer string with spaces", integer, " 42 ", int64(42), ""},
+		{"whole float string as integer", integer, "3.0", int64(3), ""},
+		{"fractional string as integer", integer, "3.5", nil, "expected an integer"},
+		{"true string as integer", integer, "TRUE", int64(1), ""},
+		{"json number as integer", integer, json.Number("7"), int64(7), ""},
+		{"bool as integer", integer, true, int64(1), ""},
+		{"word as integer", integer, "many", nil, "expected an integer"},
+		{"real string", rate, "97.5", 97.5, ""},
+		{"bool as real", rate, false, nil, "expected a number"},
+		{"word as real", rate, "high", nil, "expected a number"},
+		{"text keeps the string", text, " 0042 ", " 0042 ", ""},
+		{"json number as text", text, json.Number("0.10"), "0.10", ""},
+		{"bool as text", text, true, "true", ""},
+		{"array as text", text, []any{json.Number("1"), json.Number("2")}, "[1,2]", ""},
+		{"object as text", text, map[string]any{"a": "b"}, `{"a":"b"}`, ""},
+		{"array as integer", integer, []any{}, nil, "expected integer"},
+		{"numeric integer", numeric, "5", int64(5), ""},
+		{"numeric float", numeric, "5.5", 5.5, ""},
+		{"numeric text", numeric, "abc", "abc", ""},
+		{"unsupported type", integer, struct{}{}, nil, "unsupported value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := coerceImportValue(tt.col, tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCSVImportValue(t *testing.T) {
+	tests := []struct {
+		name string
+		col  importColumn
+		raw  string
+		want any
+	}{
+		{"empty integer is null", importColumn{affinity: "INTEGER"}, "", nil},
+		{"empty real is null", importColumn{affinity: "REAL"}, "", nil},
+		{"empty text is the empty string", importColumn{affinity: "TEXT"}, "", ""},
+		{"integer cell", importColumn{affinity: "INTEGER"}, "12", "12"},
+		{"text cell", importColumn{affinity: "TEXT"}, "Don", "Don"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := csvImportValue(tt.col, tt.raw); got != tt.want {
+				t.Fatalf("csvImportValue(%q) = %#v, want %#v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
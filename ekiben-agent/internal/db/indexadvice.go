@@ -0,0 +1,254 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// selectTrafficSize is the number of recent table.select calls index advice is based on.
+const selectTrafficSize = 1000
+
+// selectTraffic remembers the shape of recent TableSelect calls, one log per database handle so
+// that sources sharing the process do not mix their traffic. Only column names are kept, never
+// filter values.
+var selectTraffic = struct {
+	mu   sync.Mutex
+	logs map[*sql.DB]*trafficLog
+}{logs: make(map[*sql.DB]*trafficLog)}
+
+// trafficFor returns the traffic log of db, creating it on first use.
+func trafficFor(db *sql.DB) *trafficLog {
+	selectTraffic.mu.Lock()
+	defer selectTraffic.mu.Unlock()
+	log, ok := selectTraffic.logs[db]
+	if !ok {
+		log = &trafficLog{}
+		selectTraffic.logs[db] = log
+	}
+	return log
+}
+
+type trafficLog struct {
+	mu      sync.Mutex
+	entries []trafficEntry
+	next    int
+}
+
+type trafficEntry struct {
+	table    string
+	filters  []string
+	orderBy  []string
+	duration time.Duration
+}
+
+func (t *trafficLog) record(table string, filters map[string]any, orderBy []OrderBy, duration time.Duration) {
+	entry := trafficEntry{table: table, filters: sortedKeys(filters), duration: duration}
+	for _, item := range orderBy {
+		entry.orderBy = append(entry.orderBy, item.Column)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.entries) < selectTrafficSize {
+		t.entries = append(t.entries, entry)
+		return
+	}
+	t.entries[t.next] = entry
+	t.next = (t.next + 1) % selectTrafficSize
+}
+
+func (t *trafficLog) snapshot() []trafficEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]trafficEntry(nil), t.entries...)
+}
+
+// IndexAdvice is one filter pattern seen in recent table.select traffic. Index names the existing
+// index SQLite can use for it; when there is none, Suggestion holds a CREATE INDEX statement. The
+// statement is only advice and is never run by the agent.
+type IndexAdvice struct {
+	Table      string   `json:"table"`
+	Columns    []string `json:"columns"`
+	OrderBy    []string `json:"orderBy,omitempty"`
+	Calls      int      `json:"calls"`
+	AvgMs      float64  `json:"avgMs"`
+	MaxMs      float64  `json:"maxMs"`
+	Index      string   `json:"index,omitempty"`
+	Suggestion string   `json:"suggestion,omitempty"`
+}
+
+// AdviseIndexes groups the recent table.select calls made on db by table and filter columns and
+// checks each group against the indexes of the database. Groups are ordered by the total time
+// spent in them.
+func AdviseIndexes(ctx context.Context, db *sql.DB) (map[string]any, error) {
+	traffic := trafficFor(db).snapshot()
+	groups := make(map[string]*IndexAdvice)
+	totals := make(map[string]time.Duration)
+	for _, entry := range traffic {
+		if len(entry.filters) == 0 {
+			continue
+		}
+		key := entry.table + "\x00" + strings.Join(entry.filters, ",") + "\x00" + strings.Join(entry.orderBy, ",")
+		advice, ok := groups[key]
+		if !ok {
+			advice = &IndexAdvice{Table: entry.table, Columns: entry.filters, OrderBy: entry.orderBy}
+			groups[key] = advice
+		}
+		advice.Calls++
+		totals[key] += entry.duration
+		if ms := float64(entry.duration) / float64(time.Millisecond); ms > advice.MaxMs {
+			advice.MaxMs = ms
+		}
+	}
+
+	indexes := make(map[string][]tableIndex)
+	result := make([]IndexAdvice, 0, len(groups))
+	for key, advice := range groups {
+		advice.AvgMs = float64(totals[key]) / float64(time.Millisecond) / float64(advice.Calls)
+		tableIndexes, ok := indexes[advice.Table]
+		if !ok {
+			var err error
+			tableIndexes, err = listIndexes(ctx, db, advice.Table)
+			if err != nil {
+				return nil, err
+			}
+			indexes[advice.Table] = tableIndexes
+		}
+		if index, ok := usableIndex(tableIndexes, advice.Columns); ok {
+			advice.Index = index
+		} else {
+			advice.Suggestion = suggestIndex(advice.Table, advice.Columns, advice.OrderBy)
+		}
+		result = append(result, *advice)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		ti, tj := result[i].AvgMs*float64(result[i].Calls), result[j].AvgMs*float64(result[j].Calls)
+		if ti != tj {
+			return ti > tj
+		}
+		return result[i].Table < result[j].Table
+	})
+	return map[string]any{"sampled": len(traffic), "advice": result}, nil
+}
+
+type tableIndex struct {
+	name    string
+	columns []string
+}
+
+// listIndexes returns the indexes of table, including an INTEGER PRIMARY KEY, which SQLite keeps
+// as the rowid rather than as an index.
+func listIndexes(ctx context.Context, db *sql.DB, table string) ([]tableIndex, error) {
+	var indexes []tableIndex
+	info, err := queryRows(ctx, db, fmt.Sprintf("PRAGMA table_info(%s)", quoteIdent(table)))
+	if err != nil {
+		return nil, err
+	}
+	var pk []map[string]any
+	for _, col := range info {
+		if rowInt(col, "pk") > 0 {
+			pk = append(pk, col)
+		}
+	}
+	if len(pk) == 1 && strings.EqualFold(fmt.Sprintf("%v", pk[0]["type"]), "INTEGER") {
+		indexes = append(indexes, tableIndex{name: "rowid", columns: []string{fmt.Sprintf("%v", pk[0]["name"])}})
+	}
+
+	list, err := queryRows(ctx, db, fmt.Sprintf("PRAGMA index_list(%s)", quoteIdent(table)))
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range list {
+		name := fmt.Sprintf("%v", row["name"])
+		cols, err := queryRows(ctx, db, fmt.Sprintf("PRAGMA index_info(%s)", quoteIdent(name)))
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(cols, func(i, j int) bool { return rowInt(cols[i], "seqno") < rowInt(cols[j], "seqno") })
+		index := tableIndex{name: name}
+		for _, col := range cols {
+			index.columns = append(index.columns, fmt.Sprintf("%v", col["name"]))
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, nil
+}
+
+// usableIndex finds an index that answers the equality filters on columns without a scan: its
+// leading columns must all be filtered on, and either cover every filter or be the whole index.
+func usableIndex(indexes []tableIndex, columns []string) (string, bool) {
+	filtered := make(map[string]bool, len(columns))
+	for _, col := range columns {
+		filtered[strings.ToLower(col)] = true
+	}
+	for _, index := range indexes {
+		n := min(len(index.columns), len(columns))
+		leading := true
+		for _, col := range index.columns[:n] {
+			if !filtered[strings.ToLower(col)] {
+				leading = false
+				break
+			}
+		}
+		if n > 0 && leading {
+			return index.name, true
+		}
+	}
+	return "", false
+}
+
+// suggestIndex puts the filter columns first and the order columns after them, so the index also
+// returns rows in the requested order.
+func suggestIndex(table string, columns, orderBy []string) string {
+	cols := append([]string(nil), columns...)
+	for _, col := range orderBy {
+		if !containsString(cols, col) {
+			cols = append(cols, col)
+		}
+	}
+	quoted := make([]string, len(cols))
+	for i, col := range cols {
+		quoted[i] = quoteIdent(col)
+	}
+	name := "IX_Ekiben_" + table + "_" + strings.Join(cols, "_")
+	return fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)", quoteIdent(name), quoteIdent(table), strings.Join(quoted, ", "))
+}
+
+func containsString(items []string, item string) bool {
+	for _, v := range items {
+		if v == item {
+			return true
+		}
+	}
+	return false
+}
+
+// ExplainNamed returns the query plan of a named query without running it.
+func ExplainNamed(ctx context.Context, db *sql.DB, name string, args []any) (map[string]any, error) {
+	q, ok := Queries[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown query: %s", name)
+	}
+	return explain(ctx, db, q.SQL, normalizeArgs(args))
+}
+
+func explain(ctx context.Context, db *sql.DB, query string, args []any) (map[string]any, error) {
+	rows, err := queryRows(ctx, db, "EXPLAIN QUERY PLAN "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	plan := make([]map[string]any, 0, len(rows))
+	for _, row := range rows {
+		plan = append(plan, map[string]any{
+			"id":     rowInt(row, "id"),
+			"parent": rowInt(row, "parent"),
+			"detail": fmt.Sprintf("%v", row["detail"]),
+		})
+	}
+	return map[string]any{"sql": query, "plan": plan}, nil
+}
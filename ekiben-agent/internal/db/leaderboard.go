@@ -0,0 +1,131 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Crown values used by SongPlayData.Crown and SongBestData.BestCrown.
+const (
+	CrownNone      = 0
+	CrownClear     = 1
+	CrownFullCombo = 2
+	CrownDonderful = 3
+)
+
+// Dan course types used by DanScoreData.DanType. DanId values are only comparable within a type.
+const (
+	DanTypeNormal = 1
+	DanTypeGaiden = 2
+)
+
+const (
+	defaultLeaderboardLimit = 10
+	maxLeaderboardLimit     = 100
+)
+
+type LeaderboardEntry struct {
+	Rank      int    `json:"rank"`
+	Baid      int    `json:"baid"`
+	MyDonName string `json:"myDonName"`
+	Value     int    `json:"value"`
+	Crown     *int   `json:"crown,omitempty"`
+	ScoreRank *int   `json:"scoreRank,omitempty"`
+}
+
+// overallMetrics maps the leaderboard.overall "by" values to a query returning Baid and Value.
+// The dan query takes the DanType to rank as its only argument.
+var overallMetrics = map[string]string{
+	"crowns":    fmt.Sprintf("SELECT Baid, COUNT(*) AS Value FROM SongBestData WHERE BestCrown >= %d GROUP BY Baid", CrownClear),
+	"donderful": fmt.Sprintf("SELECT Baid, COUNT(*) AS Value FROM SongBestData WHERE BestCrown = %d GROUP BY Baid", CrownDonderful),
+	"dan":       "SELECT Baid, MAX(DanId) AS Value FROM DanScoreData WHERE ClearState > 0 AND DanType = ? GROUP BY Baid",
+}
+
+// SongLeaderboard ranks the best scores on one chart. Equal scores share a rank. When baid is
+// set, that player's entry is returned as "me" regardless of the requested page.
+func SongLeaderboard(ctx context.Context, db *sql.DB, songID, difficulty int, limit, offset *int, baid *int) (map[string]any, error) {
+	ranked := `SELECT b.Baid, u.MyDonName, b.BestScore AS Value, b.BestCrown AS Crown, b.BestScoreRank AS ScoreRank,
+		RANK() OVER (ORDER BY b.BestScore DESC) AS Rank
+		FROM SongBestData b JOIN UserData u ON u.Baid = b.Baid
+		WHERE b.SongId = ? AND b.Difficulty = ? AND b.BestScore > 0`
+	return leaderboard(ctx, db, ranked, []any{songID, difficulty}, limit, offset, baid, true)
+}
+
+// OverallLeaderboard ranks players by total crowns, donderful combos or highest dan cleared. The
+// dan ranking covers one DanType, DanTypeNormal unless danType is set.
+func OverallLeaderboard(ctx context.Context, db *sql.DB, by string, danType *int, limit, offset *int, baid *int) (map[string]any, error) {
+	metric, ok := overallMetrics[by]
+	if !ok {
+		return nil, fmt.Errorf("unknown leaderboard: %s", by)
+	}
+	var args []any
+	if by == "dan" {
+		danTypeValue := DanTypeNormal
+		if danType != nil {
+			danTypeValue = *danType
+		}
+		args = append(args, danTypeValue)
+	} else if danType != nil {
+		return nil, fmt.Errorf("danType only applies to the dan leaderboard")
+	}
+	ranked := fmt.Sprintf(`SELECT m.Baid, u.MyDonName, m.Value, RANK() OVER (ORDER BY m.Value DESC) AS Rank
+		FROM (%s) m JOIN UserData u ON u.Baid = m.Baid`, metric)
+	return leaderboard(ctx, db, ranked, args, limit, offset, baid, false)
+}
+
+func leaderboard(ctx context.Context, db *sql.DB, ranked string, args []any, limit, offset *int, baid *int, withCrown bool) (map[string]any, error) {
+	pageLimit := defaultLeaderboardLimit
+	if limit != nil && *limit > 0 {
+		pageLimit = min(*limit, maxLeaderboardLimit)
+	}
+	pageOffset := 0
+	if offset != nil && *offset > 0 {
+		pageOffset = *offset
+	}
+
+	var total int
+	if err := db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM (%s)", ranked), args...).Scan(&total); err != nil {
+		return nil, err
+	}
+
+	pageArgs := append(append([]any{}, args...), pageLimit, pageOffset)
+	rows, err := queryRows(ctx, db, fmt.Sprintf("SELECT * FROM (%s) ORDER BY Rank, Baid LIMIT ? OFFSET ?", ranked), pageArgs...)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]LeaderboardEntry, 0, len(rows))
+	for _, row := range rows {
+		entries = append(entries, leaderboardEntry(row, withCrown))
+	}
+
+	result := map[string]any{"entries": entries, "total": total, "limit": pageLimit, "offset": pageOffset}
+	if baid != nil {
+		meArgs := append(append([]any{}, args...), *baid)
+		rows, err := queryRows(ctx, db, fmt.Sprintf("SELECT * FROM (%s) WHERE Baid = ?", ranked), meArgs...)
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) > 0 {
+			result["me"] = leaderboardEntry(rows[0], withCrown)
+		} else {
+			result["me"] = nil
+		}
+	}
+	return result, nil
+}
+
+func leaderboardEntry(row map[string]any, withCrown bool) LeaderboardEntry {
+	entry := LeaderboardEntry{
+		Rank:      rowInt(row, "Rank"),
+		Baid:      rowInt(row, "Baid"),
+		MyDonName: rowString(row, "MyDonName"),
+		Value:     rowInt(row, "Value"),
+	}
+	if withCrown {
+		crown, scoreRank := rowInt(row, "Crown"), rowInt(row, "ScoreRank")
+		entry.Crown = &crown
+		entry.ScoreRank = &scoreRank
+	}
+	return entry
+}
@@ -0,0 +1,423 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type MergePlan struct {
+	SourceBaid       int              `json:"sourceBaid"`
+	TargetBaid       int              `json:"targetBaid"`
+	Cards            []string         `json:"cards"`
+	SongBestAdded    int              `json:"songBestAdded"`
+	SongBestImproved int              `json:"songBestImproved"`
+	SongBestKept     int              `json:"songBestKept"`
+	SongPlaysMoved   int64            `json:"songPlaysMoved"`
+	DanAdded         int              `json:"danAdded"`
+	DanReplaced      int              `json:"danReplaced"`
+	DanKept          int              `json:"danKept"`
+	AiScoresAdded    int              `json:"aiScoresAdded"`
+	AiScoresKept     int              `json:"aiScoresKept"`
+	Unlocks          map[string][]int `json:"unlocks"`
+	Tokens           map[int]int      `json:"tokens"`
+	Deleted          map[string]int64 `json:"deleted"`
+
+	// ledger records the moved tokens in the token ledger.
+	ledger bool
+}
+
+// MergePlayers folds sourceBaid into targetBaid and deletes the source player. With preview set
+// the merge runs inside a transaction that is rolled back, so the plan shows what would change.
+// A preview therefore writes too: it needs allowWrite, and holds the database write lock, which
+// keeps TLS from saving plays, until it is done. With ledger set the moved tokens are recorded in
+// the token ledger for both players.
+func MergePlayers(ctx context.Context, db *sql.DB, sourceBaid, targetBaid int, preview bool, ledger bool, allowWrite bool) (map[string]any, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+	if sourceBaid == targetBaid {
+		return nil, errors.New("source and target must be different players")
+	}
+
+	plan := &MergePlan{
+		SourceBaid: sourceBaid,
+		TargetBaid: targetBaid,
+		Cards:      []string{},
+		Unlocks:    map[string][]int{},
+		Tokens:     map[int]int{},
+		Deleted:    map[string]int64{},
+		ledger:     ledger,
+	}
+
+	err := withTx(ctx, db, !preview, func(tx *sql.Tx) error {
+		if err := requirePlayer(ctx, tx, sourceBaid); err != nil {
+			return err
+		}
+		if err := requirePlayer(ctx, tx, targetBaid); err != nil {
+			return err
+		}
+
+		steps := []func(context.Context, *sql.Tx, *MergePlan) error{
+			mergeCards,
+			mergeSongBest,
+			mergeSongPlays,
+			mergeDanScores,
+			mergeAiScores,
+			mergeTokens,
+			mergeUnlocks,
+		}
+		for _, step := range steps {
+			if err := step(ctx, tx, plan); err != nil {
+				return err
+			}
+		}
+
+		deleted, err := deletePlayerRows(ctx, tx, sourceBaid)
+		if err != nil {
+			return err
+		}
+		plan.Deleted = deleted
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]any{"plan": plan, "applied": !preview}, nil
+}
+
+func mergeCards(ctx context.Context, tx *sql.Tx, plan *MergePlan) error {
+	rows, err := queryRows(ctx, tx, "SELECT AccessCode FROM Card WHERE Baid = ? ORDER BY AccessCode", plan.SourceBaid)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		plan.Cards = append(plan.Cards, fmt.Sprintf("%v", row["AccessCode"]))
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE Card SET Baid = ? WHERE Baid = ?", plan.TargetBaid, plan.SourceBaid)
+	return err
+}
+
+type songKey struct {
+	SongID     int
+	Difficulty int
+}
+
+func mergeSongBest(ctx context.Context, tx *sql.Tx, plan *MergePlan) error {
+	target, err := songBestByKey(ctx, tx, plan.TargetBaid)
+	if err != nil {
+		return err
+	}
+	source, err := songBestByKey(ctx, tx, plan.SourceBaid)
+	if err != nil {
+		return err
+	}
+
+	for key, src := range source {
+		dst, ok := target[key]
+		if !ok {
+			if _, err := tx.ExecContext(ctx,
+				"UPDATE SongBestData SET Baid = ? WHERE Baid = ? AND SongId = ? AND Difficulty = ?",
+				plan.TargetBaid, plan.SourceBaid, key.SongID, key.Difficulty); err != nil {
+				return err
+			}
+			plan.SongBestAdded++
+			continue
+		}
+
+		merged := bestOf(dst, src)
+		if merged == dst {
+			plan.SongBestKept++
+			continue
+		}
+		if err := writeSongBest(ctx, tx, plan.TargetBaid, key, merged); err != nil {
+			return err
+		}
+		plan.SongBestImproved++
+	}
+	return nil
+}
+
+type songBest struct {
+	Crown     int
+	Rate      int
+	Score     int
+	ScoreRank int
+}
+
+// bestOf combines two SongBestData results field by field, keeping the higher value of each.
+func bestOf(a, b songBest) songBest {
+	return songBest{
+		Crown:     max(a.Crown, b.Crown),
+		Rate:      max(a.Rate, b.Rate),
+		Score:     max(a.Score, b.Score),
+		ScoreRank: max(a.ScoreRank, b.ScoreRank),
+	}
+}
+
+func songBestByKey(ctx context.Context, q querier, baid int) (map[songKey]songBest, error) {
+	rows, err := queryRows(ctx, q, "SELECT SongId, Difficulty, BestCrown, BestRate, BestScore, BestScoreRank FROM SongBestData WHERE Baid = ?", baid)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[songKey]songBest, len(rows))
+	for _, row := range rows {
+		key := songKey{SongID: rowInt(row, "SongId"), Difficulty: rowInt(row, "Difficulty")}
+		result[key] = songBest{
+			Crown:     rowInt(row, "BestCrown"),
+			Rate:      rowInt(row, "BestRate"),
+			Score:     rowInt(row, "BestScore"),
+			ScoreRank: rowInt(row, "BestScoreRank"),
+		}
+	}
+	return result, nil
+}
+
+func writeSongBest(ctx context.Context, q querier, baid int, key songKey, best songBest) error {
+	_, err := q.ExecContext(ctx,
+		`INSERT INTO SongBestData (Baid, SongId, Difficulty, BestCrown, BestRate, BestScore, BestScoreRank)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (Baid, SongId, Difficulty) DO UPDATE SET
+			BestCrown = excluded.BestCrown, BestRate = excluded.BestRate,
+			BestScore = excluded.BestScore, BestScoreRank = excluded.BestScoreRank`,
+		baid, key.SongID, key.Difficulty, best.Crown, best.Rate, best.Score, best.ScoreRank)
+	return err
+}
+
+func mergeSongPlays(ctx context.Context, tx *sql.Tx, plan *MergePlan) error {
+	res, err := tx.ExecContext(ctx, "UPDATE SongPlayData SET Baid = ? WHERE Baid = ?", plan.TargetBaid, plan.SourceBaid)
+	if err != nil {
+		return err
+	}
+	plan.SongPlaysMoved, _ = res.RowsAffected()
+	return nil
+}
+
+type danKey struct {
+	DanID   int
+	DanType int
+}
+
+type danResult struct {
+	ArrivalSongCount int
+	ClearState       int
+	ComboCountTotal  int
+	SoulGaugeTotal   int
+}
+
+// better reports whether d is a stronger dan result than other: clear state first, then how far
+// the run got, then soul gauge and combo totals.
+func (d danResult) better(other danResult) bool {
+	if d.ClearState != other.ClearState {
+		return d.ClearState > other.ClearState
+	}
+	if d.ArrivalSongCount != other.ArrivalSongCount {
+		return d.ArrivalSongCount > other.ArrivalSongCount
+	}
+	if d.SoulGaugeTotal != other.SoulGaugeTotal {
+		return d.SoulGaugeTotal > other.SoulGaugeTotal
+	}
+	return d.ComboCountTotal > other.ComboCountTotal
+}
+
+func danResultsByKey(ctx context.Context, q querier, baid int) (map[danKey]danResult, error) {
+	rows, err := queryRows(ctx, q, "SELECT DanId, DanType, ArrivalSongCount, ClearState, ComboCountTotal, SoulGaugeTotal FROM DanScoreData WHERE Baid = ?", baid)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[danKey]danResult, len(rows))
+	for _, row := range rows {
+		key := danKey{DanID: rowInt(row, "DanId"), DanType: rowInt(row, "DanType")}
+		result[key] = danResult{
+			ArrivalSongCount: rowInt(row, "ArrivalSongCount"),
+			ClearState:       rowInt(row, "ClearState"),
+			ComboCountTotal:  rowInt(row, "ComboCountTotal"),
+			SoulGaugeTotal:   rowInt(row, "SoulGaugeTotal"),
+		}
+	}
+	return result, nil
+}
+
+func mergeDanScores(ctx context.Context, tx *sql.Tx, plan *MergePlan) error {
+	target, err := danResultsByKey(ctx, tx, plan.TargetBaid)
+	if err != nil {
+		return err
+	}
+	source, err := danResultsByKey(ctx, tx, plan.SourceBaid)
+	if err != nil {
+		return err
+	}
+
+	for key, src := range source {
+		dst, ok := target[key]
+		switch {
+		case !ok:
+			plan.DanAdded++
+		case src.better(dst):
+			for _, table := range []string{"DanStageScoreData", "DanScoreData"} {
+				query := fmt.Sprintf("DELETE FROM %s WHERE Baid = ? AND DanId = ? AND DanType = ?", quoteIdent(table))
+				if _, err := tx.ExecContext(ctx, query, plan.TargetBaid, key.DanID, key.DanType); err != nil {
+					return err
+				}
+			}
+			plan.DanReplaced++
+		default:
+			plan.DanKept++
+			continue
+		}
+
+		for _, table := range []string{"DanScoreData", "DanStageScoreData"} {
+			query := fmt.Sprintf("UPDATE %s SET Baid = ? WHERE Baid = ? AND DanId = ? AND DanType = ?", quoteIdent(table))
+			if _, err := tx.ExecContext(ctx, query, plan.TargetBaid, plan.SourceBaid, key.DanID, key.DanType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func mergeAiScores(ctx context.Context, tx *sql.Tx, plan *MergePlan) error {
+	rows, err := queryRows(ctx, tx, "SELECT SongId, Difficulty, IsWin FROM AiScoreData WHERE Baid = ?", plan.SourceBaid)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		songID, difficulty := rowInt(row, "SongId"), rowInt(row, "Difficulty")
+		var count int64
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM AiScoreData WHERE Baid = ? AND SongId = ? AND Difficulty = ?",
+			plan.TargetBaid, songID, difficulty).Scan(&count); err != nil {
+			return err
+		}
+
+		if count > 0 {
+			if rowInt(row, "IsWin") != 0 {
+				if _, err := tx.ExecContext(ctx, "UPDATE AiScoreData SET IsWin = 1 WHERE Baid = ? AND SongId = ? AND Difficulty = ?",
+					plan.TargetBaid, songID, difficulty); err != nil {
+					return err
+				}
+			}
+			plan.AiScoresKept++
+			continue
+		}
+
+		for _, table := range []string{"AiScoreData", "AiSectionScoreData"} {
+			query := fmt.Sprintf("UPDATE %s SET Baid = ? WHERE Baid = ? AND SongId = ? AND Difficulty = ?", quoteIdent(table))
+			if _, err := tx.ExecContext(ctx, query, plan.TargetBaid, plan.SourceBaid, songID, difficulty); err != nil {
+				return err
+			}
+		}
+		plan.AiScoresAdded++
+	}
+	return nil
+}
+
+func mergeTokens(ctx context.Context, tx *sql.Tx, plan *MergePlan) error {
+	rows, err := queryRows(ctx, tx, "SELECT Id, Count FROM Tokens WHERE Baid = ?", plan.SourceBaid)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		id, count := rowInt(row, "Id"), rowInt(row, "Count")
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO Tokens (Baid, Id, Count) VALUES (?, ?, ?)
+			ON CONFLICT (Baid, Id) DO UPDATE SET Count = Count + excluded.Count`,
+			plan.TargetBaid, id, count); err != nil {
+			return err
+		}
+
+		var total int
+		if err := tx.QueryRowContext(ctx, "SELECT Count FROM Tokens WHERE Baid = ? AND Id = ?", plan.TargetBaid, id).Scan(&total); err != nil {
+			return err
+		}
+		plan.Tokens[id] = total
+
+		if plan.ledger && count != 0 {
+			now := time.Now()
+			if err := recordTokenChange(ctx, tx, plan.SourceBaid, id, -count, 0, "merge", fmt.Sprintf("merged into baid %d", plan.TargetBaid), now); err != nil {
+				return err
+			}
+			if err := recordTokenChange(ctx, tx, plan.TargetBaid, id, count, total, "merge", fmt.Sprintf("merged from baid %d", plan.SourceBaid), now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func mergeUnlocks(ctx context.Context, tx *sql.Tx, plan *MergePlan) error {
+	target, err := readUnlockColumns(ctx, tx, plan.TargetBaid)
+	if err != nil {
+		return err
+	}
+	source, err := readUnlockColumns(ctx, tx, plan.SourceBaid)
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string]any)
+	for _, col := range UnlockColumns {
+		merged, added := unionIDs(target[col], source[col])
+		if len(added) == 0 {
+			continue
+		}
+		plan.Unlocks[col] = added
+		values[col] = encodeIDList(merged)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	setSQL, args, err := buildSet("UserData", values)
+	if err != nil {
+		return err
+	}
+	args = append(args, plan.TargetBaid)
+	_, err = tx.ExecContext(ctx, "UPDATE UserData SET "+setSQL+" WHERE Baid = ?", args...)
+	return err
+}
+
+func readUnlockColumns(ctx context.Context, q querier, baid int) (map[string][]int, error) {
+	cols := make([]string, 0, len(UnlockColumns))
+	for _, col := range UnlockColumns {
+		cols = append(cols, quoteIdent(col))
+	}
+	query := fmt.Sprintf("SELECT %s FROM UserData WHERE Baid = ?", strings.Join(cols, ", "))
+	rows, err := queryRows(ctx, q, query, baid)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("player not found: %d", baid)
+	}
+
+	result := make(map[string][]int, len(UnlockColumns))
+	for _, col := range UnlockColumns {
+		ids, err := decodeIDList(rows[0][col])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", col, err)
+		}
+		result[col] = ids
+	}
+	return result, nil
+}
+
+// deletePlayerRows removes baid from every player table and reports the rows removed per table.
+func deletePlayerRows(ctx context.Context, q querier, baid int) (map[string]int64, error) {
+	deleted := make(map[string]int64)
+	for _, table := range PlayerTables() {
+		res, err := q.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE Baid = ?", quoteIdent(table)), baid)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", table, err)
+		}
+		affected, _ := res.RowsAffected()
+		if affected > 0 {
+			deleted[table] = affected
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,49 @@
+package db
+
+import "testing"
+
+func TestBestOf(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b songBest
+		want songBest
+	}{
+		{"empty", songBest{}, songBest{}, songBest{}},
+		{"one side empty", songBest{Crown: 2, Rate: 90, Score: 900000, ScoreRank: 5}, songBest{}, songBest{Crown: 2, Rate: 90, Score: 900000, ScoreRank: 5}},
+		{"same on both sides", songBest{Crown: 1, Rate: 80, Score: 800000, ScoreRank: 4}, songBest{Crown: 1, Rate: 80, Score: 800000, ScoreRank: 4}, songBest{Crown: 1, Rate: 80, Score: 800000, ScoreRank: 4}},
+		{"fields taken independently", songBest{Crown: 3, Rate: 70, Score: 950000, ScoreRank: 3}, songBest{Crown: 1, Rate: 95, Score: 900000, ScoreRank: 6}, songBest{Crown: 3, Rate: 95, Score: 950000, ScoreRank: 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bestOf(tt.a, tt.b); got != tt.want {
+				t.Fatalf("bestOf(%+v, %+v) = %+v, want %+v", tt.a, tt.b, got, tt.want)
+			}
+			if got := bestOf(tt.b, tt.a); got != tt.want {
+				t.Fatalf("bestOf(%+v, %+v) = %+v, want %+v", tt.b, tt.a, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDanResultBetter(t *testing.T) {
+	tests := []struct {
+		name     string
+		d, other danResult
+		want     bool
+	}{
+		{"equal", danResult{ClearState: 1, ArrivalSongCount: 3}, danResult{ClearState: 1, ArrivalSongCount: 3}, false},
+		{"higher clear state", danResult{ClearState: 2}, danResult{ClearState: 1, ArrivalSongCount: 3, SoulGaugeTotal: 100, ComboCountTotal: 900}, true},
+		{"lower clear state", danResult{ClearState: 0, ArrivalSongCount: 3}, danResult{ClearState: 1, ArrivalSongCount: 1}, false},
+		{"further arrival", danResult{ClearState: 1, ArrivalSongCount: 3}, danResult{ClearState: 1, ArrivalSongCount: 2, SoulGaugeTotal: 100}, true},
+		{"higher soul gauge", danResult{ClearState: 1, ArrivalSongCount: 3, SoulGaugeTotal: 90}, danResult{ClearState: 1, ArrivalSongCount: 3, SoulGaugeTotal: 80, ComboCountTotal: 900}, true},
+		{"lower soul gauge", danResult{ClearState: 1, ArrivalSongCount: 3, SoulGaugeTotal: 70, ComboCountTotal: 900}, danResult{ClearState: 1, ArrivalSongCount: 3, SoulGaugeTotal: 80}, false},
+		{"higher combo", danResult{ClearState: 1, ArrivalSongCount: 3, SoulGaugeTotal: 80, ComboCountTotal: 500}, danResult{ClearState: 1, ArrivalSongCount: 3, SoulGaugeTotal: 80, ComboCountTotal: 400}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.d.better(tt.other); got != tt.want {
+				t.Fatalf("%+v.better(%+v) = %v, want %v", tt.d, tt.other, got, tt.want)
+			}
+		})
+	}
+}
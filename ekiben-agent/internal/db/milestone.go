@@ -0,0 +1,151 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// EventMilestone is the change feed event carrying a Milestone.
+const EventMilestone = "milestone"
+
+// Milestone types.
+const (
+	MilestoneFirstClear   = "first_clear"
+	MilestoneCrownUp      = "crown_up"
+	MilestoneDonderful    = "donderful"
+	MilestonePersonalBest = "personal_best"
+	MilestoneDanPass      = "dan_pass"
+	MilestonePlayCount    = "play_count"
+)
+
+// MilestoneRules selects which milestones are detected. Difficulties limits song milestones to
+// the listed difficulties; empty means all of them.
+type MilestoneRules struct {
+	FirstClear          bool  `json:"firstClear"`
+	CrownUp             bool  `json:"crownUp"`
+	Donderful           bool  `json:"donderful"`
+	PersonalBest        bool  `json:"personalBest"`
+	PersonalBestMinGain int   `json:"personalBestMinGain"`
+	DanPass             bool  `json:"danPass"`
+	PlayCounts          []int `json:"playCounts"`
+	Difficulties        []int `json:"difficulties"`
+}
+
+func DefaultMilestoneRules() MilestoneRules {
+	return MilestoneRules{
+		FirstClear:   true,
+		CrownUp:      true,
+		Donderful:    true,
+		PersonalBest: true,
+		DanPass:      true,
+		PlayCounts:   []int{100},
+	}
+}
+
+// ParseMilestoneRules reads a rules file. Keys missing from the file keep their defaults.
+func ParseMilestoneRules(data []byte) (MilestoneRules, error) {
+	rules := DefaultMilestoneRules()
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return MilestoneRules{}, err
+	}
+	return rules, nil
+}
+
+// Milestone is a notable moment in a new play or dan result, with the value before and after it.
+type Milestone struct {
+	Type       string `json:"type"`
+	Baid       int    `json:"baid"`
+	SongID     *int   `json:"songId,omitempty"`
+	Difficulty *int   `json:"difficulty,omitempty"`
+	PlayID     *int   `json:"playId,omitempty"`
+	DanID      *int   `json:"danId,omitempty"`
+	DanType    *int   `json:"danType,omitempty"`
+	Before     int    `json:"before"`
+	After      int    `json:"after"`
+}
+
+// DetectMilestones returns the milestones reached by a play.recorded or dan.result event. A play
+// is compared with the player's earlier plays of the same chart rather than with SongBestData,
+// which TLS has already updated by the time the play is seen. Earlier plays include those in
+// pruned, which may be nil when nothing was pruned.
+func DetectMilestones(ctx context.Context, q querier, rules MilestoneRules, pruned *PrunedHistory, event ChangeEvent) ([]Milestone, error) {
+	switch event.Event {
+	case EventPlayRecorded:
+		return playMilestones(ctx, q, rules, pruned, event.Data)
+	case EventDanResult:
+		return danMilestones(rules, event), nil
+	default:
+		return nil, nil
+	}
+}
+
+func playMilestones(ctx context.Context, q querier, rules MilestoneRules, pruned *PrunedHistory, play map[string]any) ([]Milestone, error) {
+	if rowInt(play, "Skipped") != 0 {
+		return nil, nil
+	}
+	baid, songID, difficulty, playID := rowInt(play, "Baid"), rowInt(play, "SongId"), rowInt(play, "Difficulty"), rowInt(play, "Id")
+	if len(rules.Difficulties) > 0 && !containsID(rules.Difficulties, difficulty) {
+		return nil, nil
+	}
+
+	var count, bestCrown, bestScore int
+	err := q.QueryRowContext(ctx,
+		`SELECT COUNT(*), COALESCE(MAX(Crown), 0), COALESCE(MAX(Score), 0) FROM SongPlayData
+		WHERE Baid = ? AND SongId = ? AND Difficulty = ? AND Skipped = 0 AND Id < ?`,
+		baid, songID, difficulty, playID).Scan(&count, &bestCrown, &bestScore)
+	if err != nil {
+		return nil, err
+	}
+	if chart, ok := pruned.chart(baid, songID, difficulty); ok {
+		count += chart.Plays
+		bestCrown = max(bestCrown, chart.Crown)
+		bestScore = max(bestScore, chart.Score)
+	}
+
+	crown, score := rowInt(play, "Crown"), rowInt(play, "Score")
+	var milestones []Milestone
+	add := func(kind string, before, after int) {
+		milestones = append(milestones, Milestone{
+			Type: kind, Baid: baid, SongID: &songID, Difficulty: &difficulty, PlayID: &playID,
+			Before: before, After: after,
+		})
+	}
+
+	if rules.FirstClear && bestCrown < CrownClear && crown >= CrownClear {
+		add(MilestoneFirstClear, bestCrown, crown)
+	}
+	if rules.CrownUp && bestCrown >= CrownClear && crown > bestCrown {
+		add(MilestoneCrownUp, bestCrown, crown)
+	}
+	if rules.Donderful && bestCrown < CrownDonderful && crown == CrownDonderful {
+		add(MilestoneDonderful, bestCrown, crown)
+	}
+	if rules.PersonalBest && count > 0 && score > bestScore+rules.PersonalBestMinGain {
+		add(MilestonePersonalBest, bestScore, score)
+	}
+	if containsID(rules.PlayCounts, count+1) {
+		add(MilestonePlayCount, count, count+1)
+	}
+	return milestones, nil
+}
+
+// danMilestones reports a dan pass when a result goes from not cleared (or no result yet) to any
+// clear state.
+func danMilestones(rules MilestoneRules, event ChangeEvent) []Milestone {
+	if !rules.DanPass {
+		return nil
+	}
+	before := 0
+	if event.Previous != nil {
+		before = rowInt(event.Previous, "ClearState")
+	}
+	after := rowInt(event.Data, "ClearState")
+	if before > 0 || after <= 0 {
+		return nil
+	}
+	danID, danType := rowInt(event.Data, "DanId"), rowInt(event.Data, "DanType")
+	return []Milestone{{
+		Type: MilestoneDanPass, Baid: rowInt(event.Data, "Baid"), DanID: &danID, DanType: &danType,
+		Before: before, After: after,
+	}}
+}
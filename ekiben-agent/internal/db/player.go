@@ -0,0 +1,97 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+// querier is satisfied by both *sql.DB and *sql.Tx so helpers can run inside or outside a transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// withTx runs fn in a transaction. When commit is false the transaction is always rolled back,
+// which lets callers compute a preview of a change without applying it.
+func withTx(ctx context.Context, db *sql.DB, commit bool, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if !commit {
+		return nil
+	}
+	return tx.Commit()
+}
+
+func queryRows(ctx context.Context, q querier, query string, args ...any) ([]map[string]any, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return rowsToMaps(rows)
+}
+
+// PlayerTables returns every table in TableSchemas keyed by Baid, with UserData last so
+// dependent rows are handled before the player row itself.
+func PlayerTables() []string {
+	tables := make([]string, 0, len(TableSchemas))
+	for table, cols := range TableSchemas {
+		if table == "UserData" {
+			continue
+		}
+		for _, col := range cols {
+			if col == "Baid" {
+				tables = append(tables, table)
+				break
+			}
+		}
+	}
+	sort.Strings(tables)
+	return append(tables, "UserData")
+}
+
+func playerExists(ctx context.Context, q querier, baid int) (bool, error) {
+	var count int64
+	if err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM UserData WHERE Baid = ?", baid).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func requirePlayer(ctx context.Context, q querier, baid int) error {
+	ok, err := playerExists(ctx, q, baid)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("player not found: %d", baid)
+	}
+	return nil
+}
+
+func rowInt(row map[string]any, key string) int {
+	i, _ := anyToIntNoError(row[key])
+	return i
+}
+
+// rowString reads a text column, returning an empty string for NULL.
+func rowString(row map[string]any, key string) string {
+	switch v := row[key].(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
@@ -0,0 +1,300 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Ranges the game accepts for the enum-like profile fields.
+const (
+	maxDonNameLanguage       = 4
+	maxTitlePlateID          = 7
+	maxColorID               = 62
+	minNotesPosition         = -5
+	maxNotesPosition         = 5
+	maxAchievementDifficulty = 5
+)
+
+// ProfileUpdate holds the player-editable UserData fields. Nil fields are left unchanged.
+// UserData keeps the title as free text and a plate, with no link to the unlocked title ids, so
+// Title and TitlePlateID are only checked for length and range, not against TitleFlgArray.
+type ProfileUpdate struct {
+	MyDonName                    *string
+	MyDonNameLanguage            *int
+	Title                        *string
+	TitlePlateID                 *int
+	ColorBody                    *int
+	ColorFace                    *int
+	ColorLimb                    *int
+	Costume                      map[string]int
+	IsVoiceOn                    *bool
+	IsSkipOn                     *bool
+	NotesPosition                *int
+	DisplayAchievement           *bool
+	AchievementDisplayDifficulty *int
+	DisplayDan                   *bool
+}
+
+// profileAPIKeys maps UserData columns to the keys of the TLS UserSettings endpoint.
+var profileAPIKeys = map[string]string{
+	"MyDonName":                    "myDonName",
+	"MyDonNameLanguage":            "myDonNameLanguage",
+	"Title":                        "title",
+	"TitlePlateId":                 "titlePlateId",
+	"ColorBody":                    "bodyColor",
+	"ColorFace":                    "faceColor",
+	"ColorLimb":                    "limbColor",
+	"CurrentKigurumi":              "kigurumi",
+	"CurrentHead":                  "head",
+	"CurrentBody":                  "body",
+	"CurrentFace":                  "face",
+	"CurrentPuchi":                 "puchi",
+	"IsVoiceOn":                    "isVoiceOn",
+	"IsSkipOn":                     "isSkipOn",
+	"NotesPosition":                "notesPosition",
+	"DisplayAchievement":           "isDisplayAchievement",
+	"AchievementDisplayDifficulty": "achievementDisplayDifficulty",
+	"DisplayDan":                   "isDisplayDanOnNamePlate",
+	"UnlockedKigurumi":             "unlockedKigurumi",
+	"UnlockedHead":                 "unlockedHead",
+	"UnlockedBody":                 "unlockedBody",
+	"UnlockedFace":                 "unlockedFace",
+	"UnlockedPuchi":                "unlockedPuchi",
+}
+
+// values validates the update and returns it as UserData column values. Costume parts are only
+// checked against their range here; the unlock check needs the player's row.
+func (u ProfileUpdate) values() (map[string]any, error) {
+	values := make(map[string]any)
+	if u.MyDonName != nil {
+		if err := validateDonName(*u.MyDonName); err != nil {
+			return nil, err
+		}
+		values["MyDonName"] = *u.MyDonName
+	}
+	if u.Title != nil {
+		if err := validateTitle(*u.Title); err != nil {
+			return nil, err
+		}
+		values["Title"] = *u.Title
+	}
+
+	ranges := []struct {
+		column   string
+		value    *int
+		min, max int
+	}{
+		{"MyDonNameLanguage", u.MyDonNameLanguage, 0, maxDonNameLanguage},
+		{"TitlePlateId", u.TitlePlateID, 0, maxTitlePlateID},
+		{"ColorBody", u.ColorBody, 0, maxColorID},
+		{"ColorFace", u.ColorFace, 0, maxColorID},
+		{"ColorLimb", u.ColorLimb, 0, maxColorID},
+		{"NotesPosition", u.NotesPosition, minNotesPosition, maxNotesPosition},
+		{"AchievementDisplayDifficulty", u.AchievementDisplayDifficulty, 0, maxAchievementDifficulty},
+	}
+	for _, r := range ranges {
+		if r.value == nil {
+			continue
+		}
+		if *r.value < r.min || *r.value > r.max {
+			return nil, fmt.Errorf("%s must be between %d and %d", r.column, r.min, r.max)
+		}
+		values[r.column] = *r.value
+	}
+
+	for column, value := range map[string]*bool{
+		"IsVoiceOn":          u.IsVoiceOn,
+		"IsSkipOn":           u.IsSkipOn,
+		"DisplayAchievement": u.DisplayAchievement,
+		"DisplayDan":         u.DisplayDan,
+	} {
+		if value != nil {
+			values[column] = *value
+		}
+	}
+
+	for part, id := range u.Costume {
+		column, ok := costumeParts[part]
+		if !ok {
+			return nil, fmt.Errorf("unknown costume part: %s", part)
+		}
+		if id < 0 {
+			return nil, fmt.Errorf("costume %s must not be negative", part)
+		}
+		values[column] = id
+	}
+
+	if len(values) == 0 {
+		return nil, errors.New("no profile fields to update")
+	}
+	return values, nil
+}
+
+// checkCostumeUnlocked verifies every costume part in values against the player's unlock lists.
+// lookup reads a UserData column, which lets the same check run on UserData rows and on
+// UserSettings responses. A list the source does not provide fails the check.
+func checkCostumeUnlocked(values map[string]any, lookup func(column string) any) error {
+	parts := make([]string, 0, len(costumeParts))
+	for part := range costumeParts {
+		parts = append(parts, part)
+	}
+	sort.Strings(parts)
+	for _, part := range parts {
+		column := costumeParts[part]
+		value, ok := values[column]
+		if !ok {
+			continue
+		}
+		unlocked, err := unlockedIDs(lookup, CostumeColumns[column])
+		if err != nil {
+			return err
+		}
+		if !containsID(unlocked, value.(int)) {
+			return fmt.Errorf("costume %s %d is not unlocked", part, value)
+		}
+	}
+	return nil
+}
+
+func unlockedIDs(lookup func(column string) any, column string) ([]int, error) {
+	raw := lookup(column)
+	if raw == nil {
+		return nil, fmt.Errorf("%s is not available to check unlocks against", column)
+	}
+	unlocked, err := idsFromAny(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", column, err)
+	}
+	return unlocked, nil
+}
+
+// UpdateProfile validates and applies update to baid. Equipping a costume part also rewrites
+// CostumeData so the legacy column stays in step.
+func UpdateProfile(ctx context.Context, db *sql.DB, baid int, update ProfileUpdate, allowWrite bool) (map[string]any, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+	values, err := update.values()
+	if err != nil {
+		return nil, err
+	}
+
+	err = withTx(ctx, db, true, func(tx *sql.Tx) error {
+		rows, err := queryRows(ctx, tx, "SELECT * FROM UserData WHERE Baid = ?", baid)
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return fmt.Errorf("player not found: %d", baid)
+		}
+		row := rows[0]
+		if err := checkCostumeUnlocked(values, func(column string) any { return row[column] }); err != nil {
+			return err
+		}
+
+		if len(update.Costume) > 0 {
+			costume := make([]int, len(costumeDataOrder))
+			for i, column := range costumeDataOrder {
+				if v, ok := values[column]; ok {
+					costume[i] = v.(int)
+				} else {
+					costume[i] = rowInt(row, column)
+				}
+			}
+			values["CostumeData"] = encodeIDList(costume)
+		}
+
+		setSQL, args, err := buildSet("UserData", values)
+		if err != nil {
+			return err
+		}
+		args = append(args, baid)
+		_, err = tx.ExecContext(ctx, "UPDATE UserData SET "+setSQL+" WHERE Baid = ?", normalizeArgs(args)...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"ok": true, "baid": baid, "updated": sortedKeys(values)}, nil
+}
+
+// UpdateProfile reads the player's settings from the UserSettings endpoint, applies update and
+// posts the whole settings object back, which is how the TLS web UI saves a profile.
+func (c *APIClient) UpdateProfile(ctx context.Context, baid int, update ProfileUpdate, allowWrite bool) (map[string]any, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+	ctx = bypassCache(ctx)
+	values, err := update.values()
+	if err != nil {
+		return nil, err
+	}
+
+	path := fmt.Sprintf("/api/UserSettings/%d", baid)
+	var settings map[string]any
+	if err := c.doJSON(ctx, http.MethodGet, path, nil, &settings); err != nil {
+		return nil, err
+	}
+	if settings == nil {
+		return nil, fmt.Errorf("player not found: %d", baid)
+	}
+	lookup := func(column string) any { return fieldValue(settings, profileAPIKeys[column]) }
+	if err := checkCostumeUnlocked(values, lookup); err != nil {
+		return nil, err
+	}
+
+	for column, value := range values {
+		key := profileAPIKeys[column]
+		for existing := range settings {
+			if strings.EqualFold(existing, key) {
+				key = existing
+				break
+			}
+		}
+		settings[key] = value
+	}
+	if err := c.doJSON(ctx, http.MethodPost, path, settings, nil); err != nil {
+		return nil, err
+	}
+	return map[string]any{"ok": true, "baid": baid, "updated": sortedKeys(values)}, nil
+}
+
+// idsFromAny accepts a packed list column or an already decoded JSON array.
+func idsFromAny(value any) ([]int, error) {
+	list, ok := value.([]any)
+	if !ok {
+		return decodeIDList(value)
+	}
+	ids := make([]int, 0, len(list))
+	for _, v := range list {
+		id, err := anyToInt(v)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func containsID(ids []int, id int) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(values map[string]any) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
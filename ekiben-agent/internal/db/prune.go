@@ -0,0 +1,391 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// pruneDeleteBatch is the number of ids per DELETE, well below SQLite's bound parameter limit.
+const pruneDeleteBatch = 500
+
+// PrunePolicy selects the SongPlayData rows to keep. A play is kept when it is younger than
+// KeepDays or among the player's last KeepPlays plays; with both set, a play is only pruned when
+// neither rule keeps it. Zero disables a rule, and at least one rule is required.
+type PrunePolicy struct {
+	KeepDays   int
+	KeepPlays  int
+	ArchiveDir string
+	// HistoryPath is the PrunedHistory file the pruned plays are added to.
+	HistoryPath string
+	Vacuum      bool
+	Preview     bool
+}
+
+type PruneReport struct {
+	Table      string `json:"table"`
+	KeepDays   int    `json:"keepDays,omitempty"`
+	KeepPlays  int    `json:"keepPlays,omitempty"`
+	Cutoff     string `json:"cutoff,omitempty"`
+	Matched    int    `json:"matched"`
+	Deleted    int    `json:"deleted"`
+	Archive    string `json:"archive,omitempty"`
+	Vacuumed   bool   `json:"vacuumed"`
+	Preview    bool   `json:"preview"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// Enabled reports whether the policy has a rule to apply.
+func (p PrunePolicy) Enabled() bool {
+	return p.KeepDays > 0 || p.KeepPlays > 0
+}
+
+// pruneWhere builds the condition matching the plays the policy does not keep. It is applied to a
+// subquery that numbers each player's plays from the newest one.
+func (p PrunePolicy) pruneWhere(now time.Time) (string, []any, string) {
+	var conds []string
+	var args []any
+	cutoff := ""
+	if p.KeepDays > 0 {
+		cutoff = now.AddDate(0, 0, -p.KeepDays).Format(dbTimeLayout)
+		conds = append(conds, "PlayTime < ?")
+		args = append(args, cutoff)
+	}
+	if p.KeepPlays > 0 {
+		conds = append(conds, "Recent > ?")
+		args = append(args, p.KeepPlays)
+	}
+	return strings.Join(conds, " AND "), args, cutoff
+}
+
+// PruneSongPlays deletes old SongPlayData rows according to policy. The rows are first written to
+// an NDJSON file in ArchiveDir, so nothing is deleted unless the archive was written completely,
+// and the file is removed again when the deletion is not committed.
+// Only SongPlayData is touched: SongBestData and DanScoreData hold the records players care
+// about and are kept as they are. What was pruned from each chart is added to the PrunedHistory
+// at HistoryPath, which RebuildSongBest and DetectMilestones read so that pruning changes neither.
+// With Preview set only the matching rows are counted.
+func PruneSongPlays(ctx context.Context, db *sql.DB, policy PrunePolicy, allowWrite bool) (*PruneReport, error) {
+	if !policy.Enabled() {
+		return nil, errors.New("keepDays or keepPlays is required")
+	}
+	if policy.KeepDays < 0 || policy.KeepPlays < 0 {
+		return nil, errors.New("keepDays and keepPlays must not be negative")
+	}
+	if !policy.Preview {
+		if !allowWrite {
+			return nil, errors.New("write queries disabled")
+		}
+		if policy.ArchiveDir == "" {
+			return nil, errors.New("archive directory is required")
+		}
+		if policy.HistoryPath == "" {
+			return nil, errors.New("pruned history path is required")
+		}
+	}
+
+	started := time.Now()
+	where, args, cutoff := policy.pruneWhere(started)
+	selection := fmt.Sprintf(`SELECT Id FROM (
+		SELECT Id, PlayTime, ROW_NUMBER() OVER (PARTITION BY Baid ORDER BY PlayTime DESC, Id DESC) AS Recent
+		FROM SongPlayData) WHERE %s`, where)
+	report := &PruneReport{
+		Table:     "SongPlayData",
+		KeepDays:  policy.KeepDays,
+		KeepPlays: policy.KeepPlays,
+		Cutoff:    cutoff,
+		Preview:   policy.Preview,
+	}
+
+	if policy.Preview {
+		err := db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM (%s)", selection), args...).Scan(&report.Matched)
+		if err != nil {
+			return nil, err
+		}
+		report.DurationMs = time.Since(started).Milliseconds()
+		return report, nil
+	}
+
+	previous, err := LoadPrunedHistory(policy.HistoryPath)
+	if err != nil {
+		return nil, fmt.Errorf("pruned history: %w", err)
+	}
+	historySaved := false
+	err = withTx(ctx, db, true, func(tx *sql.Tx) error {
+		charts, err := prunedCharts(ctx, tx, selection, args)
+		if err != nil {
+			return err
+		}
+		rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT * FROM SongPlayData WHERE Id IN (%s) ORDER BY Id", selection), args...)
+		if err != nil {
+			return err
+		}
+		ids, path, err := archiveRows(rows, policy.ArchiveDir, "SongPlayData", started)
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		report.Matched = len(ids)
+		report.Archive = path
+
+		if len(charts) > 0 {
+			history, err := LoadPrunedHistory(policy.HistoryPath)
+			if err != nil {
+				return err
+			}
+			for _, chart := range charts {
+				history.add(chart)
+			}
+			if err := history.Save(policy.HistoryPath); err != nil {
+				return fmt.Errorf("pruned history: %w", err)
+			}
+			historySaved = true
+		}
+
+		for start := 0; start < len(ids); start += pruneDeleteBatch {
+			batch := ids[start:min(start+pruneDeleteBatch, len(ids))]
+			placeholders := strings.TrimSuffix(strings.Repeat("?,", len(batch)), ",")
+			res, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM SongPlayData WHERE Id IN (%s)", placeholders), batch...)
+			if err != nil {
+				return err
+			}
+			affected, _ := res.RowsAffected()
+			report.Deleted += int(affected)
+		}
+		return nil
+	})
+	if err != nil {
+		// The rows are still in the table, so the archive would only make the next run archive
+		// them a second time.
+		if report.Archive != "" {
+			os.Remove(report.Archive)
+		}
+		if historySaved {
+			previous.Save(policy.HistoryPath)
+		}
+		return nil, err
+	}
+
+	if policy.Vacuum && report.Deleted > 0 {
+		if _, err := db.ExecContext(ctx, "VACUUM"); err != nil {
+			return report, fmt.Errorf("pruned %d rows but vacuum failed: %w", report.Deleted, err)
+		}
+		report.Vacuumed = true
+	}
+	report.DurationMs = time.Since(started).Milliseconds()
+	return report, nil
+}
+
+// archiveRows writes rows to <dir>/<table>-<time>.ndjson, one JSON object per line, and returns
+// the Id of every row written. The file is only created once there is a row to write.
+func archiveRows(rows *sql.Rows, dir, table string, at time.Time) ([]any, string, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.ndjson", table, at.Format("20060102-150405.000")))
+	var file *os.File
+	var encoder *json.Encoder
+	keep := false
+	defer func() {
+		if file != nil && !keep {
+			file.Close()
+			os.Remove(path)
+		}
+	}()
+
+	var ids []any
+	for rows.Next() {
+		values := make([]any, len(cols))
+		ptrs := make([]any, len(cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, "", err
+		}
+		row := make(map[string]any, len(cols))
+		for i, col := range cols {
+			row[col] = values[i]
+		}
+
+		if file == nil {
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return nil, "", err
+			}
+			file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+			if err != nil {
+				return nil, "", err
+			}
+			encoder = json.NewEncoder(file)
+		}
+		if err := encoder.Encode(row); err != nil {
+			return nil, "", err
+		}
+		ids = append(ids, row["Id"])
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	if file == nil {
+		return nil, "", nil
+	}
+	if err := file.Sync(); err != nil {
+		return nil, "", err
+	}
+	if err := file.Close(); err != nil {
+		return nil, "", err
+	}
+	keep = true
+	return ids, path, nil
+}
+
+// PrunedChart sums up the plays of one chart that PruneSongPlays removed from SongPlayData.
+// Skipped plays are left out, as they are everywhere the play history is read.
+type PrunedChart struct {
+	Baid       int `json:"baid"`
+	SongID     int `json:"songId"`
+	Difficulty int `json:"difficulty"`
+	Plays      int `json:"plays"`
+	Crown      int `json:"crown"`
+	Rate       int `json:"rate"`
+	Score      int `json:"score"`
+	ScoreRank  int `json:"scoreRank"`
+}
+
+func (c PrunedChart) key() playerSongKey {
+	return playerSongKey{Baid: c.Baid, songKey: songKey{SongID: c.SongID, Difficulty: c.Difficulty}}
+}
+
+func (c PrunedChart) best() songBest {
+	return songBest{Crown: c.Crown, Rate: c.Rate, Score: c.Score, ScoreRank: c.ScoreRank}
+}
+
+// PrunedHistory is what PruneSongPlays removed, per player and chart. It is kept next to the
+// database so that RebuildSongBest and DetectMilestones still count pruned plays: without it a
+// rebuild would lower records whose plays were archived, and milestones would fire again.
+type PrunedHistory struct {
+	Charts []PrunedChart `json:"charts"`
+
+	index map[playerSongKey]int
+}
+
+// PrunedHistoryPath returns where the pruned history for the database at dbPath is kept.
+func PrunedHistoryPath(dbPath string) string {
+	return filepath.Join(filepath.Dir(dbPath), "ekiben-pruned.json")
+}
+
+// LoadPrunedHistory reads the pruned history at path; a missing file means nothing was pruned.
+func LoadPrunedHistory(path string) (*PrunedHistory, error) {
+	history := &PrunedHistory{}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(data))) > 0 {
+		if err := json.Unmarshal(data, history); err != nil {
+			return nil, err
+		}
+	}
+	charts := history.Charts
+	history.Charts = nil
+	for _, chart := range charts {
+		history.add(chart)
+	}
+	return history, nil
+}
+
+func (h *PrunedHistory) Save(path string) error {
+	if h.Charts == nil {
+		h.Charts = []PrunedChart{}
+	}
+	content, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return err
+	}
+	content = append(content, '\n')
+	return os.WriteFile(path, content, 0o644)
+}
+
+// add folds chart into the history, adding up plays and keeping the best of every other field.
+func (h *PrunedHistory) add(chart PrunedChart) {
+	if h.index == nil {
+		h.index = make(map[playerSongKey]int)
+	}
+	i, ok := h.index[chart.key()]
+	if !ok {
+		h.index[chart.key()] = len(h.Charts)
+		h.Charts = append(h.Charts, chart)
+		return
+	}
+	have := &h.Charts[i]
+	best := bestOf(have.best(), chart.best())
+	have.Plays += chart.Plays
+	have.Crown, have.Rate, have.Score, have.ScoreRank = best.Crown, best.Rate, best.Score, best.ScoreRank
+}
+
+// chart returns the pruned plays of one chart. A nil history has none.
+func (h *PrunedHistory) chart(baid, songID, difficulty int) (PrunedChart, bool) {
+	if h == nil {
+		return PrunedChart{}, false
+	}
+	i, ok := h.index[playerSongKey{Baid: baid, songKey: songKey{SongID: songID, Difficulty: difficulty}}]
+	if !ok {
+		return PrunedChart{}, false
+	}
+	return h.Charts[i], true
+}
+
+// MovePlayer hands the pruned plays of one player to another, after player.merge moved the rest
+// of their history.
+func (h *PrunedHistory) MovePlayer(from, to int) {
+	charts := h.Charts
+	h.Charts, h.index = nil, nil
+	for _, chart := range charts {
+		if chart.Baid == from {
+			chart.Baid = to
+		}
+		h.add(chart)
+	}
+}
+
+// RemovePlayer drops the pruned plays of a deleted player.
+func (h *PrunedHistory) RemovePlayer(baid int) {
+	charts := h.Charts
+	h.Charts, h.index = nil, nil
+	for _, chart := range charts {
+		if chart.Baid != baid {
+			h.add(chart)
+		}
+	}
+}
+
+// prunedCharts sums up the plays matched by selection, a query returning SongPlayData ids.
+func prunedCharts(ctx context.Context, q querier, selection string, args []any) ([]PrunedChart, error) {
+	rows, err := queryRows(ctx, q, fmt.Sprintf(`SELECT Baid, SongId, Difficulty, COUNT(*) AS Plays, MAX(Crown) AS Crown,
+		MAX(ScoreRate) AS Rate, MAX(Score) AS Score, MAX(ScoreRank) AS ScoreRank
+		FROM SongPlayData WHERE Skipped = 0 AND Id IN (%s) GROUP BY Baid, SongId, Difficulty`, selection), args...)
+	if err != nil {
+		return nil, err
+	}
+	charts := make([]PrunedChart, 0, len(rows))
+	for _, row := range rows {
+		charts = append(charts, PrunedChart{
+			Baid:       rowInt(row, "Baid"),
+			SongID:     rowInt(row, "SongId"),
+			Difficulty: rowInt(row, "Difficulty"),
+			Plays:      rowInt(row, "Plays"),
+			Crown:      rowInt(row, "Crown"),
+			Rate:       rowInt(row, "Rate"),
+			Score:      rowInt(row, "Score"),
+			ScoreRank:  rowInt(row, "ScoreRank"),
+		})
+	}
+	return charts, nil
+}
@@ -0,0 +1,230 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+)
+
+const (
+	BestMissing = "missing" // plays exist but there is no SongBestData row
+	BestBehind  = "behind"  // SongBestData is lower than the play history in some field
+	BestAhead   = "ahead"   // SongBestData is higher than anything in the play history
+	BestOrphan  = "orphan"  // SongBestData row without any plays behind it
+)
+
+type BestDiscrepancy struct {
+	Baid       int          `json:"baid"`
+	SongID     int          `json:"songId"`
+	Difficulty int          `json:"difficulty"`
+	Kind       string       `json:"kind"`
+	Current    *SongBestRow `json:"current,omitempty"`
+	Derived    *SongBestRow `json:"derived,omitempty"`
+}
+
+type playerSongKey struct {
+	Baid int
+	songKey
+}
+
+// RebuildSongBest derives the best crown, rate, score and rank per song and difficulty from
+// SongPlayData and compares it with SongBestData, for one player or for all when baid is nil.
+//
+// With apply set, missing rows are created and rows behind the history are raised. Rows that are
+// ahead of the history are only lowered (and orphans removed) when exact is also set, since they
+// may legitimately come from a merge or a sync with another cabinet. Plays removed by
+// PruneSongPlays are taken from pruned, which may be nil when nothing was pruned; otherwise exact
+// would lower every record whose plays were archived.
+func RebuildSongBest(ctx context.Context, db *sql.DB, baid *int, apply bool, exact bool, pruned *PrunedHistory, allowWrite bool) (map[string]any, error) {
+	if apply && !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+
+	var discrepancies []BestDiscrepancy
+	err := withTx(ctx, db, apply, func(tx *sql.Tx) error {
+		if baid != nil {
+			if err := requirePlayer(ctx, tx, *baid); err != nil {
+				return err
+			}
+		}
+
+		derived, err := derivedSongBest(ctx, tx, baid)
+		if err != nil {
+			return err
+		}
+		if pruned != nil {
+			for _, chart := range pruned.Charts {
+				if baid != nil && chart.Baid != *baid {
+					continue
+				}
+				if have, ok := derived[chart.key()]; ok {
+					derived[chart.key()] = bestOf(have, chart.best())
+				} else {
+					derived[chart.key()] = chart.best()
+				}
+			}
+		}
+		current, err := currentSongBest(ctx, tx, baid)
+		if err != nil {
+			return err
+		}
+
+		discrepancies = diffSongBest(derived, current)
+		if !apply {
+			return nil
+		}
+		for _, d := range discrepancies {
+			if err := fixSongBest(ctx, tx, d, exact); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]any{
+		"discrepancies": discrepancies,
+		"count":         len(discrepancies),
+		"applied":       apply,
+	}, nil
+}
+
+func derivedSongBest(ctx context.Context, q querier, baid *int) (map[playerSongKey]songBest, error) {
+	query := `SELECT Baid, SongId, Difficulty, MAX(Crown) AS Crown, MAX(ScoreRate) AS Rate,
+		MAX(Score) AS Score, MAX(ScoreRank) AS ScoreRank
+		FROM SongPlayData WHERE Skipped = 0`
+	args := []any{}
+	if baid != nil {
+		query += " AND Baid = ?"
+		args = append(args, *baid)
+	}
+	query += " GROUP BY Baid, SongId, Difficulty"
+
+	rows, err := queryRows(ctx, q, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[playerSongKey]songBest, len(rows))
+	for _, row := range rows {
+		key := playerSongKey{Baid: rowInt(row, "Baid"), songKey: songKey{SongID: rowInt(row, "SongId"), Difficulty: rowInt(row, "Difficulty")}}
+		result[key] = songBest{
+			Crown:     rowInt(row, "Crown"),
+			Rate:      rowInt(row, "Rate"),
+			Score:     rowInt(row, "Score"),
+			ScoreRank: rowInt(row, "ScoreRank"),
+		}
+	}
+	return result, nil
+}
+
+func currentSongBest(ctx context.Context, q querier, baid *int) (map[playerSongKey]songBest, error) {
+	query := "SELECT Baid, SongId, Difficulty, BestCrown, BestRate, BestScore, BestScoreRank FROM SongBestData"
+	args := []any{}
+	if baid != nil {
+		query += " WHERE Baid = ?"
+		args = append(args, *baid)
+	}
+
+	rows, err := queryRows(ctx, q, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[playerSongKey]songBest, len(rows))
+	for _, row := range rows {
+		key := playerSongKey{Baid: rowInt(row, "Baid"), songKey: songKey{SongID: rowInt(row, "SongId"), Difficulty: rowInt(row, "Difficulty")}}
+		result[key] = songBest{
+			Crown:     rowInt(row, "BestCrown"),
+			Rate:      rowInt(row, "BestRate"),
+			Score:     rowInt(row, "BestScore"),
+			ScoreRank: rowInt(row, "BestScoreRank"),
+		}
+	}
+	return result, nil
+}
+
+func diffSongBest(derived, current map[playerSongKey]songBest) []BestDiscrepancy {
+	result := make([]BestDiscrepancy, 0)
+	for key, want := range derived {
+		have, ok := current[key]
+		switch {
+		case !ok:
+			result = append(result, newBestDiscrepancy(key, BestMissing, nil, &want))
+		case bestOf(have, want) != have:
+			result = append(result, newBestDiscrepancy(key, BestBehind, &have, &want))
+		case have != want:
+			result = append(result, newBestDiscrepancy(key, BestAhead, &have, &want))
+		}
+	}
+	for key, have := range current {
+		if _, ok := derived[key]; !ok {
+			result = append(result, newBestDiscrepancy(key, BestOrphan, &have, nil))
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Baid != b.Baid {
+			return a.Baid < b.Baid
+		}
+		if a.SongID != b.SongID {
+			return a.SongID < b.SongID
+		}
+		return a.Difficulty < b.Difficulty
+	})
+	return result
+}
+
+func newBestDiscrepancy(key playerSongKey, kind string, current, derived *songBest) BestDiscrepancy {
+	d := BestDiscrepancy{Baid: key.Baid, SongID: key.SongID, Difficulty: key.Difficulty, Kind: kind}
+	if current != nil {
+		d.Current = current.row(key.songKey)
+	}
+	if derived != nil {
+		d.Derived = derived.row(key.songKey)
+	}
+	return d
+}
+
+func (b songBest) row(key songKey) *SongBestRow {
+	return &SongBestRow{
+		SongID:        key.SongID,
+		Difficulty:    key.Difficulty,
+		BestCrown:     b.Crown,
+		BestRate:      b.Rate,
+		BestScore:     b.Score,
+		BestScoreRank: b.ScoreRank,
+	}
+}
+
+func fixSongBest(ctx context.Context, q querier, d BestDiscrepancy, exact bool) error {
+	key := songKey{SongID: d.SongID, Difficulty: d.Difficulty}
+	switch d.Kind {
+	case BestMissing:
+		return writeSongBest(ctx, q, d.Baid, key, songBestFromRow(d.Derived))
+	case BestBehind:
+		want := songBestFromRow(d.Derived)
+		if !exact {
+			want = bestOf(songBestFromRow(d.Current), want)
+		}
+		return writeSongBest(ctx, q, d.Baid, key, want)
+	case BestAhead:
+		if !exact {
+			return nil
+		}
+		return writeSongBest(ctx, q, d.Baid, key, songBestFromRow(d.Derived))
+	case BestOrphan:
+		if !exact {
+			return nil
+		}
+		_, err := q.ExecContext(ctx, "DELETE FROM SongBestData WHERE Baid = ? AND SongId = ? AND Difficulty = ?", d.Baid, d.SongID, d.Difficulty)
+		return err
+	}
+	return nil
+}
+
+func songBestFromRow(row *SongBestRow) songBest {
+	return songBest{Crown: row.BestCrown, Rate: row.BestRate, Score: row.BestScore, ScoreRank: row.BestScoreRank}
+}
@@ -0,0 +1,325 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	defaultSessionGap   = 10 * time.Minute
+	defaultSessionDays  = 30
+	defaultSessionLimit = 50
+	maxSessionLimit     = 500
+)
+
+// SessionQuery selects the plays to group. From and To are inclusive YYYY-MM-DD dates in cabinet
+// local time; without From the last 30 days are used.
+type SessionQuery struct {
+	Baid       *int
+	From       string
+	To         string
+	GapMinutes int
+	Limit      *int
+	Offset     *int
+}
+
+// PlaySession is a run of plays by one player with no gap longer than the session gap. PlayTime is
+// written when a song ends, so Duration runs from the end of the first song to the end of the last.
+type PlaySession struct {
+	Baid            int         `json:"baid"`
+	Start           string      `json:"start"`
+	End             string      `json:"end"`
+	DurationSeconds int         `json:"durationSeconds"`
+	Plays           int         `json:"plays"`
+	Credits         int         `json:"credits"`
+	Skipped         int         `json:"skipped"`
+	Songs           []int       `json:"songs"`
+	TotalScore      int         `json:"totalScore"`
+	Difficulties    map[int]int `json:"difficulties"`
+}
+
+type DailySummary struct {
+	Date          string  `json:"date"`
+	Plays         int     `json:"plays"`
+	Sessions      int     `json:"sessions"`
+	Players       int     `json:"players"`
+	Credits       int     `json:"credits"`
+	ActiveSeconds int     `json:"activeSeconds"`
+	FirstPlay     string  `json:"firstPlay"`
+	LastPlay      string  `json:"lastPlay"`
+	BusiestHour   int     `json:"busiestHour"`
+	PlaysByHour   [24]int `json:"playsByHour"`
+}
+
+type sessionPlay struct {
+	baid       int
+	songID     int
+	difficulty int
+	score      int
+	songNumber int
+	skipped    bool
+	at         time.Time
+}
+
+// window resolves the date range of the query to [start, end).
+func (q SessionQuery) window(now time.Time) (time.Time, time.Time, error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	start := today.AddDate(0, 0, -defaultSessionDays+1)
+	end := today.AddDate(0, 0, 1)
+	if q.From != "" {
+		t, err := time.ParseInLocation("2006-01-02", q.From, time.Local)
+		if err != nil {
+			return start, end, fmt.Errorf("invalid from date: %s", q.From)
+		}
+		start = t
+	}
+	if q.To != "" {
+		t, err := time.ParseInLocation("2006-01-02", q.To, time.Local)
+		if err != nil {
+			return start, end, fmt.Errorf("invalid to date: %s", q.To)
+		}
+		end = t.AddDate(0, 0, 1)
+	}
+	if !start.Before(end) {
+		return start, end, errors.New("from must not be after to")
+	}
+	return start, end, nil
+}
+
+func (q SessionQuery) gap() (time.Duration, error) {
+	if q.GapMinutes < 0 {
+		return 0, errors.New("gapMinutes must not be negative")
+	}
+	if q.GapMinutes == 0 {
+		return defaultSessionGap, nil
+	}
+	return time.Duration(q.GapMinutes) * time.Minute, nil
+}
+
+// ListSessions groups the plays in the query range into sessions, newest first.
+func ListSessions(ctx context.Context, db *sql.DB, query SessionQuery) (map[string]any, error) {
+	plays, err := loadSessionPlays(ctx, db, query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return sessionsResult(plays, query)
+}
+
+// ListSessions groups the play history served by the TLS API. The API only serves one player's
+// history at a time, so Baid is required.
+func (c *APIClient) ListSessions(ctx context.Context, query SessionQuery) (map[string]any, error) {
+	if query.Baid == nil {
+		return nil, errors.New("baid is required in api mode")
+	}
+	start, end, err := query.window(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	rows, err := c.playHistoryRows(ctx, *query.Baid)
+	if err != nil {
+		return nil, err
+	}
+	plays := make([]sessionPlay, 0, len(rows))
+	for _, row := range rows {
+		play, ok := sessionPlayFromRow(row)
+		if !ok || play.at.Before(start) || !play.at.Before(end) {
+			continue
+		}
+		play.baid = *query.Baid
+		plays = append(plays, play)
+	}
+	sortSessionPlays(plays)
+	return sessionsResult(plays, query)
+}
+
+// DailySessionSummary reports per calendar day how the cabinet was used.
+func DailySessionSummary(ctx context.Context, db *sql.DB, query SessionQuery) (map[string]any, error) {
+	gap, err := query.gap()
+	if err != nil {
+		return nil, err
+	}
+	plays, err := loadSessionPlays(ctx, db, query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	days := make(map[string]*DailySummary)
+	players := make(map[string]map[int]struct{})
+	day := func(t time.Time) *DailySummary {
+		date := t.Format("2006-01-02")
+		summary, ok := days[date]
+		if !ok {
+			summary = &DailySummary{Date: date}
+			days[date] = summary
+			players[date] = make(map[int]struct{})
+		}
+		return summary
+	}
+
+	for _, play := range plays {
+		summary := day(play.at)
+		summary.Plays++
+		summary.PlaysByHour[play.at.Hour()]++
+		players[summary.Date][play.baid] = struct{}{}
+		at := play.at.Format(dbTimeLayout)
+		if summary.FirstPlay == "" || at < summary.FirstPlay {
+			summary.FirstPlay = at
+		}
+		if at > summary.LastPlay {
+			summary.LastPlay = at
+		}
+	}
+	// Sessions count towards the day they started on.
+	for _, session := range groupSessions(plays, gap) {
+		start, _ := parseDBTime(session.Start)
+		summary := day(start)
+		summary.Sessions++
+		summary.Credits += session.Credits
+		summary.ActiveSeconds += session.DurationSeconds
+	}
+
+	result := make([]DailySummary, 0, len(days))
+	for date, summary := range days {
+		summary.Players = len(players[date])
+		for hour, count := range summary.PlaysByHour {
+			if count > summary.PlaysByHour[summary.BusiestHour] {
+				summary.BusiestHour = hour
+			}
+		}
+		result = append(result, *summary)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Date < result[j].Date })
+	return map[string]any{"days": result, "gapMinutes": int(gap / time.Minute)}, nil
+}
+
+func loadSessionPlays(ctx context.Context, db *sql.DB, query SessionQuery, now time.Time) ([]sessionPlay, error) {
+	start, end, err := query.window(now)
+	if err != nil {
+		return nil, err
+	}
+	// PlayTime is stored in a layout that sorts as text, so the range can use the column directly.
+	sqlQuery := `SELECT Baid, SongId, Difficulty, Score, SongNumber, Skipped, PlayTime FROM SongPlayData
+		WHERE PlayTime >= ? AND PlayTime < ?`
+	args := []any{start.Format(dbTimeLayout), end.Format(dbTimeLayout)}
+	if query.Baid != nil {
+		if err := requirePlayer(ctx, db, *query.Baid); err != nil {
+			return nil, err
+		}
+		sqlQuery += " AND Baid = ?"
+		args = append(args, *query.Baid)
+	}
+	rows, err := queryRows(ctx, db, sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	plays := make([]sessionPlay, 0, len(rows))
+	for _, row := range rows {
+		if play, ok := sessionPlayFromRow(row); ok {
+			plays = append(plays, play)
+		}
+	}
+	sortSessionPlays(plays)
+	return plays, nil
+}
+
+func sessionPlayFromRow(row map[string]any) (sessionPlay, bool) {
+	at, ok := parseDBTime(fieldValue(row, "PlayTime"))
+	if !ok {
+		return sessionPlay{}, false
+	}
+	skipped := fieldValue(row, "Skipped")
+	return sessionPlay{
+		baid:       fieldInt(row, "Baid"),
+		songID:     fieldInt(row, "SongId"),
+		difficulty: fieldInt(row, "Difficulty"),
+		score:      fieldInt(row, "Score"),
+		songNumber: fieldInt(row, "SongNumber"),
+		skipped:    skipped == true || fieldInt(row, "Skipped") != 0,
+		at:         at,
+	}, true
+}
+
+func sortSessionPlays(plays []sessionPlay) {
+	sort.SliceStable(plays, func(i, j int) bool {
+		if plays[i].baid != plays[j].baid {
+			return plays[i].baid < plays[j].baid
+		}
+		return plays[i].at.Before(plays[j].at)
+	})
+}
+
+// groupSessions expects plays sorted by Baid and time. A new credit starts whenever SongNumber
+// goes back down, since the game numbers the songs of a credit from zero.
+func groupSessions(plays []sessionPlay, gap time.Duration) []PlaySession {
+	sessions := make([]PlaySession, 0)
+	var current *PlaySession
+	var first, last sessionPlay
+	for _, play := range plays {
+		if current == nil || play.baid != last.baid || play.at.Sub(last.at) > gap {
+			if current != nil {
+				sessions = append(sessions, *current)
+			}
+			current = &PlaySession{Baid: play.baid, Credits: 1, Songs: []int{}, Difficulties: map[int]int{}}
+			first = play
+		} else if play.songNumber <= last.songNumber {
+			current.Credits++
+		}
+
+		current.Plays++
+		current.Songs = append(current.Songs, play.songID)
+		current.Difficulties[play.difficulty]++
+		if play.skipped {
+			current.Skipped++
+		} else {
+			current.TotalScore += play.score
+		}
+		current.Start = first.at.Format(dbTimeLayout)
+		current.End = play.at.Format(dbTimeLayout)
+		current.DurationSeconds = int(play.at.Sub(first.at) / time.Second)
+		last = play
+	}
+	if current != nil {
+		sessions = append(sessions, *current)
+	}
+	return sessions
+}
+
+func sessionsResult(plays []sessionPlay, query SessionQuery) (map[string]any, error) {
+	gap, err := query.gap()
+	if err != nil {
+		return nil, err
+	}
+	limit, offset := defaultSessionLimit, 0
+	if query.Limit != nil {
+		limit = *query.Limit
+	}
+	if query.Offset != nil {
+		offset = *query.Offset
+	}
+	if limit <= 0 || limit > maxSessionLimit {
+		return nil, fmt.Errorf("limit must be between 1 and %d", maxSessionLimit)
+	}
+	if offset < 0 {
+		return nil, errors.New("offset must not be negative")
+	}
+
+	sessions := groupSessions(plays, gap)
+	sort.SliceStable(sessions, func(i, j int) bool { return sessions[i].Start > sessions[j].Start })
+	total := len(sessions)
+	sessions = sessions[min(offset, total):]
+	if len(sessions) > limit {
+		sessions = sessions[:limit]
+	}
+	return map[string]any{
+		"sessions":   sessions,
+		"total":      total,
+		"limit":      limit,
+		"offset":     offset,
+		"gapMinutes": int(gap / time.Minute),
+	}, nil
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGroupSessions(t *testing.T) {
+	start := time.Date(2024, 5, 1, 18, 0, 0, 0, time.Local)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	play := func(baid, minutes, songID, songNumber int) sessionPlay {
+		return sessionPlay{baid: baid, songID: songID, difficulty: 3, score: 100, songNumber: songNumber, at: at(minutes)}
+	}
+	skipped := play(1, 8, 13, 2)
+	skipped.skipped = true
+
+	tests := []struct {
+		name  string
+		plays []sessionPlay
+		want  []PlaySession
+	}{
+		{"no plays", nil, []PlaySession{}},
+		{
+			"one credit",
+			[]sessionPlay{play(1, 0, 11, 0), play(1, 4, 12, 1), skipped},
+			[]PlaySession{{Baid: 1, Start: at(0).Format(dbTimeLayout), End: at(8).Format(dbTimeLayout), DurationSeconds: 480,
+				Plays: 3, Credits: 1, Skipped: 1, Songs: []int{11, 12, 13}, TotalScore: 200, Difficulties: map[int]int{3: 3}}},
+		},
+		{
+			"song number going back starts a credit",
+			[]sessionPlay{play(1, 0, 11, 0), play(1, 4, 12, 1), play(1, 9, 13, 0)},
+			[]PlaySession{{Baid: 1, Start: at(0).Format(dbTimeLayout), End: at(9).Format(dbTimeLayout), DurationSeconds: 540,
+				Plays: 3, Credits: 2, Songs: []int{11, 12, 13}, TotalScore: 300, Difficulties: map[int]int{3: 3}}},
+		},
+		{
+			"gap splits sessions",
+			[]sessionPlay{play(1, 0, 11, 0), play(1, 31, 12, 0)},
+			[]PlaySession{
+				{Baid: 1, Start: at(0).Format(dbTimeLayout), End: at(0).Format(dbTimeLayout), Plays: 1, Credits: 1, Songs: []int{11}, TotalScore: 100, Difficulties: map[int]int{3: 1}},
+				{Baid: 1, Start: at(31).Format(dbTimeLayout), End: at(31).Format(dbTimeLayout), Plays: 1, Credits: 1, Songs: []int{12}, TotalScore: 100, Difficulties: map[int]int{3: 1}},
+			},
+		},
+		{
+			"players never share a session",
+			[]sessionPlay{play(1, 0, 11, 0), play(2, 1, 12, 1)},
+			[]PlaySession{
+				{Baid: 1, Start: at(0).Format(dbTimeLayout), End: at(0).Format(dbTimeLayout), Plays: 1, Credits: 1, Songs: []int{11}, TotalScore: 100, Difficulties: map[int]int{3: 1}},
+				{Baid: 2, Start: at(1).Format(dbTimeLayout), End: at(1).Format(dbTimeLayout), Plays: 1, Credits: 1, Songs: []int{12}, TotalScore: 100, Difficulties: map[int]int{3: 1}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := groupSessions(tt.plays, 30*time.Minute)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
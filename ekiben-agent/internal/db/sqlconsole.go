@@ -0,0 +1,279 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSQLConsoleRows = 500
+	maxSQLConsoleRows     = 5000
+	sqlConsoleTimeout     = 5 * time.Second
+)
+
+// hiddenColumns are never returned by sql.query, even though table.select lists them.
+var hiddenColumns = map[string][]string{
+	"Credential": {"Password", "Salt"},
+}
+
+// SQLQuery runs one SELECT statement on roDB, which should come from OpenReadOnly. Before it runs,
+// the compiled program of the statement is inspected: every table it opens and every column it
+// reads must be allowed by TableSchemas and not hidden, and it must not open anything for
+// writing. At most maxRows rows are returned.
+func SQLQuery(ctx context.Context, roDB *sql.DB, query string, args []any, maxRows int) (map[string]any, error) {
+	if maxRows == 0 {
+		maxRows = defaultSQLConsoleRows
+	}
+	if maxRows < 0 || maxRows > maxSQLConsoleRows {
+		return nil, fmt.Errorf("maxRows must be between 1 and %d", maxSQLConsoleRows)
+	}
+	if err := checkSelectStatement(query); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sqlConsoleTimeout)
+	defer cancel()
+	// The check and the query share a connection, so both see the same schema.
+	conn, err := roDB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	args = normalizeArgs(args)
+	if err := checkProgram(ctx, conn, query, args); err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result, truncated, err := rowsToMapsLimit(rows, maxRows)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"columns": columns, "rows": result, "truncated": truncated, "maxRows": maxRows}, nil
+}
+
+// checkSelectStatement accepts a single statement starting with SELECT or WITH. Comments and
+// quoted text are skipped, so a semicolon inside a string does not count as a second statement.
+func checkSelectStatement(query string) error {
+	var words []string
+	statementEnded := false
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 1
+			}
+			continue
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return errors.New("unterminated comment")
+			}
+			i += end + 4
+			continue
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		}
+
+		if statementEnded {
+			return errors.New("only one statement is allowed")
+		}
+		switch {
+		case c == ';':
+			statementEnded = true
+			i++
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			closing := c
+			if c == '[' {
+				closing = ']'
+			}
+			end := strings.IndexByte(query[i+1:], closing)
+			if end < 0 {
+				return errors.New("unterminated quoted text")
+			}
+			i += end + 2
+		case isWordByte(c):
+			start := i
+			for i < len(query) && isWordByte(query[i]) {
+				i++
+			}
+			if len(words) == 0 {
+				words = append(words, strings.ToUpper(query[start:i]))
+			}
+		default:
+			i++
+		}
+	}
+	if len(words) == 0 {
+		return errors.New("sql is required")
+	}
+	if words[0] != "SELECT" && words[0] != "WITH" {
+		return errors.New("only SELECT statements are allowed")
+	}
+	return nil
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+type schemaObject struct {
+	kind  string
+	name  string
+	table string
+}
+
+// programCursor is a cursor opened on a table or on one of its indexes.
+type programCursor struct {
+	table string
+	index string
+}
+
+// checkProgram compiles query with EXPLAIN and walks the bytecode. Tables and indexes are
+// identified by their root page, and columns by their position in the table or index, so a
+// column is caught however it is referenced: through *, a subquery, a view or an alias.
+func checkProgram(ctx context.Context, conn *sql.Conn, query string, args []any) error {
+	objects, err := schemaObjects(ctx, conn)
+	if err != nil {
+		return err
+	}
+	program, err := queryRows(ctx, conn, "EXPLAIN "+query, args...)
+	if err != nil {
+		return err
+	}
+
+	columns := make(map[string][]string)
+	columnsOf := func(kind, name string) ([]string, error) {
+		key := kind + " " + name
+		if cols, ok := columns[key]; ok {
+			return cols, nil
+		}
+		pragma := "table_info"
+		if kind == "index" {
+			pragma = "index_info"
+		}
+		rows, err := queryRows(ctx, conn, fmt.Sprintf("PRAGMA %s(%s)", pragma, quoteIdent(name)))
+		if err != nil {
+			return nil, err
+		}
+		cols := make([]string, len(rows))
+		for i, row := range rows {
+			cols[i] = fmt.Sprintf("%v", row["name"])
+		}
+		columns[key] = cols
+		return cols, nil
+	}
+
+	cursors := make(map[int]programCursor)
+	for _, op := range program {
+		opcode := fmt.Sprintf("%v", op["opcode"])
+		p1, p2 := rowInt(op, "p1"), rowInt(op, "p2")
+		switch opcode {
+		case "OpenWrite":
+			// Insert and IdxInsert also show up in plain SELECTs, but only on ephemeral tables.
+			return errors.New("only SELECT statements are allowed")
+		case "VOpen":
+			return errors.New("virtual tables and table-valued functions are not allowed")
+		case "Function", "PureFunc":
+			if strings.Contains(strings.ToLower(fmt.Sprintf("%v", op["p4"])), "load_extension") {
+				return errors.New("load_extension is not allowed")
+			}
+		case "OpenRead", "ReopenIdx":
+			if rowInt(op, "p3") != 0 {
+				return errors.New("only the main database can be queried")
+			}
+			object, ok := objects[p2]
+			if !ok {
+				return fmt.Errorf("unknown table at root page %d", p2)
+			}
+			if _, ok := TableSchemas[object.table]; !ok {
+				return fmt.Errorf("table not allowed: %s", object.table)
+			}
+			cursor := programCursor{table: object.table}
+			if object.kind == "index" {
+				cursor.index = object.name
+			}
+			cursors[p1] = cursor
+		case "OpenDup":
+			if cursor, ok := cursors[p2]; ok {
+				cursors[p1] = cursor
+			}
+		case "Column":
+			cursor, ok := cursors[p1]
+			if !ok {
+				// Sorters, pseudo tables and ephemeral tables only hold values read earlier.
+				continue
+			}
+			kind, name := "table", cursor.table
+			if cursor.index != "" {
+				kind, name = "index", cursor.index
+			}
+			cols, err := columnsOf(kind, name)
+			if err != nil {
+				return err
+			}
+			if p2 >= len(cols) {
+				// The last column of an index entry is the rowid.
+				continue
+			}
+			if err := checkColumn(cursor.table, cols[p2]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkColumn(table, column string) error {
+	allowed := false
+	for _, col := range TableSchemas[table] {
+		if strings.EqualFold(col, column) {
+			allowed = true
+			break
+		}
+	}
+	for _, col := range hiddenColumns[table] {
+		if strings.EqualFold(col, column) {
+			allowed = false
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("column not allowed: %s.%s", table, column)
+	}
+	return nil
+}
+
+// schemaObjects maps root pages to the tables and indexes stored there.
+func schemaObjects(ctx context.Context, conn *sql.Conn) (map[int]schemaObject, error) {
+	rows, err := queryRows(ctx, conn, "SELECT type, name, tbl_name, rootpage FROM sqlite_schema WHERE rootpage > 0")
+	if err != nil {
+		return nil, err
+	}
+	objects := map[int]schemaObject{1: {kind: "table", name: "sqlite_schema", table: "sqlite_schema"}}
+	for _, row := range rows {
+		objects[rowInt(row, "rootpage")] = schemaObject{
+			kind:  fmt.Sprintf("%v", row["type"]),
+			name:  fmt.Sprintf("%v", row["name"]),
+			table: fmt.Sprintf("%v", row["tbl_name"]),
+		}
+	}
+	return objects, nil
+}
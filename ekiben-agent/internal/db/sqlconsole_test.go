@@ -0,0 +1,86 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openConsoleDB(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "taiko.db3")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	schema := []string{
+		`CREATE TABLE "UserData" ("Baid" INTEGER NOT NULL CONSTRAINT "PK_UserData" PRIMARY KEY AUTOINCREMENT, "MyDonName" TEXT NOT NULL)`,
+		`CREATE TABLE "Card" ("AccessCode" TEXT NOT NULL CONSTRAINT "PK_Card" PRIMARY KEY, "Baid" INTEGER NOT NULL)`,
+		`CREATE TABLE "Credential" ("Baid" INTEGER NOT NULL CONSTRAINT "PK_Credential" PRIMARY KEY, "Password" TEXT NOT NULL, "Salt" TEXT NOT NULL)`,
+		`CREATE TABLE "Secret" ("Id" INTEGER NOT NULL PRIMARY KEY, "Value" TEXT NOT NULL)`,
+		`INSERT INTO UserData (Baid, MyDonName) VALUES (1, 'Alice'), (2, 'Bob')`,
+		`INSERT INTO Card (AccessCode, Baid) VALUES ('0123456789ABCDEF', 1), ('11112222333344445555', 2)`,
+		`INSERT INTO Credential (Baid, Password, Salt) VALUES (1, 'hash', 'salt')`,
+	}
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	return path
+}
+
+func TestSQLQueryChecksProgram(t *testing.T) {
+	roDB, err := OpenReadOnly(openConsoleDB(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer roDB.Close()
+
+	tests := []struct {
+		name    string
+		query   string
+		wantErr string
+	}{
+		{"select star", "SELECT * FROM UserData", ""},
+		{"select star on hidden columns", "SELECT * FROM Credential", "column not allowed: Credential.Password"},
+		{"visible column of credential", "SELECT Baid FROM Credential", ""},
+		{"count without filter", "SELECT count(*) FROM Credential", ""},
+		{"count filtered on hidden column", "SELECT count(*) FROM Credential WHERE Password LIKE 'h%'", "column not allowed: Credential.Password"},
+		{"count filtered through a function", "SELECT count(*) FROM Credential WHERE substr(Salt, 1, 1) = 's'", "column not allowed: Credential.Salt"},
+		{"join", "SELECT u.MyDonName, c.AccessCode FROM UserData u JOIN Card c ON c.Baid = u.Baid", ""},
+		{"join reading hidden column", "SELECT u.Baid, cr.Salt FROM UserData u JOIN Credential cr ON cr.Baid = u.Baid", "column not allowed: Credential.Salt"},
+		{"join condition on hidden column", "SELECT u.Baid FROM UserData u JOIN Credential cr ON cr.Password = u.MyDonName", "column not allowed: Credential.Password"},
+		{"subquery", "SELECT MyDonName FROM UserData WHERE Baid IN (SELECT Baid FROM Credential)", ""},
+		{"subquery filtered on hidden column", "SELECT MyDonName FROM UserData WHERE Baid IN (SELECT Baid FROM Credential WHERE Password = 'hash')", "column not allowed: Credential.Password"},
+		{"scalar subquery", "SELECT (SELECT Password FROM Credential c WHERE c.Baid = u.Baid) FROM UserData u", "column not allowed: Credential.Password"},
+		{"cte", "WITH c AS (SELECT Baid FROM Credential) SELECT * FROM c", ""},
+		{"cte with select star", "WITH c AS (SELECT * FROM Credential) SELECT * FROM c", "column not allowed: Credential.Password"},
+		{"materialized cte", "WITH c AS MATERIALIZED (SELECT Password FROM Credential) SELECT count(*) FROM c", "column not allowed: Credential.Password"},
+		{"table not in schemas", "SELECT * FROM Secret", "table not allowed: Secret"},
+		{"schema table", "SELECT sql FROM sqlite_schema", "table not allowed: sqlite_schema"},
+		{"pragma function", "SELECT * FROM pragma_table_info('Credential')", "table-valued functions are not allowed"},
+		{"pragma function in subquery", "SELECT Baid FROM UserData WHERE EXISTS (SELECT 1 FROM pragma_database_list)", "table-valued functions are not allowed"},
+		{"trailing semicolon", "SELECT Baid FROM UserData;", ""},
+		{"semicolon in a string", "SELECT Baid FROM UserData WHERE MyDonName <> 'a;b'", ""},
+		{"multiple statements", "SELECT Baid FROM UserData; SELECT Baid FROM Card", "only one statement is allowed"},
+		{"statement after a comment", "SELECT 1; -- done\nDELETE FROM Card", "only one statement is allowed"},
+		{"not a select", "DELETE FROM Card", "only SELECT statements are allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := SQLQuery(context.Background(), roDB, tt.query, nil, 0)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
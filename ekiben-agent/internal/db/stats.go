@@ -0,0 +1,320 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const statsTopSongs = 10
+
+type PlayerStats struct {
+	Baid              int             `json:"baid"`
+	TotalPlays        int             `json:"totalPlays"`
+	PlaysByDifficulty map[int]int     `json:"playsByDifficulty"`
+	Crowns            map[int]int     `json:"crowns"`
+	ScoreRanks        map[int]int     `json:"scoreRanks"`
+	Accuracy          float64         `json:"accuracy"`
+	TopSongs          []SongPlayCount `json:"topSongs"`
+	Streak            PlayStreak      `json:"streak"`
+	FirstPlay         string          `json:"firstPlay,omitempty"`
+	LastPlay          string          `json:"lastPlay,omitempty"`
+	Dan               *DanProgress    `json:"dan,omitempty"`
+}
+
+type SongPlayCount struct {
+	SongID int `json:"songId"`
+	Plays  int `json:"plays"`
+}
+
+// PlayStreak counts consecutive calendar days with at least one play. Current is zero unless the
+// last play was today or yesterday.
+type PlayStreak struct {
+	Current int `json:"current"`
+	Longest int `json:"longest"`
+}
+
+// DanProgress summarises a player's dan results. Attempted and Cleared count every course;
+// HighestClearedDan and HighestClearState only look at regular dan courses (DanTypeNormal), since
+// gaiden DanId values do not rank against them.
+type DanProgress struct {
+	Attempted         int           `json:"attempted"`
+	Cleared           int           `json:"cleared"`
+	HighestClearedDan int           `json:"highestClearedDan"`
+	HighestClearState int           `json:"highestClearState"`
+	Results           []DanScoreRow `json:"results"`
+}
+
+// PlayerStatsDirect computes the stats for baid with SQL aggregates over the database.
+func PlayerStatsDirect(ctx context.Context, db *sql.DB, baid int) (*PlayerStats, error) {
+	if err := requirePlayer(ctx, db, baid); err != nil {
+		return nil, err
+	}
+
+	stats := newPlayerStats(baid)
+
+	var first, last sql.NullString
+	var good, ok, miss sql.NullInt64
+	row := db.QueryRowContext(ctx,
+		`SELECT COUNT(*), MIN(PlayTime), MAX(PlayTime), SUM(GoodCount), SUM(OkCount), SUM(MissCount)
+		FROM SongPlayData WHERE Baid = ?`, baid)
+	if err := row.Scan(&stats.TotalPlays, &first, &last, &good, &ok, &miss); err != nil {
+		return nil, err
+	}
+	if first.Valid {
+		stats.FirstPlay = formatDBTime(first.String)
+	}
+	if last.Valid {
+		stats.LastPlay = formatDBTime(last.String)
+	}
+	stats.Accuracy = accuracy(int(good.Int64), int(ok.Int64), int(miss.Int64))
+
+	if err := countInto(ctx, db, stats.PlaysByDifficulty,
+		"SELECT Difficulty, COUNT(*) FROM SongPlayData WHERE Baid = ? GROUP BY Difficulty", baid); err != nil {
+		return nil, err
+	}
+	if err := countInto(ctx, db, stats.Crowns,
+		"SELECT BestCrown, COUNT(*) FROM SongBestData WHERE Baid = ? GROUP BY BestCrown", baid); err != nil {
+		return nil, err
+	}
+	if err := countInto(ctx, db, stats.ScoreRanks,
+		"SELECT BestScoreRank, COUNT(*) FROM SongBestData WHERE Baid = ? GROUP BY BestScoreRank", baid); err != nil {
+		return nil, err
+	}
+
+	top, err := queryRows(ctx, db,
+		`SELECT SongId, COUNT(*) AS Plays FROM SongPlayData WHERE Baid = ?
+		GROUP BY SongId ORDER BY Plays DESC, SongId LIMIT ?`, baid, statsTopSongs)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range top {
+		stats.TopSongs = append(stats.TopSongs, SongPlayCount{SongID: rowInt(row, "SongId"), Plays: rowInt(row, "Plays")})
+	}
+
+	days, err := queryRows(ctx, db,
+		"SELECT DISTINCT substr(PlayTime, 1, 10) AS Day FROM SongPlayData WHERE Baid = ? ORDER BY Day", baid)
+	if err != nil {
+		return nil, err
+	}
+	dayList := make([]string, 0, len(days))
+	for _, row := range days {
+		dayList = append(dayList, fmt.Sprintf("%v", row["Day"]))
+	}
+	stats.Streak = playStreak(dayList, time.Now())
+
+	dans, err := loadDanScores(ctx, db, baid)
+	if err != nil {
+		return nil, err
+	}
+	stats.Dan = danProgress(dans)
+
+	return stats, nil
+}
+
+// PlayerStats computes the stats for baid from the play history and best scores served by the
+// TLS API. Dan results are not exposed by the API, so Dan is left empty.
+func (c *APIClient) PlayerStats(ctx context.Context, baid int) (*PlayerStats, error) {
+	plays, err := c.playHistoryRows(ctx, baid)
+	if err != nil {
+		return nil, err
+	}
+	best, err := c.songBestRows(ctx, baid)
+	if err != nil {
+		return nil, err
+	}
+	return statsFromRows(baid, plays, best, time.Now()), nil
+}
+
+func statsFromRows(baid int, plays, best []map[string]any, now time.Time) *PlayerStats {
+	stats := newPlayerStats(baid)
+	stats.TotalPlays = len(plays)
+
+	var good, okCount, miss int
+	songPlays := make(map[int]int)
+	daySet := make(map[string]struct{})
+	for _, row := range plays {
+		stats.PlaysByDifficulty[fieldInt(row, "Difficulty")]++
+		songPlays[fieldInt(row, "SongId")]++
+		good += fieldInt(row, "GoodCount")
+		okCount += fieldInt(row, "OkCount")
+		miss += fieldInt(row, "MissCount")
+
+		playTime := formatDBTime(fieldValue(row, "PlayTime"))
+		if stats.FirstPlay == "" || playTime < stats.FirstPlay {
+			stats.FirstPlay = playTime
+		}
+		if playTime > stats.LastPlay {
+			stats.LastPlay = playTime
+		}
+		if len(playTime) >= 10 {
+			daySet[playTime[:10]] = struct{}{}
+		}
+	}
+	stats.Accuracy = accuracy(good, okCount, miss)
+
+	for _, row := range best {
+		stats.Crowns[fieldInt(row, "BestCrown")]++
+		stats.ScoreRanks[fieldInt(row, "BestScoreRank")]++
+	}
+
+	for songID, count := range songPlays {
+		stats.TopSongs = append(stats.TopSongs, SongPlayCount{SongID: songID, Plays: count})
+	}
+	sort.Slice(stats.TopSongs, func(i, j int) bool {
+		if stats.TopSongs[i].Plays != stats.TopSongs[j].Plays {
+			return stats.TopSongs[i].Plays > stats.TopSongs[j].Plays
+		}
+		return stats.TopSongs[i].SongID < stats.TopSongs[j].SongID
+	})
+	if len(stats.TopSongs) > statsTopSongs {
+		stats.TopSongs = stats.TopSongs[:statsTopSongs]
+	}
+
+	days := make([]string, 0, len(daySet))
+	for day := range daySet {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	stats.Streak = playStreak(days, now)
+
+	return stats
+}
+
+func newPlayerStats(baid int) *PlayerStats {
+	return &PlayerStats{
+		Baid:              baid,
+		PlaysByDifficulty: map[int]int{},
+		Crowns:            map[int]int{},
+		ScoreRanks:        map[int]int{},
+		TopSongs:          []SongPlayCount{},
+	}
+}
+
+func countInto(ctx context.Context, q querier, out map[int]int, query string, args ...any) error {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, count int
+		if err := rows.Scan(&key, &count); err != nil {
+			return err
+		}
+		out[key] = count
+	}
+	return rows.Err()
+}
+
+// accuracy is the percentage of notes hit, counting an Ok as half a Good like the game does.
+func accuracy(good, ok, miss int) float64 {
+	total := good + ok + miss
+	if total == 0 {
+		return 0
+	}
+	pct := (float64(good) + float64(ok)/2) / float64(total) * 100
+	return float64(int(pct*100+0.5)) / 100
+}
+
+// playStreak expects days as sorted, distinct YYYY-MM-DD strings.
+func playStreak(days []string, now time.Time) PlayStreak {
+	var streak PlayStreak
+	run := 0
+	var prev time.Time
+	for _, day := range days {
+		t, err := time.ParseInLocation("2006-01-02", day, time.Local)
+		if err != nil {
+			continue
+		}
+		if run > 0 && t.Equal(prev.AddDate(0, 0, 1)) {
+			run++
+		} else {
+			run = 1
+		}
+		prev = t
+		streak.Longest = max(streak.Longest, run)
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	if run > 0 && !prev.Before(today.AddDate(0, 0, -1)) {
+		streak.Current = run
+	}
+	return streak
+}
+
+func danProgress(results []DanScoreRow) *DanProgress {
+	progress := &DanProgress{Attempted: len(results), Results: results}
+	for _, result := range results {
+		if result.ClearState <= 0 {
+			continue
+		}
+		progress.Cleared++
+		if result.DanType == DanTypeNormal && result.DanID > progress.HighestClearedDan {
+			progress.HighestClearedDan = result.DanID
+			progress.HighestClearState = result.ClearState
+		}
+	}
+	return progress
+}
+
+// dbTimeLayout is how TLS (EF Core) writes DateTime values to SQLite.
+const dbTimeLayout = "2006-01-02 15:04:05.0000000"
+
+var dbTimeLayouts = []string{
+	"2006-01-02 15:04:05.9999999",
+	"2006-01-02T15:04:05.9999999",
+	time.RFC3339Nano,
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseDBTime reads a DateTime column written by TLS or returned by its API. Values without a
+// zone are taken as cabinet local time, which is how TLS stores them.
+func parseDBTime(value any) (time.Time, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, true
+	case []byte:
+		return parseDBTime(string(v))
+	case string:
+		v = strings.TrimSpace(v)
+		for _, layout := range dbTimeLayouts {
+			if t, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// formatDBTime renders a PlayTime value in dbTimeLayout, so stats read from the database and from
+// the TLS API compare and display the same way. Values that do not parse are returned as is.
+func formatDBTime(value any) string {
+	if t, ok := parseDBTime(value); ok {
+		return t.Format(dbTimeLayout)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// fieldValue looks up a column in a row that may come from SQLite (PascalCase) or from the TLS
+// API (camelCase).
+func fieldValue(row map[string]any, name string) any {
+	if v, ok := row[name]; ok {
+		return v
+	}
+	for key, v := range row {
+		if strings.EqualFold(key, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+func fieldInt(row map[string]any, name string) int {
+	i, _ := anyToIntNoError(fieldValue(row, name))
+	return i
+}
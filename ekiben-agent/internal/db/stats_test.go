@@ -0,0 +1,51 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPlayStreak(t *testing.T) {
+	now := time.Date(2024, 5, 10, 15, 0, 0, 0, time.Local)
+	tests := []struct {
+		name string
+		days []string
+		want PlayStreak
+	}{
+		{"no plays", nil, PlayStreak{}},
+		{"played today", []string{"2024-05-10"}, PlayStreak{Current: 1, Longest: 1}},
+		{"run ending yesterday is current", []string{"2024-05-07", "2024-05-08", "2024-05-09"}, PlayStreak{Current: 3, Longest: 3}},
+		{"run ending two days ago is over", []string{"2024-05-07", "2024-05-08"}, PlayStreak{Longest: 2}},
+		{"longest run in the past", []string{"2024-04-01", "2024-04-02", "2024-04-03", "2024-05-09", "2024-05-10"}, PlayStreak{Current: 2, Longest: 3}},
+		{"across a month end", []string{"2024-04-30", "2024-05-01"}, PlayStreak{Longest: 2}},
+		{"bad days are skipped", []string{"2024-05-09", "junk", "2024-05-10"}, PlayStreak{Current: 2, Longest: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := playStreak(tt.days, now); got != tt.want {
+				t.Fatalf("playStreak(%v) = %+v, want %+v", tt.days, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatDBTime(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+		want  string
+	}{
+		{"database layout", "2024-05-10 18:30:00.1234567", "2024-05-10 18:30:00.1234567"},
+		{"short fraction", "2024-05-10 18:30:00.5", "2024-05-10 18:30:00.5000000"},
+		{"api layout", "2024-05-10T18:30:00", "2024-05-10 18:30:00.0000000"},
+		{"bytes", []byte("2024-05-10 18:30"), "2024-05-10 18:30:00.0000000"},
+		{"not a time", "soon", "soon"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatDBTime(tt.value); got != tt.want {
+				t.Fatalf("formatDBTime(%v) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,482 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ChangeSet is a portable snapshot of the best-score data of players whose LastPlayDatetime is
+// newer than Since. Players are identified by access code so it can be applied to another
+// database where the same cards map to different Baids.
+type ChangeSet struct {
+	Origin    string          `json:"origin"`
+	Since     string          `json:"since,omitempty"`
+	Watermark string          `json:"watermark"`
+	Players   []PlayerChanges `json:"players"`
+}
+
+type PlayerChanges struct {
+	AccessCodes []string      `json:"accessCodes"`
+	SongBest    []SongBestRow `json:"songBest"`
+	DanScores   []DanScoreRow `json:"danScores"`
+	AiScores    []AiScoreRow  `json:"aiScores"`
+}
+
+type SongBestRow struct {
+	SongID        int `json:"songId"`
+	Difficulty    int `json:"difficulty"`
+	BestCrown     int `json:"bestCrown"`
+	BestRate      int `json:"bestRate"`
+	BestScore     int `json:"bestScore"`
+	BestScoreRank int `json:"bestScoreRank"`
+}
+
+type DanScoreRow struct {
+	DanID            int           `json:"danId"`
+	DanType          int           `json:"danType"`
+	ArrivalSongCount int           `json:"arrivalSongCount"`
+	ClearState       int           `json:"clearState"`
+	ComboCountTotal  int           `json:"comboCountTotal"`
+	SoulGaugeTotal   int           `json:"soulGaugeTotal"`
+	Stages           []DanStageRow `json:"stages"`
+}
+
+type DanStageRow struct {
+	SongNumber    int `json:"songNumber"`
+	BadCount      int `json:"badCount"`
+	ComboCount    int `json:"comboCount"`
+	DrumrollCount int `json:"drumrollCount"`
+	GoodCount     int `json:"goodCount"`
+	HighScore     int `json:"highScore"`
+	OkCount       int `json:"okCount"`
+	PlayScore     int `json:"playScore"`
+	TotalHitCount int `json:"totalHitCount"`
+}
+
+type AiScoreRow struct {
+	SongID     int  `json:"songId"`
+	Difficulty int  `json:"difficulty"`
+	IsWin      bool `json:"isWin"`
+}
+
+type SyncReport struct {
+	Origin           string         `json:"origin"`
+	Watermark        string         `json:"watermark"`
+	Applied          bool           `json:"applied"`
+	Players          int            `json:"players"`
+	Unmapped         []string       `json:"unmapped"`
+	Conflicts        []SyncConflict `json:"conflicts"`
+	SongBestAdded    int            `json:"songBestAdded"`
+	SongBestImproved int            `json:"songBestImproved"`
+	DanAdded         int            `json:"danAdded"`
+	DanReplaced      int            `json:"danReplaced"`
+	AiScoresAdded    int            `json:"aiScoresAdded"`
+	AiScoresWon      int            `json:"aiScoresWon"`
+	// Stale is set when a change set older than the last one applied from its origin was skipped.
+	Stale bool `json:"stale,omitempty"`
+}
+
+// SyncConflict is reported when the access codes of one source player belong to several
+// players in the destination database.
+type SyncConflict struct {
+	AccessCodes []string `json:"accessCodes"`
+	Baids       []int    `json:"baids"`
+}
+
+// SyncState stores the last applied watermark per origin so repeated syncs are incremental.
+type SyncState struct {
+	Watermarks map[string]string `json:"watermarks"`
+}
+
+// SyncStatePath returns where the sync state for the database at dbPath is kept.
+func SyncStatePath(dbPath string) string {
+	return filepath.Join(filepath.Dir(dbPath), "ekiben-sync.json")
+}
+
+func LoadSyncState(path string) (*SyncState, error) {
+	state := &SyncState{Watermarks: map[string]string{}}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return state, nil
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Watermarks == nil {
+		state.Watermarks = map[string]string{}
+	}
+	return state, nil
+}
+
+func (s *SyncState) Save(path string) error {
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	content = append(content, '\n')
+	return os.WriteFile(path, content, 0o644)
+}
+
+// ExportChangeSet collects the best-score data of every player that played after since.
+// An empty since exports all players.
+func ExportChangeSet(ctx context.Context, db *sql.DB, origin, since string) (*ChangeSet, error) {
+	cs := &ChangeSet{Origin: origin, Since: since, Watermark: since, Players: []PlayerChanges{}}
+
+	err := withTx(ctx, db, false, func(tx *sql.Tx) error {
+		var watermark sql.NullString
+		if err := tx.QueryRowContext(ctx, "SELECT MAX(LastPlayDatetime) FROM UserData").Scan(&watermark); err != nil {
+			return err
+		}
+		if watermark.Valid && watermark.String > cs.Watermark {
+			cs.Watermark = watermark.String
+		}
+
+		rows, err := queryRows(ctx, tx, "SELECT Baid FROM UserData WHERE LastPlayDatetime > ? ORDER BY Baid", since)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			player, err := exportPlayerChanges(ctx, tx, rowInt(row, "Baid"))
+			if err != nil {
+				return err
+			}
+			if len(player.AccessCodes) == 0 {
+				continue
+			}
+			cs.Players = append(cs.Players, player)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+func exportPlayerChanges(ctx context.Context, q querier, baid int) (PlayerChanges, error) {
+	player := PlayerChanges{
+		AccessCodes: []string{},
+		SongBest:    []SongBestRow{},
+		DanScores:   []DanScoreRow{},
+		AiScores:    []AiScoreRow{},
+	}
+
+	cards, err := queryRows(ctx, q, "SELECT AccessCode FROM Card WHERE Baid = ? ORDER BY AccessCode", baid)
+	if err != nil {
+		return player, err
+	}
+	for _, row := range cards {
+		player.AccessCodes = append(player.AccessCodes, fmt.Sprintf("%v", row["AccessCode"]))
+	}
+
+	best, err := queryRows(ctx, q, "SELECT * FROM SongBestData WHERE Baid = ? ORDER BY SongId, Difficulty", baid)
+	if err != nil {
+		return player, err
+	}
+	for _, row := range best {
+		player.SongBest = append(player.SongBest, SongBestRow{
+			SongID:        rowInt(row, "SongId"),
+			Difficulty:    rowInt(row, "Difficulty"),
+			BestCrown:     rowInt(row, "BestCrown"),
+			BestRate:      rowInt(row, "BestRate"),
+			BestScore:     rowInt(row, "BestScore"),
+			BestScoreRank: rowInt(row, "BestScoreRank"),
+		})
+	}
+
+	player.DanScores, err = loadDanScores(ctx, q, baid)
+	if err != nil {
+		return player, err
+	}
+
+	ai, err := queryRows(ctx, q, "SELECT SongId, Difficulty, IsWin FROM AiScoreData WHERE Baid = ? ORDER BY SongId, Difficulty", baid)
+	if err != nil {
+		return player, err
+	}
+	for _, row := range ai {
+		player.AiScores = append(player.AiScores, AiScoreRow{
+			SongID:     rowInt(row, "SongId"),
+			Difficulty: rowInt(row, "Difficulty"),
+			IsWin:      rowInt(row, "IsWin") != 0,
+		})
+	}
+
+	return player, nil
+}
+
+func loadDanScores(ctx context.Context, q querier, baid int) ([]DanScoreRow, error) {
+	result := []DanScoreRow{}
+	dans, err := queryRows(ctx, q, "SELECT * FROM DanScoreData WHERE Baid = ? ORDER BY DanId, DanType", baid)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range dans {
+		dan := DanScoreRow{
+			DanID:            rowInt(row, "DanId"),
+			DanType:          rowInt(row, "DanType"),
+			ArrivalSongCount: rowInt(row, "ArrivalSongCount"),
+			ClearState:       rowInt(row, "ClearState"),
+			ComboCountTotal:  rowInt(row, "ComboCountTotal"),
+			SoulGaugeTotal:   rowInt(row, "SoulGaugeTotal"),
+			Stages:           []DanStageRow{},
+		}
+		stages, err := queryRows(ctx, q, "SELECT * FROM DanStageScoreData WHERE Baid = ? AND DanId = ? AND DanType = ? ORDER BY SongNumber",
+			baid, dan.DanID, dan.DanType)
+		if err != nil {
+			return nil, err
+		}
+		for _, stage := range stages {
+			dan.Stages = append(dan.Stages, DanStageRow{
+				SongNumber:    rowInt(stage, "SongNumber"),
+				BadCount:      rowInt(stage, "BadCount"),
+				ComboCount:    rowInt(stage, "ComboCount"),
+				DrumrollCount: rowInt(stage, "DrumrollCount"),
+				GoodCount:     rowInt(stage, "GoodCount"),
+				HighScore:     rowInt(stage, "HighScore"),
+				OkCount:       rowInt(stage, "OkCount"),
+				PlayScore:     rowInt(stage, "PlayScore"),
+				TotalHitCount: rowInt(stage, "TotalHitCount"),
+			})
+		}
+		result = append(result, dan)
+	}
+	return result, nil
+}
+
+// ApplyChangeSet merges cs into db with best-of rules: SongBestData keeps the higher value of
+// every field, DanScoreData keeps the stronger result together with its stages, and AiScoreData
+// keeps a win once either side has one. Players whose cards are unknown here are skipped. A dry
+// run applies the changes in a transaction that is rolled back, so it needs allowWrite as well,
+// and holds the database write lock, which keeps TLS from saving plays, until it is done.
+func ApplyChangeSet(ctx context.Context, db *sql.DB, cs *ChangeSet, dryRun bool, allowWrite bool) (*SyncReport, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+	if cs == nil {
+		return nil, errors.New("change set is required")
+	}
+
+	report := &SyncReport{
+		Origin:    cs.Origin,
+		Watermark: cs.Watermark,
+		Applied:   !dryRun,
+		Unmapped:  []string{},
+		Conflicts: []SyncConflict{},
+	}
+
+	err := withTx(ctx, db, !dryRun, func(tx *sql.Tx) error {
+		for _, player := range cs.Players {
+			baids, err := baidsForAccessCodes(ctx, tx, player.AccessCodes)
+			if err != nil {
+				return err
+			}
+			switch len(baids) {
+			case 0:
+				report.Unmapped = append(report.Unmapped, player.AccessCodes...)
+				continue
+			case 1:
+			default:
+				report.Conflicts = append(report.Conflicts, SyncConflict{AccessCodes: player.AccessCodes, Baids: baids})
+				continue
+			}
+
+			if err := applyPlayerChanges(ctx, tx, baids[0], player, report); err != nil {
+				return err
+			}
+			report.Players++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// ApplyTrackedChangeSet applies cs like ApplyChangeSet and records its watermark in state, which
+// is updated in place when the changes were applied; saving it is up to the caller. A change set
+// older than the last one applied from the same origin is not applied, since that would repeat
+// work and move the watermark back; the report has Stale set instead.
+func ApplyTrackedChangeSet(ctx context.Context, db *sql.DB, cs *ChangeSet, state *SyncState, dryRun bool, allowWrite bool) (*SyncReport, error) {
+	if cs == nil {
+		return nil, errors.New("change set is required")
+	}
+	if cs.Origin == "" {
+		return nil, errors.New("change set origin is required")
+	}
+	if last := state.Watermarks[cs.Origin]; last != "" && cs.Watermark < last {
+		return &SyncReport{
+			Origin:    cs.Origin,
+			Watermark: last,
+			Stale:     true,
+			Unmapped:  []string{},
+			Conflicts: []SyncConflict{},
+		}, nil
+	}
+	report, err := ApplyChangeSet(ctx, db, cs, dryRun, allowWrite)
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		state.Watermarks[cs.Origin] = cs.Watermark
+	}
+	return report, nil
+}
+
+func baidsForAccessCodes(ctx context.Context, q querier, accessCodes []string) ([]int, error) {
+	seen := make(map[int]struct{})
+	for _, code := range accessCodes {
+		rows, err := queryRows(ctx, q, "SELECT Baid FROM Card WHERE AccessCode = ?", code)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			seen[rowInt(row, "Baid")] = struct{}{}
+		}
+	}
+
+	baids := make([]int, 0, len(seen))
+	for baid := range seen {
+		baids = append(baids, baid)
+	}
+	sort.Ints(baids)
+	return baids, nil
+}
+
+func applyPlayerChanges(ctx context.Context, tx *sql.Tx, baid int, player PlayerChanges, report *SyncReport) error {
+	current, err := songBestByKey(ctx, tx, baid)
+	if err != nil {
+		return err
+	}
+	for _, row := range player.SongBest {
+		key := songKey{SongID: row.SongID, Difficulty: row.Difficulty}
+		incoming := songBest{Crown: row.BestCrown, Rate: row.BestRate, Score: row.BestScore, ScoreRank: row.BestScoreRank}
+		existing, ok := current[key]
+		merged := incoming
+		if ok {
+			merged = bestOf(existing, incoming)
+			if merged == existing {
+				continue
+			}
+		}
+		if err := writeSongBest(ctx, tx, baid, key, merged); err != nil {
+			return err
+		}
+		if ok {
+			report.SongBestImproved++
+		} else {
+			report.SongBestAdded++
+		}
+	}
+
+	dans, err := danResultsByKey(ctx, tx, baid)
+	if err != nil {
+		return err
+	}
+	for _, row := range player.DanScores {
+		key := danKey{DanID: row.DanID, DanType: row.DanType}
+		incoming := danResult{
+			ArrivalSongCount: row.ArrivalSongCount,
+			ClearState:       row.ClearState,
+			ComboCountTotal:  row.ComboCountTotal,
+			SoulGaugeTotal:   row.SoulGaugeTotal,
+		}
+		existing, ok := dans[key]
+		if ok && !incoming.better(existing) {
+			continue
+		}
+		if err := writeDanScore(ctx, tx, baid, row); err != nil {
+			return err
+		}
+		if ok {
+			report.DanReplaced++
+		} else {
+			report.DanAdded++
+		}
+	}
+
+	for _, row := range player.AiScores {
+		var isWin sql.NullInt64
+		err := tx.QueryRowContext(ctx, "SELECT IsWin FROM AiScoreData WHERE Baid = ? AND SongId = ? AND Difficulty = ?",
+			baid, row.SongID, row.Difficulty).Scan(&isWin)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			if _, err := tx.ExecContext(ctx, "INSERT INTO AiScoreData (Baid, SongId, Difficulty, IsWin) VALUES (?, ?, ?, ?)",
+				baid, row.SongID, row.Difficulty, row.IsWin); err != nil {
+				return err
+			}
+			report.AiScoresAdded++
+		case err != nil:
+			return err
+		case row.IsWin && isWin.Int64 == 0:
+			if _, err := tx.ExecContext(ctx, "UPDATE AiScoreData SET IsWin = 1 WHERE Baid = ? AND SongId = ? AND Difficulty = ?",
+				baid, row.SongID, row.Difficulty); err != nil {
+				return err
+			}
+			report.AiScoresWon++
+		}
+	}
+	return nil
+}
+
+func writeDanScore(ctx context.Context, q querier, baid int, row DanScoreRow) error {
+	for _, table := range []string{"DanStageScoreData", "DanScoreData"} {
+		query := fmt.Sprintf("DELETE FROM %s WHERE Baid = ? AND DanId = ? AND DanType = ?", quoteIdent(table))
+		if _, err := q.ExecContext(ctx, query, baid, row.DanID, row.DanType); err != nil {
+			return err
+		}
+	}
+
+	if _, err := q.ExecContext(ctx,
+		`INSERT INTO DanScoreData (Baid, DanId, DanType, ArrivalSongCount, ClearState, ComboCountTotal, SoulGaugeTotal)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		baid, row.DanID, row.DanType, row.ArrivalSongCount, row.ClearState, row.ComboCountTotal, row.SoulGaugeTotal); err != nil {
+		return err
+	}
+	for _, stage := range row.Stages {
+		if _, err := q.ExecContext(ctx,
+			`INSERT INTO DanStageScoreData (Baid, DanId, DanType, SongNumber, BadCount, ComboCount, DrumrollCount,
+			GoodCount, HighScore, OkCount, PlayScore, TotalHitCount) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			baid, row.DanID, row.DanType, stage.SongNumber, stage.BadCount, stage.ComboCount, stage.DrumrollCount,
+			stage.GoodCount, stage.HighScore, stage.OkCount, stage.PlayScore, stage.TotalHitCount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SyncDatabases exports the changes in src since the watermark recorded for origin and applies
+// them to dst. The state is updated in place when the changes were applied; saving it is up to
+// the caller. With full set the watermark is ignored and every player is reconciled.
+func SyncDatabases(ctx context.Context, src, dst *sql.DB, origin string, state *SyncState, full bool, dryRun bool, allowWrite bool) (*SyncReport, error) {
+	since := ""
+	if !full {
+		since = state.Watermarks[origin]
+	}
+
+	cs, err := ExportChangeSet(ctx, src, origin, since)
+	if err != nil {
+		return nil, fmt.Errorf("export: %w", err)
+	}
+	report, err := ApplyChangeSet(ctx, dst, cs, dryRun, allowWrite)
+	if err != nil {
+		return nil, fmt.Errorf("apply: %w", err)
+	}
+	if !dryRun {
+		state.Watermarks[origin] = cs.Watermark
+	}
+	return report, nil
+}
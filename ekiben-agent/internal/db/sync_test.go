@@ -0,0 +1,182 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// openSyncDB creates a database with one player, Baid 1 on card CARD1, who has a best score, a
+// dan result and a lost AI battle on song 1 / difficulty 3.
+func openSyncDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := Open(filepath.Join(t.TempDir(), "taiko.db3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	schema := []string{
+		`CREATE TABLE "Card" ("AccessCode" TEXT NOT NULL CONSTRAINT "PK_Card" PRIMARY KEY, "Baid" INTEGER NOT NULL)`,
+		`CREATE TABLE "SongBestData" ("Baid" INTEGER NOT NULL, "SongId" INTEGER NOT NULL, "Difficulty" INTEGER NOT NULL, "BestCrown" INTEGER NOT NULL, "BestRate" INTEGER NOT NULL, "BestScore" INTEGER NOT NULL, "BestScoreRank" INTEGER NOT NULL, CONSTRAINT "PK_SongBestData" PRIMARY KEY ("Baid", "SongId", "Difficulty"))`,
+		`CREATE TABLE "AiScoreData" ("Baid" INTEGER NOT NULL, "SongId" INTEGER NOT NULL, "Difficulty" INTEGER NOT NULL, "IsWin" INTEGER NOT NULL, CONSTRAINT "PK_AiScoreData" PRIMARY KEY ("Baid", "SongId", "Difficulty"))`,
+		`CREATE TABLE "DanScoreData" ("Baid" INTEGER NOT NULL, "DanId" INTEGER NOT NULL, "DanType" INTEGER NOT NULL, "ArrivalSongCount" INTEGER NOT NULL, "ClearState" INTEGER NOT NULL, "ComboCountTotal" INTEGER NOT NULL, "SoulGaugeTotal" INTEGER NOT NULL, CONSTRAINT "PK_DanScoreData" PRIMARY KEY ("Baid", "DanId", "DanType"))`,
+		`CREATE TABLE "DanStageScoreData" ("Baid" INTEGER NOT NULL, "DanId" INTEGER NOT NULL, "DanType" INTEGER NOT NULL, "SongNumber" INTEGER NOT NULL, "BadCount" INTEGER NOT NULL, "ComboCount" INTEGER NOT NULL, "DrumrollCount" INTEGER NOT NULL, "GoodCount" INTEGER NOT NULL, "HighScore" INTEGER NOT NULL, "OkCount" INTEGER NOT NULL, "PlayScore" INTEGER NOT NULL, "TotalHitCount" INTEGER NOT NULL, CONSTRAINT "PK_DanStageScoreData" PRIMARY KEY ("Baid", "DanId", "DanType", "SongNumber"))`,
+		`INSERT INTO Card (AccessCode, Baid) VALUES ('CARD1', 1)`,
+		`INSERT INTO SongBestData VALUES (1, 1, 3, 1, 80, 800000, 4)`,
+		`INSERT INTO DanScoreData VALUES (1, 1, 1, 3, 1, 500, 90)`,
+		`INSERT INTO DanStageScoreData VALUES (1, 1, 1, 1, 0, 200, 10, 180, 300000, 20, 300000, 210)`,
+		`INSERT INTO AiScoreData VALUES (1, 1, 3, 0)`,
+	}
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	return db
+}
+
+func TestApplyChangeSetBestOf(t *testing.T) {
+	tests := []struct {
+		name       string
+		player     PlayerChanges
+		wantReport SyncReport
+		wantBest   songBest
+		wantDan    danResult
+		wantStages int
+		wantWin    int
+	}{
+		{
+			name:       "worse scores are ignored",
+			player:     PlayerChanges{SongBest: []SongBestRow{{SongID: 1, Difficulty: 3, BestCrown: 0, BestRate: 50, BestScore: 500000, BestScoreRank: 2}}, DanScores: []DanScoreRow{{DanID: 1, DanType: 1, ArrivalSongCount: 2, ClearState: 1}}, AiScores: []AiScoreRow{{SongID: 1, Difficulty: 3}}},
+			wantBest:   songBest{Crown: 1, Rate: 80, Score: 800000, ScoreRank: 4},
+			wantDan:    danResult{ArrivalSongCount: 3, ClearState: 1, ComboCountTotal: 500, SoulGaugeTotal: 90},
+			wantStages: 1,
+		},
+		{
+			name:       "song best fields are merged one by one",
+			player:     PlayerChanges{SongBest: []SongBestRow{{SongID: 1, Difficulty: 3, BestCrown: 2, BestRate: 70, BestScore: 850000, BestScoreRank: 3}}},
+			wantReport: SyncReport{SongBestImproved: 1},
+			wantBest:   songBest{Crown: 2, Rate: 80, Score: 850000, ScoreRank: 4},
+			wantDan:    danResult{ArrivalSongCount: 3, ClearState: 1, ComboCountTotal: 500, SoulGaugeTotal: 90},
+			wantStages: 1,
+		},
+		{
+			name:       "stronger dan replaces the result and its stages",
+			player:     PlayerChanges{DanScores: []DanScoreRow{{DanID: 1, DanType: 1, ArrivalSongCount: 3, ClearState: 2, ComboCountTotal: 400, SoulGaugeTotal: 80, Stages: []DanStageRow{{SongNumber: 1}, {SongNumber: 2}, {SongNumber: 3}}}}},
+			wantReport: SyncReport{DanReplaced: 1},
+			wantBest:   songBest{Crown: 1, Rate: 80, Score: 800000, ScoreRank: 4},
+			wantDan:    danResult{ArrivalSongCount: 3, ClearState: 2, ComboCountTotal: 400, SoulGaugeTotal: 80},
+			wantStages: 3,
+		},
+		{
+			name:       "ai win is kept",
+			player:     PlayerChanges{AiScores: []AiScoreRow{{SongID: 1, Difficulty: 3, IsWin: true}}},
+			wantReport: SyncReport{AiScoresWon: 1},
+			wantBest:   songBest{Crown: 1, Rate: 80, Score: 800000, ScoreRank: 4},
+			wantDan:    danResult{ArrivalSongCount: 3, ClearState: 1, ComboCountTotal: 500, SoulGaugeTotal: 90},
+			wantStages: 1,
+			wantWin:    1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			db := openSyncDB(t)
+			tt.player.AccessCodes = []string{"CARD1"}
+			report, err := ApplyChangeSet(ctx, db, &ChangeSet{Origin: "other", Players: []PlayerChanges{tt.player}}, false, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Players != 1 || report.SongBestAdded != tt.wantReport.SongBestAdded || report.SongBestImproved != tt.wantReport.SongBestImproved ||
+				report.DanAdded != tt.wantReport.DanAdded || report.DanReplaced != tt.wantReport.DanReplaced ||
+				report.AiScoresAdded != tt.wantReport.AiScoresAdded || report.AiScoresWon != tt.wantReport.AiScoresWon {
+				t.Fatalf("report = %+v, want counts of %+v", report, tt.wantReport)
+			}
+
+			best, err := songBestByKey(ctx, db, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := best[songKey{SongID: 1, Difficulty: 3}]; got != tt.wantBest {
+				t.Fatalf("song best = %+v, want %+v", got, tt.wantBest)
+			}
+			dans, err := danResultsByKey(ctx, db, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := dans[danKey{DanID: 1, DanType: 1}]; got != tt.wantDan {
+				t.Fatalf("dan = %+v, want %+v", got, tt.wantDan)
+			}
+			var stages, win int
+			if err := db.QueryRow("SELECT COUNT(*) FROM DanStageScoreData WHERE Baid = 1").Scan(&stages); err != nil {
+				t.Fatal(err)
+			}
+			if stages != tt.wantStages {
+				t.Fatalf("dan stages = %d, want %d", stages, tt.wantStages)
+			}
+			if err := db.QueryRow("SELECT IsWin FROM AiScoreData WHERE Baid = 1").Scan(&win); err != nil {
+				t.Fatal(err)
+			}
+			if win != tt.wantWin {
+				t.Fatalf("ai win = %d, want %d", win, tt.wantWin)
+			}
+		})
+	}
+}
+
+func TestApplyTrackedChangeSetWatermark(t *testing.T) {
+	tests := []struct {
+		name          string
+		last          string
+		watermark     string
+		dryRun        bool
+		wantStale     bool
+		wantApplied   bool
+		wantWatermark string
+	}{
+		{"first sync", "", "2024-01-02 00:00:00", false, false, true, "2024-01-02 00:00:00"},
+		{"newer change set", "2024-01-01 00:00:00", "2024-01-02 00:00:00", false, false, true, "2024-01-02 00:00:00"},
+		{"same watermark", "2024-01-02 00:00:00", "2024-01-02 00:00:00", false, false, true, "2024-01-02 00:00:00"},
+		{"older change set", "2024-01-03 00:00:00", "2024-01-02 00:00:00", false, true, false, "2024-01-03 00:00:00"},
+		{"dry run keeps the watermark", "2024-01-01 00:00:00", "2024-01-02 00:00:00", true, false, false, "2024-01-01 00:00:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			db := openSyncDB(t)
+			state := &SyncState{Watermarks: map[string]string{}}
+			if tt.last != "" {
+				state.Watermarks["other"] = tt.last
+			}
+			cs := &ChangeSet{Origin: "other", Watermark: tt.watermark, Players: []PlayerChanges{{
+				AccessCodes: []string{"CARD1"},
+				SongBest:    []SongBestRow{{SongID: 1, Difficulty: 3, BestCrown: 1, BestRate: 80, BestScore: 900000, BestScoreRank: 4}},
+			}}}
+			report, err := ApplyTrackedChangeSet(ctx, db, cs, state, tt.dryRun, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Stale != tt.wantStale || report.Applied != tt.wantApplied {
+				t.Fatalf("report stale=%v applied=%v, want stale=%v applied=%v", report.Stale, report.Applied, tt.wantStale, tt.wantApplied)
+			}
+			if got := state.Watermarks["other"]; got != tt.wantWatermark {
+				t.Fatalf("watermark = %q, want %q", got, tt.wantWatermark)
+			}
+			var score int
+			if err := db.QueryRow("SELECT BestScore FROM SongBestData WHERE Baid = 1").Scan(&score); err != nil {
+				t.Fatal(err)
+			}
+			if want := map[bool]int{true: 900000, false: 800000}[tt.wantApplied]; score != want {
+				t.Fatalf("best score = %d, want %d", score, want)
+			}
+		})
+	}
+
+	t.Run("origin is required", func(t *testing.T) {
+		state := &SyncState{Watermarks: map[string]string{}}
+		if _, err := ApplyTrackedChangeSet(context.Background(), openSyncDB(t), &ChangeSet{Watermark: "2024-01-02"}, state, false, true); err == nil {
+			t.Fatal("expected an error for a change set without origin")
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sqlite "modernc.org/sqlite"
+)
+
+// slowQueryLog is read on every statement, so it is swapped atomically instead of locked.
+var slowQueryLog atomic.Pointer[slowQueryConfig]
+
+type slowQueryConfig struct {
+	threshold time.Duration
+	logf      func(format string, args ...any)
+}
+
+// SetSlowQueryLog makes every statement run through a connection from Open report to logf when
+// it takes longer than threshold. A zero threshold turns the log off.
+func SetSlowQueryLog(threshold time.Duration, logf func(format string, args ...any)) {
+	if threshold <= 0 || logf == nil {
+		slowQueryLog.Store(nil)
+		return
+	}
+	slowQueryLog.Store(&slowQueryConfig{threshold: threshold, logf: logf})
+}
+
+// observeQuery logs query if it ran for longer than the slow query threshold. Only the
+// parameterized SQL and the number of arguments are logged: the values can be password hashes
+// or access codes.
+func observeQuery(query string, args int, started time.Time) {
+	cfg := slowQueryLog.Load()
+	if cfg == nil {
+		return
+	}
+	elapsed := time.Since(started)
+	if elapsed < cfg.threshold {
+		return
+	}
+	cfg.logf("Slow query (%s, %d args): %s", elapsed.Round(time.Millisecond), args, strings.Join(strings.Fields(query), " "))
+}
+
+// timedConnector opens sqlite connections that time every statement. The time of a query runs
+// until its rows are closed, so reading the rows is included.
+type timedConnector struct {
+	dsn string
+}
+
+func (c timedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Driver().Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{conn: conn}, nil
+}
+
+func (c timedConnector) Driver() driver.Driver {
+	return &sqlite.Driver{}
+}
+
+// timedConn forwards to the sqlite connection. It implements the same optional interfaces the
+// sqlite driver does, so database/sql takes the same paths through it.
+type timedConn struct {
+	conn driver.Conn
+}
+
+func (c *timedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.conn.Prepare(query)
+}
+
+func (c *timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+}
+
+func (c *timedConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *timedConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *timedConn) Ping(ctx context.Context) error {
+	return c.conn.(driver.Pinger).Ping(ctx)
+}
+
+func (c *timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	started := time.Now()
+	res, err := c.conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+	observeQuery(query, len(args), started)
+	return res, err
+}
+
+func (c *timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	started := time.Now()
+	rows, err := c.conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+	if err != nil {
+		observeQuery(query, len(args), started)
+		return nil, err
+	}
+	return &timedRows{Rows: rows, query: query, args: len(args), started: started}, nil
+}
+
+type timedRows struct {
+	driver.Rows
+	query   string
+	args    int
+	started time.Time
+	once    sync.Once
+}
+
+func (r *timedRows) Close() error {
+	err := r.Rows.Close()
+	r.once.Do(func() { observeQuery(r.query, r.args, r.started) })
+	return err
+}
+
+func (r *timedRows) ColumnTypeDatabaseTypeName(index int) string {
+	if t, ok := r.Rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return t.ColumnTypeDatabaseTypeName(index)
+	}
+	return ""
+}
+
+func (r *timedRows) ColumnTypeLength(index int) (int64, bool) {
+	if t, ok := r.Rows.(driver.RowsColumnTypeLength); ok {
+		return t.ColumnTypeLength(index)
+	}
+	return 0, false
+}
+
+func (r *timedRows) ColumnTypeNullable(index int) (bool, bool) {
+	if t, ok := r.Rows.(driver.RowsColumnTypeNullable); ok {
+		return t.ColumnTypeNullable(index)
+	}
+	return false, false
+}
+
+func (r *timedRows) ColumnTypePrecisionScale(index int) (int64, int64, bool) {
+	if t, ok := r.Rows.(driver.RowsColumnTypePrecisionScale); ok {
+		return t.ColumnTypePrecisionScale(index)
+	}
+	return 0, 0, false
+}
+
+func (r *timedRows) ColumnTypeScanType(index int) reflect.Type {
+	if t, ok := r.Rows.(driver.RowsColumnTypeScanType); ok {
+		return t.ColumnTypeScanType(index)
+	}
+	return reflect.TypeOf(new(any)).Elem()
+}
@@ -19,6 +19,7 @@ type APIClient struct {
 	baseURL string
 	token   string
 	http    *http.Client
+	cache   *ResultCache
 }
 
 func NewAPIClient(baseURL, token string) (*APIClient, error) {
@@ -33,6 +34,12 @@ func NewAPIClient(baseURL, token string) (*APIClient, error) {
 	}, nil
 }
 
+// SetCache makes doJSON cache GET responses in cache. Any other request invalidates it, since it
+// may have changed what the GETs return.
+func (c *APIClient) SetCache(cache *ResultCache) {
+	c.cache = cache
+}
+
 func (c *APIClient) QueryNamed(ctx context.Context, name string, args []any, allowWrite bool) (map[string]any, error) {
 	switch name {
 	case "get_user_by_baid":
@@ -78,7 +85,21 @@ func (c *APIClient) QueryNamed(ctx context.Context, name string, args []any, all
 		if !allowWrite {
 			return nil, errors.New("write queries disabled")
 		}
-		return nil, errors.New("query not supported in api mode: update_user_name")
+		if len(args) == 0 {
+			return nil, errors.New("missing arg: name")
+		}
+		name, ok := args[0].(string)
+		if !ok {
+			return nil, errors.New("name must be a string")
+		}
+		baid, err := intArg(args, 1, "baid")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := c.UpdateProfile(ctx, baid, ProfileUpdate{MyDonName: &name}, allowWrite); err != nil {
+			return nil, err
+		}
+		return map[string]any{"rowsAffected": 1}, nil
 	default:
 		return nil, fmt.Errorf("unknown query: %s", name)
 	}
@@ -276,6 +297,19 @@ func (c *APIClient) cardsByBaid(ctx context.Context, baid int) ([]map[string]any
 }
 
 func (c *APIClient) doJSON(ctx context.Context, method, path string, body any, out any) error {
+	cached := method == http.MethodGet && out != nil && c.cache.enabled() && !cacheBypassed(ctx)
+	var generation uint64
+	if cached {
+		var data []byte
+		var ok bool
+		data, generation, ok = c.cache.lookup(ctx, path)
+		if ok && json.Unmarshal(data, out) == nil {
+			return nil
+		}
+	} else if method != http.MethodGet {
+		defer c.cache.Invalidate()
+	}
+
 	var bodyReader io.Reader
 	if body != nil {
 		b, err := json.Marshal(body)
@@ -312,7 +346,18 @@ func (c *APIClient) doJSON(ctx context.Context, method, path string, body any, o
 	if out == nil {
 		return nil
 	}
-	return json.NewDecoder(resp.Body).Decode(out)
+	if !cached {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return err
+	}
+	c.cache.store(path, generation, data)
+	return nil
 }
 
 func intArg(args []any, idx int, name string) (int, error) {
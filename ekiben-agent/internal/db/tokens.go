@@ -0,0 +1,297 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// TokenLedgerTable records every token change made by tokens.grant and tokens.set, and those
+	// made by player.merge and player.create while the ledger is turned on. It lives in the TLS
+	// database so that a change and its ledger entry are committed together; TLS itself never
+	// reads it.
+	TokenLedgerTable = "EkibenTokenLedger"
+
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// TokenFilter selects the players a bulk grant applies to. Exactly one of Baids, All and
+// PlayedWithinDays must be set.
+type TokenFilter struct {
+	Baids            []int
+	All              bool
+	PlayedWithinDays int
+}
+
+type TokenBalance struct {
+	Baid    int `json:"baid"`
+	TokenID int `json:"tokenId"`
+	Before  int `json:"before"`
+	Count   int `json:"count"`
+}
+
+type TokenLedgerEntry struct {
+	ID        int64  `json:"id"`
+	Baid      int    `json:"baid"`
+	TokenID   int    `json:"tokenId"`
+	Operation string `json:"operation"`
+	Delta     int    `json:"delta"`
+	Balance   int    `json:"balance"`
+	Reason    string `json:"reason"`
+	CreatedAt string `json:"createdAt"`
+}
+
+func ensureTokenLedger(ctx context.Context, q querier) error {
+	_, err := q.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+TokenLedgerTable+` (
+		Id INTEGER PRIMARY KEY AUTOINCREMENT,
+		Baid INTEGER NOT NULL,
+		TokenId INTEGER NOT NULL,
+		Operation TEXT NOT NULL,
+		Delta INTEGER NOT NULL,
+		Balance INTEGER NOT NULL,
+		Reason TEXT NOT NULL,
+		CreatedAt TEXT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS IX_"+TokenLedgerTable+"_Baid ON "+TokenLedgerTable+" (Baid, TokenId)")
+	return err
+}
+
+func tokenCount(ctx context.Context, q querier, baid, tokenID int) (int, error) {
+	var count int
+	err := q.QueryRowContext(ctx, "SELECT Count FROM Tokens WHERE Baid = ? AND Id = ?", baid, tokenID).Scan(&count)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return count, err
+}
+
+// writeTokenCount stores the new count for one player and records the change in the ledger.
+func writeTokenCount(ctx context.Context, q querier, baid, tokenID, before, count int, operation, reason string, now time.Time) error {
+	if _, err := q.ExecContext(ctx,
+		`INSERT INTO Tokens (Baid, Id, Count) VALUES (?, ?, ?)
+		ON CONFLICT (Baid, Id) DO UPDATE SET Count = excluded.Count`,
+		baid, tokenID, count); err != nil {
+		return err
+	}
+	return recordTokenChange(ctx, q, baid, tokenID, count-before, count, operation, reason, now)
+}
+
+// recordTokenChange adds a ledger entry for a change already written to Tokens. The ledger table
+// is created on first use.
+func recordTokenChange(ctx context.Context, q querier, baid, tokenID, delta, balance int, operation, reason string, now time.Time) error {
+	if err := ensureTokenLedger(ctx, q); err != nil {
+		return err
+	}
+	_, err := q.ExecContext(ctx,
+		"INSERT INTO "+TokenLedgerTable+" (Baid, TokenId, Operation, Delta, Balance, Reason, CreatedAt) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		baid, tokenID, operation, delta, balance, reason, now.Format(dbTimeLayout))
+	return err
+}
+
+// tokenTargets resolves filter to a list of Baids.
+func tokenTargets(ctx context.Context, q querier, filter TokenFilter, now time.Time) ([]int, error) {
+	set := 0
+	if len(filter.Baids) > 0 {
+		set++
+	}
+	if filter.All {
+		set++
+	}
+	if filter.PlayedWithinDays > 0 {
+		set++
+	}
+	if set != 1 {
+		return nil, errors.New("exactly one of baids, all or playedWithinDays is required")
+	}
+
+	if len(filter.Baids) > 0 {
+		baids, _ := unionIDs(nil, filter.Baids)
+		for _, baid := range baids {
+			if err := requirePlayer(ctx, q, baid); err != nil {
+				return nil, err
+			}
+		}
+		return baids, nil
+	}
+
+	query := "SELECT Baid FROM UserData ORDER BY Baid"
+	var args []any
+	if filter.PlayedWithinDays > 0 {
+		// LastPlayDatetime is stored in cabinet local time in a layout that sorts as text.
+		since := now.AddDate(0, 0, -filter.PlayedWithinDays).Format(dbTimeLayout)
+		query = "SELECT Baid FROM UserData WHERE LastPlayDatetime >= ? ORDER BY Baid"
+		args = append(args, since)
+	}
+	rows, err := queryRows(ctx, q, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	baids := make([]int, 0, len(rows))
+	for _, row := range rows {
+		baids = append(baids, rowInt(row, "Baid"))
+	}
+	return baids, nil
+}
+
+// GrantTokens adds delta (which may be negative) to tokenID for every player matched by filter.
+// The grant is all or nothing: if any balance would drop below zero nothing is written. Every
+// change is recorded in the token ledger.
+func GrantTokens(ctx context.Context, db *sql.DB, filter TokenFilter, tokenID, delta int, reason string, allowWrite bool) (map[string]any, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+	if delta == 0 {
+		return nil, errors.New("count must not be zero")
+	}
+	if err := validateTokenChange(tokenID, reason); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	balances := make([]TokenBalance, 0)
+	err := withTx(ctx, db, true, func(tx *sql.Tx) error {
+		baids, err := tokenTargets(ctx, tx, filter, now)
+		if err != nil {
+			return err
+		}
+		for _, baid := range baids {
+			before, err := tokenCount(ctx, tx, baid, tokenID)
+			if err != nil {
+				return err
+			}
+			count := before + delta
+			if count < 0 {
+				return fmt.Errorf("baid %d has %d of token %d, cannot remove %d", baid, before, tokenID, -delta)
+			}
+			if err := writeTokenCount(ctx, tx, baid, tokenID, before, count, "grant", reason, now); err != nil {
+				return err
+			}
+			balances = append(balances, TokenBalance{Baid: baid, TokenID: tokenID, Before: before, Count: count})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"ok": true, "players": len(balances), "balances": balances}, nil
+}
+
+// SetTokens overwrites the count of tokenID for one player and records the change in the token
+// ledger.
+func SetTokens(ctx context.Context, db *sql.DB, baid, tokenID, count int, reason string, allowWrite bool) (map[string]any, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+	if count < 0 {
+		return nil, errors.New("count must not be negative")
+	}
+	if err := validateTokenChange(tokenID, reason); err != nil {
+		return nil, err
+	}
+
+	var balance TokenBalance
+	err := withTx(ctx, db, true, func(tx *sql.Tx) error {
+		if err := requirePlayer(ctx, tx, baid); err != nil {
+			return err
+		}
+		before, err := tokenCount(ctx, tx, baid, tokenID)
+		if err != nil {
+			return err
+		}
+		balance = TokenBalance{Baid: baid, TokenID: tokenID, Before: before, Count: count}
+		if before == count {
+			return nil
+		}
+		return writeTokenCount(ctx, tx, baid, tokenID, before, count, "set", reason, time.Now())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"ok": true, "balance": balance}, nil
+}
+
+// TokenHistory lists ledger entries, newest first, optionally narrowed to one player and token.
+func TokenHistory(ctx context.Context, db *sql.DB, baid, tokenID, limit, offset *int) (map[string]any, error) {
+	n, off := defaultHistoryLimit, 0
+	if limit != nil {
+		n = *limit
+	}
+	if offset != nil {
+		off = *offset
+	}
+	if n <= 0 || n > maxHistoryLimit {
+		return nil, fmt.Errorf("limit must be between 1 and %d", maxHistoryLimit)
+	}
+	if off < 0 {
+		return nil, errors.New("offset must not be negative")
+	}
+
+	result := map[string]any{"entries": []TokenLedgerEntry{}, "total": 0, "limit": n, "offset": off}
+	var exists int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", TokenLedgerTable).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return result, nil
+	}
+
+	var where []string
+	var args []any
+	if baid != nil {
+		where = append(where, "Baid = ?")
+		args = append(args, *baid)
+	}
+	if tokenID != nil {
+		where = append(where, "TokenId = ?")
+		args = append(args, *tokenID)
+	}
+	whereSQL := ""
+	if len(where) > 0 {
+		whereSQL = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	var total int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+TokenLedgerTable+whereSQL, args...).Scan(&total); err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx,
+		"SELECT Id, Baid, TokenId, Operation, Delta, Balance, Reason, CreatedAt FROM "+TokenLedgerTable+whereSQL+
+			" ORDER BY Id DESC LIMIT ? OFFSET ?", append(args, n, off)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]TokenLedgerEntry, 0)
+	for rows.Next() {
+		var e TokenLedgerEntry
+		if err := rows.Scan(&e.ID, &e.Baid, &e.TokenID, &e.Operation, &e.Delta, &e.Balance, &e.Reason, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	result["entries"] = entries
+	result["total"] = total
+	return result, nil
+}
+
+func validateTokenChange(tokenID int, reason string) error {
+	if tokenID < 0 {
+		return errors.New("tokenId must not be negative")
+	}
+	if strings.TrimSpace(reason) == "" {
+		return errors.New("reason is required")
+	}
+	return nil
+}
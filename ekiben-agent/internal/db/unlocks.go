@@ -0,0 +1,236 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// unlockKinds maps the unlock kinds used in requests to their UserData list columns.
+var unlockKinds = map[string]string{
+	"songs":    "UnlockedSongIdList",
+	"uraSongs": "UnlockedUraSongIdList",
+	"body":     "UnlockedBody",
+	"face":     "UnlockedFace",
+	"head":     "UnlockedHead",
+	"kigurumi": "UnlockedKigurumi",
+	"puchi":    "UnlockedPuchi",
+	"titles":   "TitleFlgArray",
+}
+
+// UnlockChange is the per-player outcome of a grant or revoke, keyed by unlock kind. Kinds that
+// did not change are left out.
+type UnlockChange struct {
+	Baid       int              `json:"baid"`
+	Changed    map[string][]int `json:"changed"`
+	Unequipped map[string]int   `json:"unequipped,omitempty"`
+}
+
+// GetUnlocks returns the decoded unlock lists of baid, keyed by unlock kind.
+func GetUnlocks(ctx context.Context, db *sql.DB, baid int) (map[string]any, error) {
+	lists, err := readUnlockColumns(ctx, db, baid)
+	if err != nil {
+		return nil, err
+	}
+	unlocks := make(map[string][]int, len(unlockKinds))
+	for kind, column := range unlockKinds {
+		unlocks[kind] = lists[column]
+	}
+	return map[string]any{"baid": baid, "unlocks": unlocks}, nil
+}
+
+// ChangeUnlocks grants or revokes ids for the given players, or for every player when all is set,
+// in one transaction. Granting an id that is already unlocked and revoking one that is not are
+// no-ops. Revoking the costume part a player has equipped puts part 0 back on, so part 0 itself
+// cannot be revoked.
+func ChangeUnlocks(ctx context.Context, db *sql.DB, baids []int, all bool, unlocks map[string][]int, revoke bool, allowWrite bool) (map[string]any, error) {
+	if !allowWrite {
+		return nil, errors.New("write queries disabled")
+	}
+	if len(baids) == 0 && !all {
+		return nil, errors.New("baid or all is required")
+	}
+	changes, err := normalizeUnlocks(unlocks, revoke)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []UnlockChange
+	err = withTx(ctx, db, true, func(tx *sql.Tx) error {
+		targets := baids
+		if all {
+			rows, err := queryRows(ctx, tx, "SELECT Baid FROM UserData ORDER BY Baid")
+			if err != nil {
+				return err
+			}
+			targets = make([]int, 0, len(rows))
+			for _, row := range rows {
+				targets = append(targets, rowInt(row, "Baid"))
+			}
+		}
+
+		for _, baid := range targets {
+			change, err := changePlayerUnlocks(ctx, tx, baid, changes, revoke)
+			if err != nil {
+				return fmt.Errorf("baid %d: %w", baid, err)
+			}
+			if len(change.Changed) > 0 {
+				results = append(results, change)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if results == nil {
+		results = []UnlockChange{}
+	}
+	return map[string]any{"ok": true, "players": results, "changedPlayers": len(results)}, nil
+}
+
+// normalizeUnlocks maps request kinds to columns and rejects unknown kinds and invalid ids.
+func normalizeUnlocks(unlocks map[string][]int, revoke bool) (map[string][]int, error) {
+	if len(unlocks) == 0 {
+		return nil, errors.New("unlocks are required")
+	}
+	changes := make(map[string][]int, len(unlocks))
+	for kind, ids := range unlocks {
+		column, ok := unlockKinds[kind]
+		if !ok {
+			return nil, fmt.Errorf("unknown unlock kind: %s", kind)
+		}
+		for _, id := range ids {
+			if id < 0 {
+				return nil, fmt.Errorf("%s id must not be negative", kind)
+			}
+			if revoke && id == 0 && isCostumeColumn(column) {
+				return nil, fmt.Errorf("%s part 0 cannot be revoked", kind)
+			}
+		}
+		merged, _ := unionIDs(nil, ids)
+		changes[column] = merged
+	}
+	return changes, nil
+}
+
+func changePlayerUnlocks(ctx context.Context, tx *sql.Tx, baid int, changes map[string][]int, revoke bool) (UnlockChange, error) {
+	change := UnlockChange{Baid: baid, Changed: make(map[string][]int)}
+	lists, err := readUnlockColumns(ctx, tx, baid)
+	if err != nil {
+		return change, err
+	}
+
+	values := make(map[string]any)
+	for column, ids := range changes {
+		var updated, changed []int
+		if revoke {
+			updated, changed = removeIDs(lists[column], ids)
+		} else {
+			updated, changed = unionIDs(lists[column], ids)
+		}
+		if len(changed) == 0 {
+			continue
+		}
+		values[column] = encodeIDList(updated)
+		change.Changed[unlockKind(column)] = changed
+	}
+	if len(values) == 0 {
+		return change, nil
+	}
+
+	if revoke {
+		if err := unequipRevoked(ctx, tx, baid, changes, values, &change); err != nil {
+			return change, err
+		}
+	}
+
+	setSQL, args, err := buildSet("UserData", values)
+	if err != nil {
+		return change, err
+	}
+	args = append(args, baid)
+	_, err = tx.ExecContext(ctx, "UPDATE UserData SET "+setSQL+" WHERE Baid = ?", args...)
+	return change, err
+}
+
+// unequipRevoked puts part 0 back on for every equipped costume part that was just revoked and
+// rewrites CostumeData to match.
+func unequipRevoked(ctx context.Context, tx *sql.Tx, baid int, changes map[string][]int, values map[string]any, change *UnlockChange) error {
+	cols := make([]string, len(costumeDataOrder))
+	for i, column := range costumeDataOrder {
+		cols[i] = quoteIdent(column)
+	}
+	rows, err := queryRows(ctx, tx, fmt.Sprintf("SELECT %s FROM UserData WHERE Baid = ?", strings.Join(cols, ", ")), baid)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return fmt.Errorf("player not found: %d", baid)
+	}
+
+	costume := make([]int, len(costumeDataOrder))
+	unequipped := false
+	for i, column := range costumeDataOrder {
+		costume[i] = rowInt(rows[0], column)
+		revoked := make(map[int]struct{})
+		for _, id := range changes[CostumeColumns[column]] {
+			revoked[id] = struct{}{}
+		}
+		if _, ok := revoked[costume[i]]; !ok {
+			continue
+		}
+		if change.Unequipped == nil {
+			change.Unequipped = make(map[string]int)
+		}
+		change.Unequipped[unlockKind(CostumeColumns[column])] = costume[i]
+		costume[i] = 0
+		values[column] = 0
+		unequipped = true
+	}
+	if unequipped {
+		values["CostumeData"] = encodeIDList(costume)
+	}
+	return nil
+}
+
+// removeIDs drops the ids in remove from base, keeping the order of base. It returns the
+// remaining list and the ids that were actually removed.
+func removeIDs(base, remove []int) ([]int, []int) {
+	drop := make(map[int]struct{}, len(remove))
+	for _, id := range remove {
+		drop[id] = struct{}{}
+	}
+	kept := make([]int, 0, len(base))
+	removed := make([]int, 0)
+	for _, id := range base {
+		if _, ok := drop[id]; ok {
+			removed = append(removed, id)
+			continue
+		}
+		kept = append(kept, id)
+	}
+	sort.Ints(removed)
+	return kept, removed
+}
+
+func isCostumeColumn(column string) bool {
+	for _, unlock := range CostumeColumns {
+		if unlock == column {
+			return true
+		}
+	}
+	return false
+}
+
+func unlockKind(column string) string {
+	for kind, c := range unlockKinds {
+		if c == column {
+			return kind
+		}
+	}
+	return column
+}
@@ -0,0 +1,31 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRemoveIDs(t *testing.T) {
+	tests := []struct {
+		name        string
+		base        []int
+		remove      []int
+		wantKept    []int
+		wantRemoved []int
+	}{
+		{"nothing to remove", []int{1, 2, 3}, nil, []int{1, 2, 3}, []int{}},
+		{"empty base", nil, []int{1}, []int{}, []int{}},
+		{"keeps the order of base", []int{5, 1, 4, 2}, []int{4}, []int{5, 1, 2}, []int{4}},
+		{"removed ids are sorted", []int{9, 3, 7}, []int{7, 9}, []int{3}, []int{7, 9}},
+		{"unknown ids are not reported", []int{1, 2}, []int{2, 8}, []int{1}, []int{2}},
+		{"duplicates in base all go", []int{1, 2, 1}, []int{1}, []int{2}, []int{1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, removed := removeIDs(tt.base, tt.remove)
+			if !reflect.DeepEqual(kept, tt.wantKept) || !reflect.DeepEqual(removed, tt.wantRemoved) {
+				t.Fatalf("removeIDs(%v, %v) = %v, %v, want %v, %v", tt.base, tt.remove, kept, removed, tt.wantKept, tt.wantRemoved)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxDonNameLength = 10
+	maxTitleLength   = 20
+)
+
+// CostumeColumns are the UserData columns for the equipped costume parts, each paired with the
+// unlock list it must be part of.
+var CostumeColumns = map[string]string{
+	"CurrentKigurumi": "UnlockedKigurumi",
+	"CurrentHead":     "UnlockedHead",
+	"CurrentBody":     "UnlockedBody",
+	"CurrentFace":     "UnlockedFace",
+	"CurrentPuchi":    "UnlockedPuchi",
+}
+
+// UnlockColumns are the UserData columns holding packed lists of unlocked ids.
+var UnlockColumns = []string{
+	"UnlockedSongIdList", "UnlockedUraSongIdList", "UnlockedBody", "UnlockedFace",
+	"UnlockedHead", "UnlockedKigurumi", "UnlockedPuchi", "TitleFlgArray",
+}
+
+// decodeIDList decodes a packed list column. TLS stores these as JSON arrays in TEXT columns.
+func decodeIDList(value any) ([]int, error) {
+	var raw []byte
+	switch v := value.(type) {
+	case nil:
+		return []int{}, nil
+	case string:
+		raw = []byte(v)
+	case []byte:
+		raw = v
+	default:
+		return nil, fmt.Errorf("unsupported list value: %T", value)
+	}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return []int{}, nil
+	}
+
+	var ids []int
+	if err := json.Unmarshal(raw, &ids); err != nil {
+		return nil, fmt.Errorf("invalid list value: %w", err)
+	}
+	if ids == nil {
+		ids = []int{}
+	}
+	return ids, nil
+}
+
+func encodeIDList(ids []int) string {
+	if len(ids) == 0 {
+		return "[]"
+	}
+	b, _ := json.Marshal(ids)
+	return string(b)
+}
+
+// unionIDs appends the ids from extra that are missing in base, keeping the order of both.
+// It returns the merged list and the ids that were added.
+func unionIDs(base, extra []int) ([]int, []int) {
+	seen := make(map[int]struct{}, len(base))
+	merged := make([]int, 0, len(base)+len(extra))
+	for _, id := range base {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		merged = append(merged, id)
+	}
+
+	added := make([]int, 0)
+	for _, id := range extra {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		merged = append(merged, id)
+		added = append(added, id)
+	}
+	return merged, added
+}
+
+// newUserDefaults returns a UserData row as the game creates it for a fresh card: the default
+// name, costume part 0 equipped and unlocked, and empty lists for everything else.
+func newUserDefaults(now time.Time) map[string]any {
+	return map[string]any{
+		"AchievementDisplayDifficulty": 0,
+		"AiWinCount":                   0,
+		"ColorBody":                    0,
+		"ColorFace":                    0,
+		"ColorLimb":                    0,
+		"CostumeData":                  "[0,0,0,0,0]",
+		"CostumeFlgArray":              "[]",
+		"DifficultyPlayedArray":        "[]",
+		"DifficultySettingArray":       "[]",
+		"DisplayAchievement":           true,
+		"DisplayDan":                   true,
+		"FavoriteSongsArray":           "[]",
+		"GenericInfoFlgArray":          "[]",
+		"IsAdmin":                      false,
+		"IsSkipOn":                     false,
+		"IsVoiceOn":                    true,
+		"LastPlayDatetime":             now.Format(dbTimeLayout),
+		"LastPlayMode":                 0,
+		"MyDonName":                    "どんちゃん",
+		"MyDonNameLanguage":            0,
+		"NotesPosition":                0,
+		"OptionSetting":                0,
+		"SelectedToneId":               0,
+		"Title":                        "",
+		"TitleFlgArray":                "[]",
+		"TitlePlateId":                 0,
+		"ToneFlgArray":                 "[0]",
+		"UnlockedSongIdList":           "[]",
+		"UnlockedUraSongIdList":        "[]",
+		"UnlockedBody":                 "[0]",
+		"UnlockedFace":                 "[0]",
+		"UnlockedHead":                 "[0]",
+		"UnlockedKigurumi":             "[0]",
+		"UnlockedPuchi":                "[0]",
+		"CurrentBody":                  0,
+		"CurrentFace":                  0,
+		"CurrentHead":                  0,
+		"CurrentKigurumi":              0,
+		"CurrentPuchi":                 0,
+		"DifficultyPlayedCourse":       0,
+		"DifficultyPlayedSort":         0,
+		"DifficultyPlayedStar":         0,
+		"DifficultySettingCourse":      0,
+		"DifficultySettingSort":        0,
+		"DifficultySettingStar":        0,
+	}
+}
+
+func validateDonName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("MyDonName must not be empty")
+	}
+	if err := validateText("MyDonName", name, maxDonNameLength); err != nil {
+		return err
+	}
+	// The name plate font only covers the Basic Multilingual Plane, so emoji and other
+	// supplementary characters render as blanks on the cabinet.
+	for _, r := range name {
+		if r > 0xFFFF || unicode.Is(unicode.Co, r) {
+			return fmt.Errorf("MyDonName contains an unsupported character %q", r)
+		}
+	}
+	return nil
+}
+
+func validateTitle(title string) error {
+	return validateText("Title", title, maxTitleLength)
+}
+
+func validateText(field, value string, maxLength int) error {
+	if !utf8.ValidString(value) {
+		return fmt.Errorf("%s is not valid UTF-8", field)
+	}
+	if n := utf8.RuneCountInString(value); n > maxLength {
+		return fmt.Errorf("%s is too long: %d characters, at most %d allowed", field, n, maxLength)
+	}
+	for _, r := range value {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return fmt.Errorf("%s contains an unsupported character %q", field, r)
+		}
+	}
+	return nil
+}
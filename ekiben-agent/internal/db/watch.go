@@ -0,0 +1,289 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Change feed event types.
+const (
+	EventPlayRecorded  = "play.recorded"
+	EventDanResult     = "dan.result"
+	EventCardBound     = "card.bound"
+	EventPlayerCreated = "player.created"
+)
+
+// watchBatchSize caps the rows read per table and poll, so a large backlog is delivered over
+// several polls instead of one huge burst.
+const watchBatchSize = 200
+
+type watchedTable struct {
+	table   string
+	event   string
+	columns []string
+	// key is set for tables that are compared against a snapshot instead of followed by rowid.
+	key []string
+}
+
+// watchedTables lists the tables the change feed follows. New rows are found by rowid, so rows
+// that TLS updates in place (a renamed player) are not reported again. DanScoreData is the
+// exception: TLS overwrites a dan result when it improves, so that table is small enough to be
+// compared against a snapshot of the previous poll.
+var watchedTables = []watchedTable{
+	{"SongPlayData", EventPlayRecorded, []string{"Id", "Baid", "SongId", "Difficulty", "Score", "ScoreRate", "ScoreRank", "Crown", "Skipped", "PlayTime"}, nil},
+	{"DanScoreData", EventDanResult, []string{"Baid", "DanId", "DanType", "ClearState", "ArrivalSongCount", "SoulGaugeTotal", "ComboCountTotal"}, []string{"Baid", "DanId", "DanType"}},
+	{"Card", EventCardBound, []string{"AccessCode", "Baid"}, nil},
+	{"UserData", EventPlayerCreated, []string{"Baid", "MyDonName"}, nil},
+}
+
+// EventTypes returns every event type the change feed can produce.
+func EventTypes() []string {
+	types := make([]string, 0, len(watchedTables))
+	for _, w := range watchedTables {
+		types = append(types, w.event)
+	}
+	return types
+}
+
+// ChangeEvent is one new or changed row. Previous holds the row as it was before the change for
+// snapshot tables, and is nil for new rows.
+type ChangeEvent struct {
+	Event    string         `json:"event"`
+	Data     map[string]any `json:"data"`
+	Previous map[string]any `json:"previous,omitempty"`
+}
+
+// Watcher detects new and changed rows in the watched tables. It holds its own connection because
+// PRAGMA data_version is only meaningful when asked on the same connection each time: it
+// changes when another connection commits.
+type Watcher struct {
+	db          *sql.DB
+	conn        *sql.Conn
+	tables      []watchedTable
+	dataVersion int64
+	lastRowID   map[string]int64
+	snapshots   map[string]map[string]map[string]any
+	// backlog is set when a table had more new rows than one batch; the rest is read on the next
+	// poll even if nothing was committed in between.
+	backlog bool
+}
+
+// NewWatcher returns a watcher for the given event types. Rows that exist when the watcher
+// starts are not reported.
+func NewWatcher(ctx context.Context, db *sql.DB, events []string) (*Watcher, error) {
+	w := &Watcher{db: db, lastRowID: make(map[string]int64), snapshots: make(map[string]map[string]map[string]any)}
+	for _, event := range events {
+		found := false
+		for _, t := range watchedTables {
+			if t.event != event {
+				continue
+			}
+			found = true
+			if !w.watches(t.table) {
+				w.tables = append(w.tables, t)
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown event type: %s", event)
+		}
+	}
+
+	if err := w.connect(ctx); err != nil {
+		return nil, err
+	}
+	for _, t := range w.tables {
+		if len(t.key) > 0 {
+			snapshot, err := w.snapshot(ctx, t)
+			if err != nil {
+				w.Close()
+				return nil, err
+			}
+			w.snapshots[t.table] = snapshot
+			continue
+		}
+		max, err := w.maxRowID(ctx, t.table)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w.lastRowID[t.table] = max
+	}
+	return w, nil
+}
+
+func (w *Watcher) watches(table string) bool {
+	for _, t := range w.tables {
+		if t.table == table {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Watcher) connect(ctx context.Context) error {
+	conn, err := w.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	version, err := w.readDataVersion(ctx)
+	if err != nil {
+		conn.Close()
+		w.conn = nil
+		return err
+	}
+	w.dataVersion = version
+	return nil
+}
+
+func (w *Watcher) Close() error {
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+func (w *Watcher) readDataVersion(ctx context.Context) (int64, error) {
+	var version int64
+	err := w.conn.QueryRowContext(ctx, "PRAGMA data_version").Scan(&version)
+	return version, err
+}
+
+func (w *Watcher) maxRowID(ctx context.Context, table string) (int64, error) {
+	var max sql.NullInt64
+	err := w.conn.QueryRowContext(ctx, fmt.Sprintf("SELECT MAX(rowid) FROM %s", quoteIdent(table))).Scan(&max)
+	return max.Int64, err
+}
+
+// Poll returns the events for rows added or changed since the previous poll. It is cheap when nothing was
+// committed in between and no backlog is left, since then only PRAGMA data_version is read.
+func (w *Watcher) Poll(ctx context.Context) ([]ChangeEvent, error) {
+	if w.conn == nil {
+		// The previous connection failed; start over on a new one. Its data_version is not
+		// comparable with the old one, so check the tables unconditionally.
+		if err := w.connect(ctx); err != nil {
+			return nil, err
+		}
+	} else {
+		version, err := w.readDataVersion(ctx)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		if version == w.dataVersion && !w.backlog {
+			return nil, nil
+		}
+		w.dataVersion = version
+	}
+
+	w.backlog = false
+	var events []ChangeEvent
+	for _, t := range w.tables {
+		tableEvents, err := w.pollTable(ctx, t)
+		if err != nil {
+			w.Close()
+			return events, fmt.Errorf("%s: %w", t.table, err)
+		}
+		events = append(events, tableEvents...)
+	}
+	return events, nil
+}
+
+func (w *Watcher) pollTable(ctx context.Context, t watchedTable) ([]ChangeEvent, error) {
+	if len(t.key) > 0 {
+		return w.pollSnapshot(ctx, t)
+	}
+	last := w.lastRowID[t.table]
+	max, err := w.maxRowID(ctx, t.table)
+	if err != nil {
+		return nil, err
+	}
+	if max < last {
+		// Rows were deleted from the end of the table; new rows may reuse their rowids.
+		w.lastRowID[t.table] = max
+		return nil, nil
+	}
+	if max == last {
+		return nil, nil
+	}
+
+	cols := make([]string, len(t.columns))
+	for i, col := range t.columns {
+		cols[i] = quoteIdent(col)
+	}
+	query := fmt.Sprintf("SELECT rowid AS _rowid, %s FROM %s WHERE rowid > ? ORDER BY rowid LIMIT ?",
+		strings.Join(cols, ", "), quoteIdent(t.table))
+	rows, err := queryRows(ctx, w.conn, query, last, watchBatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]ChangeEvent, 0, len(rows))
+	for _, row := range rows {
+		rowID, _ := anyToIntNoError(row["_rowid"])
+		delete(row, "_rowid")
+		w.lastRowID[t.table] = int64(rowID)
+		events = append(events, ChangeEvent{Event: t.event, Data: row})
+	}
+	if w.lastRowID[t.table] < max {
+		w.backlog = true
+	}
+	return events, nil
+}
+
+func (w *Watcher) snapshot(ctx context.Context, t watchedTable) (map[string]map[string]any, error) {
+	cols := make([]string, len(t.columns))
+	for i, col := range t.columns {
+		cols[i] = quoteIdent(col)
+	}
+	rows, err := queryRows(ctx, w.conn, fmt.Sprintf("SELECT %s FROM %s", strings.Join(cols, ", "), quoteIdent(t.table)))
+	if err != nil {
+		return nil, err
+	}
+	snapshot := make(map[string]map[string]any, len(rows))
+	for _, row := range rows {
+		snapshot[rowKey(row, t.key)] = row
+	}
+	return snapshot, nil
+}
+
+// pollSnapshot reports rows that are new or differ from the previous snapshot. Deleted rows are
+// not reported.
+func (w *Watcher) pollSnapshot(ctx context.Context, t watchedTable) ([]ChangeEvent, error) {
+	current, err := w.snapshot(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	previous := w.snapshots[t.table]
+	w.snapshots[t.table] = current
+
+	keys := make([]string, 0, len(current))
+	for key := range current {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var events []ChangeEvent
+	for _, key := range keys {
+		row := current[key]
+		before, ok := previous[key]
+		if ok && rowKey(before, t.columns) == rowKey(row, t.columns) {
+			continue
+		}
+		events = append(events, ChangeEvent{Event: t.event, Data: row, Previous: before})
+	}
+	return events, nil
+}
+
+func rowKey(row map[string]any, columns []string) string {
+	parts := make([]string, len(columns))
+	for i, col := range columns {
+		parts[i] = fmt.Sprintf("%v", row[col])
+	}
+	return strings.Join(parts, "\x00")
+}
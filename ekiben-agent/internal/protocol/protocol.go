@@ -12,6 +12,10 @@ type Envelope struct {
 	AgentID string          `json:"agentId,omitempty"`
 	Version string          `json:"version,omitempty"`
 	Meta    map[string]any  `json:"meta,omitempty"`
+	Event   string          `json:"event,omitempty"`
+	Data    any             `json:"data,omitempty"`
+	// Source names the data source a response or event comes from, when it is not the default one.
+	Source string `json:"source,omitempty"`
 }
 
 type Error struct {
@@ -20,17 +24,19 @@ type Error struct {
 }
 
 type QueryParams struct {
-	Name string `json:"name"`
-	Args []any  `json:"args"`
+	Name    string `json:"name"`
+	Args    []any  `json:"args"`
+	Explain bool   `json:"explain,omitempty"`
 }
 
 type TableSelectParams struct {
-	Table   string              `json:"table"`
-	Columns []string            `json:"columns,omitempty"`
-	Filters map[string]any      `json:"filters,omitempty"`
-	OrderBy []TableOrderBy      `json:"orderBy,omitempty"`
-	Limit   *int                `json:"limit,omitempty"`
-	Offset  *int                `json:"offset,omitempty"`
+	Table   string         `json:"table"`
+	Columns []string       `json:"columns,omitempty"`
+	Filters map[string]any `json:"filters,omitempty"`
+	OrderBy []TableOrderBy `json:"orderBy,omitempty"`
+	Limit   *int           `json:"limit,omitempty"`
+	Offset  *int           `json:"offset,omitempty"`
+	Explain bool           `json:"explain,omitempty"`
 }
 
 type TableOrderBy struct {
@@ -84,3 +90,206 @@ type DanRemoveParams struct {
 type ConfigSetParams struct {
 	Config map[string]any `json:"config"`
 }
+
+type PlayerMergeParams struct {
+	SourceBaid int  `json:"sourceBaid"`
+	TargetBaid int  `json:"targetBaid"`
+	Preview    bool `json:"preview,omitempty"`
+}
+
+type SyncExportParams struct {
+	Since string `json:"since,omitempty"`
+}
+
+type SyncApplyParams struct {
+	ChangeSet  json.RawMessage `json:"changeSet,omitempty"`
+	FromDBPath string          `json:"fromDbPath,omitempty"`
+	Full       bool            `json:"full,omitempty"`
+	DryRun     bool            `json:"dryRun,omitempty"`
+}
+
+type PlayerRebuildBestParams struct {
+	Baid  *int `json:"baid,omitempty"`
+	Apply bool `json:"apply,omitempty"`
+	Exact bool `json:"exact,omitempty"`
+}
+
+type PlayerStatsParams struct {
+	Baid int `json:"baid"`
+}
+
+type LeaderboardSongParams struct {
+	SongID     int  `json:"songId"`
+	Difficulty int  `json:"difficulty"`
+	Limit      *int `json:"limit,omitempty"`
+	Offset     *int `json:"offset,omitempty"`
+	Baid       *int `json:"baid,omitempty"`
+}
+
+type LeaderboardOverallParams struct {
+	By string `json:"by"`
+	// DanType picks the dan courses ranked by "dan": 1 (regular, the default) or 2 (gaiden).
+	DanType *int `json:"danType,omitempty"`
+	Limit   *int `json:"limit,omitempty"`
+	Offset  *int `json:"offset,omitempty"`
+	Baid    *int `json:"baid,omitempty"`
+}
+
+type CardBindParams struct {
+	Baid       int    `json:"baid"`
+	AccessCode string `json:"accessCode"`
+}
+
+type CardUnbindParams struct {
+	AccessCode string `json:"accessCode"`
+	Force      bool   `json:"force,omitempty"`
+}
+
+type CardTransferParams struct {
+	AccessCode string `json:"accessCode"`
+	TargetBaid int    `json:"targetBaid"`
+	Force      bool   `json:"force,omitempty"`
+}
+
+type CardLookupParams struct {
+	AccessCode string `json:"accessCode"`
+}
+
+type PlayerCreateParams struct {
+	AccessCode   string         `json:"accessCode"`
+	MyDonName    *string        `json:"myDonName,omitempty"`
+	Title        *string        `json:"title,omitempty"`
+	TitlePlateID *int           `json:"titlePlateId,omitempty"`
+	Costume      map[string]int `json:"costume,omitempty"`
+	Password     string         `json:"password,omitempty"`
+	Tokens       map[int]int    `json:"tokens,omitempty"`
+}
+
+type PlayerDeleteParams struct {
+	Baid      int  `json:"baid"`
+	Anonymize bool `json:"anonymize,omitempty"`
+}
+
+type CredentialSetParams struct {
+	Baid      int    `json:"baid"`
+	Password  string `json:"password"`
+	ResetCode string `json:"resetCode,omitempty"`
+}
+
+type CredentialResetParams struct {
+	Baid int `json:"baid"`
+}
+
+type PlayerUnlocksGetParams struct {
+	Baid int `json:"baid"`
+}
+
+type PlayerUnlocksChangeParams struct {
+	Baid    int              `json:"baid,omitempty"`
+	Baids   []int            `json:"baids,omitempty"`
+	All     bool             `json:"all,omitempty"`
+	Unlocks map[string][]int `json:"unlocks"`
+}
+
+type TokensGrantParams struct {
+	TokenID          int    `json:"tokenId"`
+	Count            int    `json:"count"`
+	Reason           string `json:"reason"`
+	Baid             int    `json:"baid,omitempty"`
+	Baids            []int  `json:"baids,omitempty"`
+	All              bool   `json:"all,omitempty"`
+	PlayedWithinDays int    `json:"playedWithinDays,omitempty"`
+}
+
+type TokensSetParams struct {
+	Baid    int    `json:"baid"`
+	TokenID int    `json:"tokenId"`
+	Count   int    `json:"count"`
+	Reason  string `json:"reason"`
+}
+
+type TokensHistoryParams struct {
+	Baid    *int `json:"baid,omitempty"`
+	TokenID *int `json:"tokenId,omitempty"`
+	Limit   *int `json:"limit,omitempty"`
+	Offset  *int `json:"offset,omitempty"`
+}
+
+type PlayerProfileUpdateParams struct {
+	Baid                         int            `json:"baid"`
+	MyDonName                    *string        `json:"myDonName,omitempty"`
+	MyDonNameLanguage            *int           `json:"myDonNameLanguage,omitempty"`
+	Title                        *string        `json:"title,omitempty"`
+	TitlePlateID                 *int           `json:"titlePlateId,omitempty"`
+	ColorBody                    *int           `json:"colorBody,omitempty"`
+	ColorFace                    *int           `json:"colorFace,omitempty"`
+	ColorLimb                    *int           `json:"colorLimb,omitempty"`
+	Costume                      map[string]int `json:"costume,omitempty"`
+	IsVoiceOn                    *bool          `json:"isVoiceOn,omitempty"`
+	IsSkipOn                     *bool          `json:"isSkipOn,omitempty"`
+	NotesPosition                *int           `json:"notesPosition,omitempty"`
+	DisplayAchievement           *bool          `json:"displayAchievement,omitempty"`
+	AchievementDisplayDifficulty *int           `json:"achievementDisplayDifficulty,omitempty"`
+	DisplayDan                   *bool          `json:"displayDan,omitempty"`
+}
+
+type PlayerFavoritesParams struct {
+	Baid    int   `json:"baid"`
+	SongIDs []int `json:"songIds,omitempty"`
+}
+
+type SessionsParams struct {
+	Baid       *int   `json:"baid,omitempty"`
+	From       string `json:"from,omitempty"`
+	To         string `json:"to,omitempty"`
+	GapMinutes int    `json:"gapMinutes,omitempty"`
+	Limit      *int   `json:"limit,omitempty"`
+	Offset     *int   `json:"offset,omitempty"`
+}
+
+type AnalyticsUsageParams struct {
+	From     string `json:"from,omitempty"`
+	To       string `json:"to,omitempty"`
+	Top      int    `json:"top,omitempty"`
+	TimeZone string `json:"timeZone,omitempty"`
+	Refresh  bool   `json:"refresh,omitempty"`
+}
+
+type DBPruneParams struct {
+	KeepDays  *int  `json:"keepDays,omitempty"`
+	KeepPlays *int  `json:"keepPlays,omitempty"`
+	Vacuum    *bool `json:"vacuum,omitempty"`
+	Preview   bool  `json:"preview,omitempty"`
+}
+
+type SQLQueryParams struct {
+	SQL     string `json:"sql"`
+	Args    []any  `json:"args,omitempty"`
+	MaxRows int    `json:"maxRows,omitempty"`
+}
+
+// TableExportParams selects rows like TableSelectParams. Without File the output is sent back as
+// chunk envelopes carrying the request id, followed by the response. The last chunk has no data
+// and says whether the stream is complete.
+type TableExportParams struct {
+	Table   string         `json:"table"`
+	Columns []string       `json:"columns,omitempty"`
+	Filters map[string]any `json:"filters,omitempty"`
+	OrderBy []TableOrderBy `json:"orderBy,omitempty"`
+	Limit   *int           `json:"limit,omitempty"`
+	Offset  *int           `json:"offset,omitempty"`
+	Format  string         `json:"format,omitempty"`
+	File    string         `json:"file,omitempty"`
+}
+
+// TableImportParams loads CSV or NDJSON rows into a table. The rows are given inline in Data, or
+// read from File in the export directory. Columns maps source columns to table columns.
+type TableImportParams struct {
+	Table   string            `json:"table"`
+	Format  string            `json:"format,omitempty"`
+	Mode    string            `json:"mode,omitempty"`
+	Columns map[string]string `json:"columns,omitempty"`
+	Data    string            `json:"data,omitempty"`
+	File    string            `json:"file,omitempty"`
+	DryRun  bool              `json:"dryRun,omitempty"`
+}